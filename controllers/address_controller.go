@@ -0,0 +1,126 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/rules"
+	"github.com/kakao/network-node-manager/pkg/statusaddr"
+)
+
+// Variables
+var (
+	// The services for the addresses of the resources before the addresses are deduped
+	addressClaims = map[ctrl.Request]corev1.Service{}
+	// The services for the addresses of which rules are set
+	addressServiceCache = map[ctrl.Request]corev1.Service{}
+)
+
+// IsInitialized returns whether the service controller initialized rules
+func IsInitialized() bool {
+	select {
+	case <-initDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReconcileAddressService reconciles the externalIP to clusterIP rules of the service made for the addresses of the gateway
+// or the ingress. The service is nil if the resource is removed, or has no backing service or no address. The addresses are
+// deduped with the services of all gateways and ingresses, so the rules of other resources sharing the addresses are also
+// reconciled if their addresses are changed. It returns the conflicts of the addresses of the service.
+func ReconcileAddressService(logger logr.Logger, kind string, req ctrl.Request, svc *corev1.Service) ([]statusaddr.Conflict, error) {
+	svcReq := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: req.Namespace, Name: statusaddr.GetServiceName(kind, req.Name)}}
+
+	// Lock
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+
+	// Dedupe the addresses of all resources
+	if svc == nil {
+		delete(addressClaims, svcReq)
+	} else {
+		addressClaims[svcReq] = *svc.DeepCopy()
+	}
+	claims := []corev1.Service{}
+	for _, claim := range addressClaims {
+		claims = append(claims, claim)
+	}
+	deduped, conflicts := statusaddr.Dedupe(claims)
+	desired := map[ctrl.Request]*corev1.Service{}
+	for i := range deduped {
+		desired[ctrl.Request{NamespacedName: types.NamespacedName{Namespace: deduped[i].Namespace, Name: deduped[i].Name}}] = &deduped[i]
+	}
+
+	// Reconcile the service, and the other services of which the addresses are changed by deduping
+	reqs := []ctrl.Request{svcReq}
+	for r := range addressServiceCache {
+		if r != svcReq {
+			reqs = append(reqs, r)
+		}
+	}
+	for r := range desired {
+		if _, exist := addressServiceCache[r]; !exist && r != svcReq {
+			reqs = append(reqs, r)
+		}
+	}
+	sort.Slice(reqs[1:], func(i, j int) bool { return reqs[i+1].String() < reqs[j+1].String() })
+	for _, r := range reqs {
+		newSvc := desired[r]
+		var oldSvc *corev1.Service
+		if cachedSvc, exist := addressServiceCache[r]; exist {
+			oldSvc = &cachedSvc
+		}
+		// Reconcile the service even if there is no service info in cache, so that the rules kept at start are deleted
+		if r != svcReq && (oldSvc == nil) == (newSvc == nil) && (oldSvc == nil || reflect.DeepEqual(oldSvc.Status, newSvc.Status)) {
+			continue
+		}
+		if err := reconcileAddressServiceRules(logger, r, newSvc, oldSvc); err != nil {
+			return nil, err
+		}
+
+		// Cache service to use deleting service
+		if newSvc == nil {
+			delete(addressServiceCache, r)
+		} else {
+			addressServiceCache[r] = *newSvc.DeepCopy()
+		}
+	}
+	return conflicts[svcReq.NamespacedName], nil
+}
+
+// reconcileAddressServiceRules reconciles the externalIP to clusterIP rules of the service for the addresses
+func reconcileAddressServiceRules(logger logr.Logger, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	for _, rule := range enabledRules {
+		if rule.Name() != rules.FeatureExternalCluster {
+			continue
+		}
+		for _, family := range families {
+			if err := rule.Reconcile(logger, family, req, svc, oldSvc); err != nil {
+				logger.Error(err, "failed to reconcile rules", "feature", rule.Name(), "family", family.Name, "service", req.String())
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/statusaddr"
+)
+
+func newAddressService(kind, name string, created int64, clusterIP string, ips ...string) *corev1.Service {
+	backing := &corev1.Service{Spec: corev1.ServiceSpec{ClusterIP: clusterIP}}
+	obj := &metav1.ObjectMeta{Namespace: "default", Name: name, CreationTimestamp: metav1.Unix(created, 0)}
+	return statusaddr.NewService(kind, obj, backing, ips)
+}
+
+func getCachedAddresses(name string) []string {
+	result := []string{}
+	svc, ok := addressServiceCache[ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}]
+	if !ok {
+		return nil
+	}
+	for _, lb := range svc.Status.LoadBalancer.Ingress {
+		result = append(result, lb.IP)
+	}
+	return result
+}
+
+func TestReconcileAddressServiceDedupe(t *testing.T) {
+	defer func() {
+		addressClaims = map[ctrl.Request]corev1.Service{}
+		addressServiceCache = map[ctrl.Request]corev1.Service{}
+	}()
+	ingReq := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}}
+	gwReq := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "gw"}}
+
+	// The newer gateway can't take the address of the ingress
+	ing := newAddressService(statusaddr.KindIngress, "web", 100, "10.96.0.10", "192.168.0.10")
+	if conflicts, err := ReconcileAddressService(log.NullLogger{}, statusaddr.KindIngress, ingReq, ing); err != nil || len(conflicts) != 0 {
+		t.Fatalf("failed to reconcile ingress - %v %v", conflicts, err)
+	}
+	gw := newAddressService(statusaddr.KindGateway, "gw", 200, "10.96.0.20", "192.168.0.10", "192.168.0.20")
+	conflicts, err := ReconcileAddressService(log.NullLogger{}, statusaddr.KindGateway, gwReq, gw)
+	if err != nil || !reflect.DeepEqual(conflicts, []statusaddr.Conflict{
+		{Address: "192.168.0.10", Owner: types.NamespacedName{Namespace: "default", Name: "ingress.web"}},
+	}) {
+		t.Fatalf("wrong conflicts of gateway - %v %v", conflicts, err)
+	}
+	if ips := getCachedAddresses("ingress.web"); !reflect.DeepEqual(ips, []string{"192.168.0.10"}) {
+		t.Errorf("wrong addresses of ingress - %v", ips)
+	}
+	if ips := getCachedAddresses("gateway.gw"); !reflect.DeepEqual(ips, []string{"192.168.0.20"}) {
+		t.Errorf("wrong addresses of gateway - %v", ips)
+	}
+
+	// The gateway takes the address when the ingress is removed
+	if _, err := ReconcileAddressService(log.NullLogger{}, statusaddr.KindIngress, ingReq, nil); err != nil {
+		t.Fatalf("failed to reconcile removed ingress - %v", err)
+	}
+	if ips := getCachedAddresses("ingress.web"); ips != nil {
+		t.Errorf("ingress remains - %v", ips)
+	}
+	if ips := getCachedAddresses("gateway.gw"); !reflect.DeepEqual(ips, []string{"192.168.0.10", "192.168.0.20"}) {
+		t.Errorf("wrong addresses of gateway - %v", ips)
+	}
+}
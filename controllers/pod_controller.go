@@ -0,0 +1,89 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/rules"
+	"github.com/kakao/network-node-manager/pkg/utils"
+)
+
+// PodReconciler reconciles the pods in the namespaces allowed to access cloud metadata endpoints
+type PodReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	AllowedNamespaces []string
+
+	podCache cache.Cache
+}
+
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Log.WithName("reconcile").WithValues("pod", req.String())
+
+	// Get pod IPs. Not found pod means that the pod is removed
+	var ips []string
+	pod := &corev1.Pod{}
+	if err := r.podCache.Get(ctx, req.NamespacedName, pod); err == nil {
+		ips = utils.GetPodIPs(pod)
+	} else if !apierror.IsNotFound(err) {
+		logger.Error(err, "failed to get pod info")
+		return ctrl.Result{}, err
+	}
+
+	// Set allowed pod IPs
+	if err := rules.SetMetadataAllowedPod(logger, req.NamespacedName, ips); err != nil {
+		logger.Error(err, "failed to set allowed pod for metadata endpoints")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Cache only the pods in the allowed namespaces with its own cache, not to list and watch all pods
+	// in the cluster by the cache of the manager shared with services
+	podCache, err := cache.MultiNamespacedCacheBuilder(r.AllowedNamespaces)(mgr.GetConfig(),
+		cache.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		return err
+	}
+	if err := mgr.Add(podCache); err != nil {
+		return err
+	}
+	r.podCache = podCache
+
+	// Set controller manager
+	c, err := controller.New("pod", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	return c.Watch(source.NewKindWithCache(&corev1.Pod{}, podCache), &handler.EnqueueRequestForObject{})
+}
@@ -16,50 +16,82 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
 	apierror "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/go-logr/logr"
 	"github.com/kakao/network-node-manager/pkg/configs"
-	"github.com/kakao/network-node-manager/pkg/ip"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
 	"github.com/kakao/network-node-manager/pkg/rules"
+	"github.com/kakao/network-node-manager/pkg/statusaddr"
 	"github.com/kakao/network-node-manager/pkg/utils"
 )
 
 // ServiceReconciler reconciles a Service object
 type ServiceReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log       logr.Logger
+	Scheme    *runtime.Scheme
+	Recorder  record.EventRecorder
+	ProxyMode proxymode.Mode
+
+	// APIReader reads events without caching them
+	APIReader client.Reader
 }
 
+// Constants
+const (
+	eventReasonExternalIPNotAllowed = "ExternalIPNotAllowed"
+)
+
 // Variables
 var (
 	configPodCIDRIPv4 string
 	configPodCIDRIPv6 string
 
-	configRuleDropInvalidInputEnabled bool
-	configRuleExternalClusterEnabled  bool
+	configLocalEndpoints    bool
+	configRejectNoEndpoints bool
+	configNodeName          string
 
-	initFlag    = false
-	podCIDRIPv4 string
-	podCIDRIPv6 string
+	configGatewayEnabled bool
+	configIngressEnabled bool
+	configBacking        statusaddr.Backing
+
+	initFlag     = false
+	initDone     = make(chan struct{})
+	families     []*rules.Family
+	enabledRules []rules.Rule
+
+	// rulesLock serializes reconciling rules by the service, gateway and ingress controllers
+	rulesLock = &sync.Mutex{}
 
 	serviceCache = map[ctrl.Request]corev1.Service{}
 )
 
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=list;create;patch
+// +kubebuilder:rbac:groups=core,resources=configmaps,resourceNames=kube-proxy,verbs=get
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
 
 func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	logger := r.Log.WithName("reconcile").WithValues("service", req.NamespacedName)
-	var err error
+	logger := r.Log.WithName("reconcile").WithValues("service", req.String())
 
 	// ** Init service controller **
 	// In SetupWithManager, function k8s client cannot be used.
@@ -67,6 +99,7 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	if !initFlag {
 		defer func() {
 			initFlag = true
+			close(initDone)
 		}()
 
 		// Init logger for only initialize controller
@@ -76,183 +109,268 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		// Get pod CIDR configs
 		configPodCIDRIPv4, _ = configs.GetConfigPodCIDRIPv4()
 		configPodCIDRIPv6, _ = configs.GetConfigPodCIDRIPv6()
-		logger.WithValues("IPv4 pod cIDR", configPodCIDRIPv4).Info("config IPv4 pod CIDR")
-		logger.WithValues("IPv6 pod cIDR", configPodCIDRIPv6).Info("config IPv6 pod CIDR")
+		logger.Info("config pod CIDR", "family", iptables.FamilyIPv4.Name, "cidr", configPodCIDRIPv4)
+		logger.Info("config pod CIDR", "family", iptables.FamilyIPv6.Name, "cidr", configPodCIDRIPv6)
+
+		// Init packages
+		rules.Init(configPodCIDRIPv4, configPodCIDRIPv6)
+		families = rules.GetFamilies()
 
 		// Get rule configs
-		configRuleDropInvalidInputEnabled, err = configs.GetConfigRuleDropInvalidInputEnabled()
+		var disabledRules []rules.Rule
+		var err error
+		enabledRules, disabledRules, err = rules.GetEnabledRules(r.ProxyMode)
 		if err != nil {
 			logger.Error(err, "config error")
 			os.Exit(1)
 		}
-		configRuleExternalClusterEnabled, err = configs.GetConfigRuleExternalClusterEnabled()
-		if err != nil {
-			logger.Error(err, "config error")
-			os.Exit(1)
+		for _, rule := range enabledRules {
+			logger.Info("config for rule", "feature", rule.Name(), "enabled", true)
+		}
+		for _, rule := range disabledRules {
+			logger.Info("config for rule", "feature", rule.Name(), "enabled", false)
 		}
-		logger.WithValues("enabled", configRuleDropInvalidInputEnabled).Info("config for drop invalid packet in INPUT chain")
-		logger.WithValues("enabled", configRuleExternalClusterEnabled).Info("config for externalIP to clusterIP")
-
-		// Init packages
-		rules.Init(configPodCIDRIPv4, configPodCIDRIPv6)
 
-		// Init or Cleanup rules
-		if configRuleDropInvalidInputEnabled {
-			if err := rules.InitRulesDropInvalidInput(logger); err != nil {
-				logger.Error(err, "failed to initalize rules for drop invalid packet in INPUT chain")
-				os.Exit(1)
-			}
-		} else {
-			if err := rules.CleanupRulesDropInvalidInput(logger); err != nil {
-				logger.Error(err, "failed to cleanup rules for drop invalid packet in INPUT chain")
-				os.Exit(1)
-			}
+		// Get all services
+		svcs := &corev1.ServiceList{}
+		if err := r.Client.List(ctx, svcs, client.InNamespace("")); err != nil {
+			logger.Error(err, "failed to get all services from API server")
+			os.Exit(1)
 		}
 
-		if configRuleExternalClusterEnabled {
-			// Init externalIP to clusterIP rules
-			if err := rules.InitRulesExternalCluster(logger); err != nil {
-				logger.Error(err, "failed to initalize rules for externalIP to clusterIP")
-				os.Exit(1)
+		// Add the services for the addresses of gateways and ingresses, so that their rules aren't cleaned up.
+		// All of them claim their addresses before reconciled, so that the oldest one keeps the address after restart.
+		addrSvcs, err := statusaddr.List(ctx, r.Client, configGatewayEnabled, configIngressEnabled, configBacking)
+		if err != nil {
+			logger.Error(err, "failed to get the services for the addresses of gateways and ingresses")
+			os.Exit(1)
+		}
+		for _, addrSvc := range addrSvcs {
+			addressClaims[ctrl.Request{NamespacedName: types.NamespacedName{Namespace: addrSvc.Namespace, Name: addrSvc.Name}}] = addrSvc
+		}
+		addrSvcs, _ = statusaddr.Dedupe(addrSvcs)
+		svcs.Items = append(svcs.Items, addrSvcs...)
+
+		// Init enabled rules and cleanup rules for deleted services
+		for _, rule := range enabledRules {
+			for _, family := range families {
+				if err := rule.Init(logger, family); err != nil {
+					logger.Error(err, "failed to initalize rules", "feature", rule.Name(), "family", family.Name)
+					os.Exit(1)
+				}
+				if err := rule.Sync(logger, family, svcs); err != nil {
+					logger.Error(err, "failed to sync rules", "feature", rule.Name(), "family", family.Name)
+					os.Exit(1)
+				}
 			}
+		}
 
-			// Get all services
-			svcs := &corev1.ServiceList{}
-			if err := r.Client.List(ctx, svcs, client.InNamespace("")); err != nil {
-				logger.Error(err, "failed to get all services from API server")
-				os.Exit(1)
+		// Cleanup disabled rules
+		for _, rule := range disabledRules {
+			for _, family := range families {
+				if err := rule.Cleanup(logger, family); err != nil {
+					logger.Error(err, "failed to cleanup rules", "feature", rule.Name(), "family", family.Name)
+					os.Exit(1)
+				}
 			}
+		}
 
-			// Cleanup externalIP to clusterIP rules for deleted services
-			if err := rules.CleanupRulesExternalCluster(logger, svcs); err != nil {
-				logger.Error(err, "failed to cleanup rule externalIP to clusterIP")
-				os.Exit(1)
-			}
-		} else {
-			// Destroy externalIP to clusterIP rules
-			if err := rules.DestoryRulesExternalCluster(logger); err != nil {
-				logger.Error(err, "failed to destroy rule externalIP to clusterIP")
+		// Cleanup base chains not used by enabled rules
+		for _, family := range families {
+			if err := rules.CleanupBaseChains(logger, family); err != nil {
+				logger.Error(err, "failed to cleanup base chains", "family", family.Name)
 				os.Exit(1)
 			}
 		}
+	}
+
+	// ** Reconcile Loop **
+	// Get service info
+	var svc *corev1.Service
+	svcGet := &corev1.Service{}
+	if err := r.Client.Get(ctx, req.NamespacedName, svcGet); err == nil {
+		svc = svcGet
+	} else if !apierror.IsNotFound(err) {
+		logger.Error(err, "failed to get service info")
+		return ctrl.Result{}, err
+	}
+	// Not found service means that the service is removed.
+	// Delete iptables rules by using cache
+	var oldSvc *corev1.Service
+	if cachedSvc, exist := serviceCache[req]; exist {
+		oldSvc = &cachedSvc
+	}
+	if svc == nil && oldSvc == nil {
+		// If there is no service info in cache, skip it
+		return ctrl.Result{}, nil
+	}
 
-		// Run rules periodically
-		ticker := time.NewTicker(60 * time.Second)
-		go func() {
-			for {
-				<-ticker.C
+	// Set the endpoints of the service before reconciling rules
+	if err := r.setEndpoints(ctx, req, svc); err != nil {
+		logger.Error(err, "failed to get endpoint slices")
+		return ctrl.Result{}, err
+	}
 
-				if configRuleDropInvalidInputEnabled {
-					if err := rules.InitRulesDropInvalidInput(logger); err != nil {
-						logger.Error(err, "failed to set rules for drop invalid packet in INPUT chain")
-					}
-				}
+	// Reconcile rules
+	rulesLock.Lock()
+	for _, rule := range enabledRules {
+		for _, family := range families {
+			if err := rule.Reconcile(logger, family, req, svc, oldSvc); err != nil {
+				logger.Error(err, "failed to reconcile rules", "feature", rule.Name(), "family", family.Name)
+				rulesLock.Unlock()
+				return ctrl.Result{}, err
 			}
-		}()
+		}
+	}
+	rulesLock.Unlock()
+
+	// Record an event when the service has new disallowed externalIPs
+	if svc != nil {
+		ips := rules.GetDisallowedExternalIPs(svc)
+		if len(ips) != 0 && (oldSvc == nil || !utils.IsSameStrings(rules.GetDisallowedExternalIPs(oldSvc), ips)) {
+			logger.Info("externalIPs are not allowed", "externalIPs", ips)
+			r.recordExternalIPNotAllowed(ctx, logger, svc, ips)
+		}
 	}
 
-	// ** Reconcile Loop **
-	if configRuleExternalClusterEnabled {
-		// In case the iptables chain is deleted, initalize again
-		if err := rules.InitRulesExternalCluster(logger); err != nil {
-			logger.Error(err, "failed to initalize rules externalIP to clusterIP")
-			os.Exit(1)
+	// Cache service to use deleting service
+	if svc == nil {
+		delete(serviceCache, req)
+	} else {
+		serviceCache[req] = *svc.DeepCopy()
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Get endpoints configs
+	var err error
+	configLocalEndpoints, err = configs.GetConfigRuleExternalClusterLocalEndpoints()
+	if err != nil {
+		return err
+	}
+	configRejectNoEndpoints, err = configs.GetConfigRuleExternalClusterRejectNoEndpoints()
+	if err != nil {
+		return err
+	}
+	if configLocalEndpoints {
+		if configNodeName, err = configs.GetConfigNodeName(); err != nil {
+			return err
 		}
+	}
 
-		// Get service info
-		svc := &corev1.Service{}
-		if err := r.Client.Get(ctx, req.NamespacedName, svc); err != nil {
-			if apierror.IsNotFound(err) {
-				// Not found service means that the service is removed.
-				// Delete iptables rules by using cache
-
-				// Get service from cache
-				oldSvc, exist := serviceCache[req]
-				if !exist {
-					// If there is no service info in cache, skip it
-					return ctrl.Result{}, nil
-				}
+	// Get gateway and ingress configs to keep the rules for their addresses at start
+	if configGatewayEnabled, err = configs.GetConfigRuleExternalClusterGatewayEnabled(); err != nil {
+		return err
+	}
+	if configIngressEnabled, err = configs.GetConfigRuleExternalClusterIngressEnabled(); err != nil {
+		return err
+	}
+	if configBacking.DefaultService, err = configs.GetConfigRuleExternalClusterIngressService(); err != nil {
+		return err
+	}
+	if configBacking.AllowedServices, err = configs.GetConfigRuleExternalClusterBackingServices(); err != nil {
+		return err
+	}
 
-				// Get service's clusterIPs for each family
-				oldClusterIPv4 := utils.GetClusterIPByFamily(corev1.IPv4Protocol, &oldSvc)
-				oldClusterIPv6 := utils.GetClusterIPByFamily(corev1.IPv6Protocol, &oldSvc)
-				if oldClusterIPv4 == "" && oldClusterIPv6 == "" {
-					// If there is no clusterIP in the service, skip it
-					return ctrl.Result{}, nil
-				}
+	// Run rules periodically until the manager stops
+	if err := mgr.Add(manager.RunnableFunc(r.runPeriodically)); err != nil {
+		return err
+	}
 
-				// Get all the service's externalIPs
-				oldExternalIPs := []string{}
-				for _, ingress := range oldSvc.Status.LoadBalancer.Ingress {
-					oldExternalIPs = append(oldExternalIPs, ingress.IP)
-				}
-				for _, externalIP := range oldSvc.Spec.ExternalIPs {
-					oldExternalIPs = append(oldExternalIPs, externalIP)
-				}
+	// Set controller manager. Watch endpoint slices to reconcile their services only if endpoints are used.
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Service{})
+	if configLocalEndpoints || configRejectNoEndpoints {
+		b = b.Watches(&source.Kind{Type: &discoveryv1beta1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(r.getServiceOfEndpointSlice))
+	}
+	return b.Complete(r)
+}
 
-				// Delete rules
-				for _, oldExternalIP := range oldExternalIPs {
-					oldClusterIP := oldClusterIPv4
-					if ip.IsIPv6Addr(oldExternalIP) {
-						oldClusterIP = oldClusterIPv6
-					}
-
-					// Delete rules
-					logger.WithValues("externalIP", oldExternalIP).WithValues("clusterIP", oldClusterIP).
-						Info("delete a iptables rule for externalIp to clusterIP")
-					if err := rules.DeleteRulesExternalCluster(logger, &req, oldClusterIP, oldExternalIP); err != nil {
-						return ctrl.Result{}, err
-					}
-				}
-				return ctrl.Result{}, nil
-			} else {
-				logger.Error(err, "failed to get service info")
-				return ctrl.Result{}, err
-			}
-		}
+// setEndpoints sets the local endpoints and whether the service has no ready endpoints from its endpoint slices
+// if endpoints are used. svc is nil when the service is deleted.
+func (r *ServiceReconciler) setEndpoints(ctx context.Context, req ctrl.Request, svc *corev1.Service) error {
+	if !configLocalEndpoints && !configRejectNoEndpoints {
+		return nil
+	}
 
-		// Get service's clusterIPs for each family
-		clusterIPv4 := utils.GetClusterIPByFamily(corev1.IPv4Protocol, svc)
-		clusterIPv6 := utils.GetClusterIPByFamily(corev1.IPv6Protocol, svc)
-		if clusterIPv4 == "" && clusterIPv6 == "" {
-			// If there is no clusterIP in the service, skip it
-			return ctrl.Result{}, nil
+	slices := &discoveryv1beta1.EndpointSliceList{}
+	if svc != nil {
+		if err := r.Client.List(ctx, slices, client.InNamespace(req.Namespace),
+			client.MatchingLabels{discoveryv1beta1.LabelServiceName: req.Name}); err != nil {
+			return err
 		}
+	}
+	if configLocalEndpoints {
+		rules.SetLocalEndpoints(req.String(), rules.GetLocalEndpoints(slices.Items, configNodeName))
+	}
+	if configRejectNoEndpoints {
+		rules.SetNoEndpoints(req.String(), svc != nil && !rules.HasReadyEndpoints(slices.Items))
+	}
+	return nil
+}
 
-		// Get all the service's externalIPs
-		externalIPs := []string{}
-		for _, ingress := range svc.Status.LoadBalancer.Ingress {
-			externalIPs = append(externalIPs, ingress.IP)
-		}
-		for _, externalIP := range svc.Spec.ExternalIPs {
-			externalIPs = append(externalIPs, externalIP)
-		}
+// getServiceOfEndpointSlice returns the service of the endpoint slice if the service has externalIPs or load balancer ingress IPs
+func (r *ServiceReconciler) getServiceOfEndpointSlice(obj client.Object) []ctrl.Request {
+	name, ok := obj.GetLabels()[discoveryv1beta1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}
 
-		// Create rules
-		for _, externalIP := range externalIPs {
-			clusterIP := clusterIPv4
-			if ip.IsIPv6Addr(externalIP) {
-				clusterIP = clusterIPv6
-			}
+	svc := &corev1.Service{}
+	if err := r.Client.Get(context.Background(), req.NamespacedName, svc); err != nil || len(utils.GetExternalIPs(svc)) == 0 {
+		return nil
+	}
+	return []ctrl.Request{req}
+}
 
-			// Cache service to use deleting service
-			serviceCache[req] = *svc.DeepCopy()
+// runPeriodically sets the rules of the enabled rules every minute after the rules are initialized, until the context is done
+func (r *ServiceReconciler) runPeriodically(ctx context.Context) error {
+	select {
+	case <-initDone:
+	case <-ctx.Done():
+		return nil
+	}
 
-			// Create rules
-			logger.WithValues("externalIP", externalIP).WithValues("clusterIP", clusterIP).
-				Info("create a iptables rule for externalIP to clusterIP")
-			if err := rules.CreateRulesExternalCluster(logger, &req, clusterIP, externalIP); err != nil {
-				return ctrl.Result{}, err
+	logger := r.Log.WithName("periodic")
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		rulesLock.Lock()
+		for _, rule := range enabledRules {
+			for _, family := range families {
+				if err := rule.Init(logger, family); err != nil {
+					logger.Error(err, "failed to set rules", "feature", rule.Name(), "family", family.Name)
+				}
 			}
 		}
+		rulesLock.Unlock()
 	}
-
-	return ctrl.Result{}, nil
 }
 
-func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	// Set controller manager
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Service{}).
-		Complete(r)
+// recordExternalIPNotAllowed records the event of the disallowed externalIPs on the service unless the same event
+// exists. All network-node-manager pods reconcile the service, so the first one records the event and the others skip it.
+func (r *ServiceReconciler) recordExternalIPNotAllowed(ctx context.Context, logger logr.Logger, svc *corev1.Service, ips []string) {
+	message := fmt.Sprintf("externalIPs %s are not allowed and ignored by network-node-manager", strings.Join(ips, ","))
+
+	events := &corev1.EventList{}
+	if err := r.APIReader.List(ctx, events, client.InNamespace(svc.Namespace),
+		client.MatchingFields{"involvedObject.uid": string(svc.UID), "reason": eventReasonExternalIPNotAllowed}); err != nil {
+		logger.Error(err, "failed to get events of service")
+	} else {
+		for _, event := range events.Items {
+			if event.Message == message {
+				return
+			}
+		}
+	}
+	r.Recorder.Event(svc, corev1.EventTypeWarning, eventReasonExternalIPNotAllowed, message)
 }
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kakao/network-node-manager/pkg/rules"
+)
+
+func newEndpointSlice(svcName string) *discoveryv1beta1.EndpointSlice {
+	return &discoveryv1beta1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      svcName + "-abcde",
+			Labels:    map[string]string{discoveryv1beta1.LabelServiceName: svcName},
+		},
+	}
+}
+
+func TestGetServiceOfEndpointSlice(t *testing.T) {
+	lbSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, ClusterIP: "10.96.0.10"},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.0.10"}}},
+		},
+	}
+	externalIPSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "external"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.20", ExternalIPs: []string{"192.168.0.20"}},
+	}
+	clusterIPSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "internal"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.30"},
+	}
+	r := &ServiceReconciler{Client: fake.NewClientBuilder().WithObjects(lbSvc, externalIPSvc, clusterIPSvc).Build()}
+
+	tests := []struct {
+		slice    *discoveryv1beta1.EndpointSlice
+		expected []ctrl.Request
+	}{
+		{newEndpointSlice("lb"), []ctrl.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "lb"}}}},
+		{newEndpointSlice("external"), []ctrl.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "external"}}}},
+		{newEndpointSlice("internal"), nil},
+		{newEndpointSlice("unknown"), nil},
+		{&discoveryv1beta1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "no-label"}}, nil},
+	}
+	for _, test := range tests {
+		if reqs := r.getServiceOfEndpointSlice(test.slice); !reflect.DeepEqual(reqs, test.expected) {
+			t.Errorf("wrong requests of %s - %v", test.slice.Name, reqs)
+		}
+	}
+}
+
+func TestSetNoEndpoints(t *testing.T) {
+	configRejectNoEndpoints = true
+	defer func() { configRejectNoEndpoints = false }()
+	defer rules.SetNoEndpoints("default/lb", false)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, ClusterIP: "10.96.0.10"},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.0.10"}}},
+		},
+	}
+	slice := newEndpointSlice("lb")
+	c := fake.NewClientBuilder().WithObjects(svc, slice).Build()
+	r := &ServiceReconciler{Client: c}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "lb"}}
+
+	// Each change of the endpoint slice reconciles the service and updates whether it has no endpoints
+	ready, notReady := true, false
+	for _, test := range []struct {
+		name      string
+		endpoints []discoveryv1beta1.Endpoint
+		expected  bool
+	}{
+		{"ready", []discoveryv1beta1.Endpoint{{Addresses: []string{"10.244.1.10"}, Conditions: discoveryv1beta1.EndpointConditions{Ready: &ready}}}, false},
+		{"not ready", []discoveryv1beta1.Endpoint{{Addresses: []string{"10.244.1.10"}, Conditions: discoveryv1beta1.EndpointConditions{Ready: &notReady}}}, true},
+		{"none", nil, true},
+		{"ready again", []discoveryv1beta1.Endpoint{{Addresses: []string{"10.244.1.11"}}}, false},
+	} {
+		slice.Endpoints = test.endpoints
+		if err := c.Update(context.Background(), slice); err != nil {
+			t.Fatalf("failed to update endpoint slice : %v", err)
+		}
+		if reqs := r.getServiceOfEndpointSlice(slice); !reflect.DeepEqual(reqs, []ctrl.Request{req}) {
+			t.Errorf("service isn't enqueued for %s endpoints - %v", test.name, reqs)
+		}
+		if err := r.setEndpoints(context.Background(), req, svc); err != nil {
+			t.Fatalf("failed to set endpoints : %v", err)
+		}
+		if rules.HasNoEndpoints("default/lb") != test.expected {
+			t.Errorf("wrong no endpoints for %s endpoints", test.name)
+		}
+	}
+
+	// Deleted service is regarded as having endpoints
+	if err := r.setEndpoints(context.Background(), req, nil); err != nil || rules.HasNoEndpoints("default/lb") {
+		t.Errorf("no endpoints remain after deleting service - %v", err)
+	}
+}
@@ -4,6 +4,9 @@ go 1.16
 
 require (
 	github.com/go-logr/logr v0.3.0
+	github.com/prometheus/client_golang v1.7.1
+	go.uber.org/zap v1.15.0
+	golang.org/x/sys v0.0.0-20201112073958-5cba982894dd
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v0.20.2
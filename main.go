@@ -17,9 +17,14 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -28,6 +33,14 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/kakao/network-node-manager/controllers"
+	"github.com/kakao/network-node-manager/pkg/commands"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/conntrack"
+	"github.com/kakao/network-node-manager/pkg/ipset"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/statusaddr"
+	"github.com/kakao/network-node-manager/pkg/sysctl"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -45,10 +58,77 @@ func init() {
 
 func main() {
 	var metricsAddr string
+	var cleanupOnExit bool
+	var dryRun bool
+	var samplingInitial, samplingThereafter int
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.BoolVar(&cleanupOnExit, "cleanup-on-exit", false,
+		"Remove all network-node-manager rules when receiving a termination signal. Enable it only for uninstall.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Log and record iptables commands that change rules instead of running them.")
+	flag.IntVar(&samplingInitial, "zap-sampling-initial", 0,
+		"Number of log entries with the same level and message logged per second before sampling. 0 disables this sampling.")
+	flag.IntVar(&samplingThereafter, "zap-sampling-thereafter", 100,
+		"Log every Nth entry with the same level and message after zap-sampling-initial entries per second.")
+	opts := zap.Options{
+		StacktraceLevel: zapcore.PanicLevel,
+	}
+	opts.BindFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [cleanup|dump|diff|simulate] [subcommand flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	// Set logger
+	if samplingInitial > 0 {
+		opts.ZapOpts = append(opts.ZapOpts, uberzap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSampler(core, time.Second, samplingInitial, samplingThereafter)
+		}))
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	// Set dry-run mode
+	if dryRun {
+		iptables.SetDryRun(ctrl.Log.WithName("dry-run"))
+		ipset.SetDryRun(ctrl.Log.WithName("dry-run"))
+		conntrack.SetDryRun(ctrl.Log.WithName("dry-run"))
+		sysctl.SetDryRun(ctrl.Log.WithName("dry-run"))
+	}
+
+	// Run subcommand
+	switch flag.Arg(0) {
+	case "":
+	case "cleanup":
+		if err := commands.RunCleanup(ctrl.Log.WithName("cleanup")); err != nil {
+			os.Exit(1)
+		}
+		if dryRun {
+			commands.PrintDryRunCommands()
+		}
+		return
+	case "dump":
+		if err := commands.RunDump(flag.Args()[1:]); err != nil {
+			setupLog.Error(err, "failed to dump rules")
+			os.Exit(1)
+		}
+		return
+	case "diff":
+		if err := commands.RunDiff(flag.Args()[1:]); err != nil {
+			setupLog.Error(err, "failed to diff rules")
+			os.Exit(1)
+		}
+		return
+	case "simulate":
+		if err := commands.RunSimulate(flag.Args()[1:]); err != nil {
+			setupLog.Error(err, "failed to simulate rules")
+			os.Exit(1)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	// Initalize controller manager
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -63,15 +143,107 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Detect kube-proxy mode for the defaults of rules
+	proxyModeOverride, err := configs.GetConfigKubeProxyMode()
+	if err != nil {
+		setupLog.Error(err, "config error")
+		os.Exit(1)
+	}
+	proxyMode, proxyModeSource, err := proxymode.Get(context.Background(), mgr.GetAPIReader(), proxyModeOverride)
+	if err != nil {
+		setupLog.Error(err, "failed to detect kube-proxy mode")
+		os.Exit(1)
+	}
+	if proxyMode == proxymode.ModeUnknown {
+		setupLog.Info("failed to detect kube-proxy mode. use the defaults of iptables mode")
+	} else {
+		setupLog.Info("kube-proxy mode", "mode", proxyMode, "source", proxyModeSource)
+	}
+
 	// Initialize service controller
 	if err = (&controllers.ServiceReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Service"),
-		Scheme: mgr.GetScheme(),
+		Client:    mgr.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("Service"),
+		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("network-node-manager"),
+		ProxyMode: proxyMode,
+		APIReader: mgr.GetAPIReader(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
+
+	// Initialize pod controller for the allowed namespaces of block metadata rule
+	blockMetadataEnabled, err := configs.GetConfigRuleBlockMetadataEnabled()
+	if err != nil {
+		setupLog.Error(err, "config error")
+		os.Exit(1)
+	}
+	allowedNamespaces := configs.GetConfigRuleBlockMetadataAllowedNamespaces()
+	if blockMetadataEnabled && len(allowedNamespaces) != 0 {
+		if err = (&controllers.PodReconciler{
+			Client:            mgr.GetClient(),
+			Log:               ctrl.Log.WithName("controllers").WithName("Pod"),
+			Scheme:            mgr.GetScheme(),
+			AllowedNamespaces: allowedNamespaces,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Pod")
+			os.Exit(1)
+		}
+	}
+
+	// Initialize gateway and ingress controllers for the addresses in their status
+	gatewayEnabled, err := configs.GetConfigRuleExternalClusterGatewayEnabled()
+	if err != nil {
+		setupLog.Error(err, "config error")
+		os.Exit(1)
+	}
+	ingressEnabled, err := configs.GetConfigRuleExternalClusterIngressEnabled()
+	if err != nil {
+		setupLog.Error(err, "config error")
+		os.Exit(1)
+	}
+	ingressService, err := configs.GetConfigRuleExternalClusterIngressService()
+	if err != nil {
+		setupLog.Error(err, "config error")
+		os.Exit(1)
+	}
+	allowedServices, err := configs.GetConfigRuleExternalClusterBackingServices()
+	if err != nil {
+		setupLog.Error(err, "config error")
+		os.Exit(1)
+	}
+	backing := statusaddr.Backing{DefaultService: ingressService, AllowedServices: allowedServices}
+	if gatewayEnabled {
+		if err = (&statusaddr.Reconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("Gateway"),
+			Scheme:           mgr.GetScheme(),
+			Recorder:         mgr.GetEventRecorderFor("network-node-manager"),
+			Kind:             statusaddr.KindGateway,
+			Backing:          backing,
+			Initialized:      controllers.IsInitialized,
+			ReconcileService: controllers.ReconcileAddressService,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Gateway")
+			os.Exit(1)
+		}
+	}
+	if ingressEnabled {
+		if err = (&statusaddr.Reconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("Ingress"),
+			Scheme:           mgr.GetScheme(),
+			Recorder:         mgr.GetEventRecorderFor("network-node-manager"),
+			Kind:             statusaddr.KindIngress,
+			Backing:          backing,
+			Initialized:      controllers.IsInitialized,
+			ReconcileService: controllers.ReconcileAddressService,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Ingress")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	// Run service controller
@@ -80,4 +252,11 @@ func main() {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+
+	// Teardown rules
+	if cleanupOnExit {
+		if err := commands.RunCleanup(ctrl.Log.WithName("cleanup")); err != nil {
+			os.Exit(1)
+		}
+	}
 }
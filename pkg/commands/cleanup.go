@@ -0,0 +1,17 @@
+package commands
+
+import (
+	"github.com/go-logr/logr"
+
+	"github.com/kakao/network-node-manager/pkg/rules"
+)
+
+// RunCleanup removes all rules managed by network-node-manager
+func RunCleanup(logger logr.Logger) error {
+	logger.Info("cleanup all rules")
+	if err := rules.CleanupRulesAll(logger); err != nil {
+		logger.Error(err, "failed to cleanup all rules")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/ipset"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/rules"
+)
+
+// Constants
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// initRules initializes the rules package with the same configs and kube-proxy mode as the controller
+// and returns the enabled rules
+func initRules(reader client.Reader) ([]rules.Rule, error) {
+	podCIDRIPv4, _ := configs.GetConfigPodCIDRIPv4()
+	podCIDRIPv6, _ := configs.GetConfigPodCIDRIPv6()
+	rules.Init(podCIDRIPv4, podCIDRIPv6)
+
+	override, err := configs.GetConfigKubeProxyMode()
+	if err != nil {
+		return nil, err
+	}
+	mode, _, err := proxymode.Get(context.Background(), reader, override)
+	if err != nil {
+		return nil, err
+	}
+	enabledRules, _, err := rules.GetEnabledRules(mode)
+	return enabledRules, err
+}
+
+// printRuleStates prints rules grouped by family, feature and service
+func printRuleStates(w io.Writer, output string, states []rules.RuleState) error {
+	rules.SortRuleStates(states)
+
+	switch output {
+	case OutputJSON:
+		if states == nil {
+			states = []rules.RuleState{}
+		}
+		return printJSON(w, states)
+	case OutputText:
+		var family, feature, service string
+		for i, state := range states {
+			if i == 0 || state.Family != family {
+				family, feature, service = state.Family, "", ""
+				fmt.Fprintf(w, "%s\n", family)
+			}
+			if state.Feature != feature {
+				feature, service = state.Feature, ""
+				fmt.Fprintf(w, "  %s\n", feature)
+			}
+			if state.Service != service {
+				service = state.Service
+				fmt.Fprintf(w, "    service %s\n", service)
+			}
+			if service != "" {
+				fmt.Fprintf(w, "      %-6s %s\n", state.Table, state.Rule)
+			} else {
+				fmt.Fprintf(w, "    %-6s %s\n", state.Table, state.Rule)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("wrong output format : %s", output)
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// PrintDryRunCommands prints the iptables and ipset commands recorded in dry-run mode
+func PrintDryRunCommands() {
+	for _, command := range iptables.GetDryRunCommands() {
+		fmt.Fprintln(os.Stdout, command)
+	}
+	for _, command := range ipset.GetDryRunCommands() {
+		fmt.Fprintln(os.Stdout, command)
+	}
+}
@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/rules"
+	"github.com/kakao/network-node-manager/pkg/statusaddr"
+	"github.com/kakao/network-node-manager/pkg/utils"
+)
+
+// Diff is the result of the diff subcommand
+type Diff struct {
+	Missing []rules.RuleState `json:"missing"`
+	Extra   []rules.RuleState `json:"extra"`
+}
+
+// RunDiff prints the difference between the rules in the node and the rules
+// computed from the configs and services without applying them
+func RunDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	output := fs.String("o", OutputText, "Output format. One of: text, json.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Init rules
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{})
+	if err != nil {
+		return err
+	}
+	enabledRules, err := initRules(c)
+	if err != nil {
+		return err
+	}
+
+	// Get all services
+	svcs := &corev1.ServiceList{}
+	if err := c.List(context.Background(), svcs, client.InNamespace("")); err != nil {
+		return err
+	}
+
+	if err := setEndpoints(c, svcs); err != nil {
+		return err
+	}
+	if err := setMetadataAllowedPods(c); err != nil {
+		return err
+	}
+
+	// Add the services for the addresses of gateways and ingresses
+	gateway, err := configs.GetConfigRuleExternalClusterGatewayEnabled()
+	if err != nil {
+		return err
+	}
+	ingress, err := configs.GetConfigRuleExternalClusterIngressEnabled()
+	if err != nil {
+		return err
+	}
+	ingressService, err := configs.GetConfigRuleExternalClusterIngressService()
+	if err != nil {
+		return err
+	}
+	allowedServices, err := configs.GetConfigRuleExternalClusterBackingServices()
+	if err != nil {
+		return err
+	}
+	backing := statusaddr.Backing{DefaultService: ingressService, AllowedServices: allowedServices}
+	addrSvcs, err := statusaddr.List(context.Background(), c, gateway, ingress, backing)
+	if err != nil {
+		return err
+	}
+	addrSvcs, _ = statusaddr.Dedupe(addrSvcs)
+	svcs.Items = append(svcs.Items, addrSvcs...)
+
+	// Get rules
+	current, err := rules.GetRulesCurrent()
+	if err != nil {
+		return err
+	}
+	desired := rules.GetRulesDesired(enabledRules, svcs)
+	missing, extra := rules.DiffRules(current, desired)
+	rules.SortRuleStates(missing)
+	rules.SortRuleStates(extra)
+
+	// Print result
+	switch *output {
+	case OutputJSON:
+		if missing == nil {
+			missing = []rules.RuleState{}
+		}
+		if extra == nil {
+			extra = []rules.RuleState{}
+		}
+		return printJSON(os.Stdout, Diff{Missing: missing, Extra: extra})
+	case OutputText:
+		fmt.Fprintf(os.Stdout, "missing rules : %d\n", len(missing))
+		if err := printRuleStates(os.Stdout, *output, missing); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "extra rules : %d\n", len(extra))
+		return printRuleStates(os.Stdout, *output, extra)
+	}
+	return fmt.Errorf("wrong output format : %s", *output)
+}
+
+// setEndpoints sets the endpoints of all services from endpoint slices if endpoints are used
+func setEndpoints(c client.Client, svcs *corev1.ServiceList) error {
+	local, err := configs.GetConfigRuleExternalClusterLocalEndpoints()
+	if err != nil {
+		return err
+	}
+	reject, err := configs.GetConfigRuleExternalClusterRejectNoEndpoints()
+	if err != nil || (!local && !reject) {
+		return err
+	}
+	nodeName := ""
+	if local {
+		if nodeName, err = configs.GetConfigNodeName(); err != nil {
+			return err
+		}
+	}
+
+	// Get all endpoint slices and group them by services
+	slices := &discoveryv1beta1.EndpointSliceList{}
+	if err := c.List(context.Background(), slices, client.InNamespace("")); err != nil {
+		return err
+	}
+	svcSlices := map[string][]discoveryv1beta1.EndpointSlice{}
+	for _, slice := range slices.Items {
+		if name, ok := slice.Labels[discoveryv1beta1.LabelServiceName]; ok {
+			svcSlices[slice.Namespace+"/"+name] = append(svcSlices[slice.Namespace+"/"+name], slice)
+		}
+	}
+	for _, svc := range svcs.Items {
+		nsName := svc.Namespace + "/" + svc.Name
+		if local {
+			rules.SetLocalEndpoints(nsName, rules.GetLocalEndpoints(svcSlices[nsName], nodeName))
+		}
+		if reject {
+			rules.SetNoEndpoints(nsName, !rules.HasReadyEndpoints(svcSlices[nsName]))
+		}
+	}
+	return nil
+}
+
+// setMetadataAllowedPods sets the IPs of the pods in the namespaces allowed to access cloud metadata endpoints
+func setMetadataAllowedPods(c client.Client) error {
+	pods := map[types.NamespacedName][]string{}
+	for _, ns := range configs.GetConfigRuleBlockMetadataAllowedNamespaces() {
+		podList := &corev1.PodList{}
+		if err := c.List(context.Background(), podList, client.InNamespace(ns)); err != nil {
+			return err
+		}
+		for i := range podList.Items {
+			pod := &podList.Items[i]
+			pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = utils.GetPodIPs(pod)
+		}
+	}
+	rules.SetMetadataAllowedPods(pods)
+	return nil
+}
@@ -0,0 +1,25 @@
+package commands
+
+import (
+	"flag"
+	"os"
+
+	"github.com/kakao/network-node-manager/pkg/rules"
+)
+
+// RunDump prints the rules of network-node-manager in the node
+func RunDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	output := fs.String("o", OutputText, "Output format. One of: text, json.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Get rules
+	states, err := rules.GetRulesCurrent()
+	if err != nil {
+		return err
+	}
+
+	return printRuleStates(os.Stdout, *output, states)
+}
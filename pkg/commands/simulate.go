@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/kakao/network-node-manager/pkg/ip"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/rules"
+)
+
+// Constants
+const (
+	defaultServiceCIDRIPv4 = "10.96.0.0/12"
+	defaultServiceCIDRIPv6 = "fd00:10:96::/112"
+)
+
+// RunSimulate prints the iptables-restore payload that network-node-manager installs
+// for the services in manifest files without accessing a node or a cluster
+func RunSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	podCIDRIPv4 := fs.String("pod-cidr-ipv4", "", "IPv4 pod CIDR.")
+	podCIDRIPv6 := fs.String("pod-cidr-ipv6", "", "IPv6 pod CIDR.")
+	proxyMode := fs.String("proxy-mode", string(proxymode.ModeIPTables), "kube-proxy mode. One of: iptables, ipvs.")
+	serviceCIDRIPv4 := fs.String("service-cidr-ipv4", defaultServiceCIDRIPv4, "IPv4 service CIDR to allocate clusterIPs for services without clusterIPs.")
+	serviceCIDRIPv6 := fs.String("service-cidr-ipv6", defaultServiceCIDRIPv6, "IPv6 service CIDR to allocate clusterIPs for services without clusterIPs.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: simulate [flags] [manifest files, \"-\" for stdin]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Check configs
+	if *podCIDRIPv4 != "" && !ip.IsIPv4CIDR(*podCIDRIPv4) {
+		return fmt.Errorf("wrong IPv4 pod CIDR")
+	}
+	if *podCIDRIPv6 != "" && !ip.IsIPv6CIDR(*podCIDRIPv6) {
+		return fmt.Errorf("wrong IPv6 pod CIDR")
+	}
+	if *podCIDRIPv4 == "" && *podCIDRIPv6 == "" {
+		return fmt.Errorf("pod CIDR isn't set")
+	}
+	mode, err := proxymode.Parse(*proxyMode)
+	if err != nil {
+		return err
+	}
+
+	// Read services
+	svcs := &corev1.ServiceList{}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		r := io.Reader(os.Stdin)
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		items, err := readServices(r)
+		if err != nil {
+			return fmt.Errorf("failed to read services from %s : %v", file, err)
+		}
+		svcs.Items = append(svcs.Items, items...)
+	}
+	if err := allocateClusterIPs(svcs, *serviceCIDRIPv4, *serviceCIDRIPv6); err != nil {
+		return err
+	}
+
+	// Get rules with the default configs for the kube-proxy mode. kube-proxy has KUBE-MARK-MASQ chain in both modes.
+	rules.Init(*podCIDRIPv4, *podCIDRIPv6)
+	rules.SetKubeMarkMasqExist(true)
+	enabledRules := []rules.Rule{}
+	for _, rule := range rules.GetRules() {
+		if rule.DefaultEnabled(mode) {
+			enabledRules = append(enabledRules, rule)
+		}
+	}
+	states := rules.GetRulesDesired(enabledRules, svcs)
+
+	// Print result
+	for _, family := range rules.GetFamilies() {
+		fmt.Fprintf(os.Stdout, "# %s\n%s", family.Name, rules.GetRestorePayload(states, family.Name))
+	}
+	return nil
+}
+
+// readServices reads services from YAML or JSON documents. Objects except
+// services and lists of services are ignored.
+func readServices(r io.Reader) ([]corev1.Service, error) {
+	var result []corev1.Service
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		obj := map[string]interface{}{}
+		if err := decoder.Decode(&obj); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch obj["kind"] {
+		case "Service":
+			svc := corev1.Service{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &svc); err != nil {
+				return nil, err
+			}
+			result = append(result, svc)
+		case "List", "ServiceList":
+			list := corev1.List{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &list); err != nil {
+				return nil, err
+			}
+			for _, item := range list.Items {
+				items, err := readServices(bytes.NewReader(item.Raw))
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, items...)
+			}
+		}
+	}
+
+	// Set default namespace like kubectl
+	for i := range result {
+		if result[i].Namespace == "" {
+			result[i].Namespace = "default"
+		}
+	}
+	return result, nil
+}
+
+// allocateClusterIPs sets clusterIPs in order from the service CIDRs
+// to the services without clusterIPs like manifests before applying
+func allocateClusterIPs(svcs *corev1.ServiceList, serviceCIDRIPv4, serviceCIDRIPv6 string) error {
+	next := map[corev1.IPFamily]int64{corev1.IPv4Protocol: 1, corev1.IPv6Protocol: 1}
+	cidrs := map[corev1.IPFamily]string{corev1.IPv4Protocol: serviceCIDRIPv4, corev1.IPv6Protocol: serviceCIDRIPv6}
+
+	for i := range svcs.Items {
+		spec := &svcs.Items[i].Spec
+		if spec.ClusterIP != "" || len(spec.ClusterIPs) != 0 || spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+
+		families := spec.IPFamilies
+		if len(families) == 0 {
+			families = []corev1.IPFamily{corev1.IPv4Protocol}
+		}
+		for _, family := range families {
+			clusterIP, err := getNthAddr(cidrs[family], next[family])
+			if err != nil {
+				return err
+			}
+			next[family]++
+			spec.ClusterIPs = append(spec.ClusterIPs, clusterIP)
+		}
+		spec.IPFamilies = families
+		spec.ClusterIP = spec.ClusterIPs[0]
+	}
+	return nil
+}
+
+func getNthAddr(cidr string, n int64) (string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("wrong service CIDR : %s", cidr)
+	}
+
+	addr := new(big.Int).Add(new(big.Int).SetBytes(ipNet.IP), big.NewInt(n))
+	result := net.IP(addr.FillBytes(make([]byte, len(ipNet.IP))))
+	if !ipNet.Contains(result) {
+		return "", fmt.Errorf("no more address in service CIDR : %s", cidr)
+	}
+	return result.String(), nil
+}
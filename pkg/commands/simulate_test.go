@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestReadServices(t *testing.T) {
+	f, err := os.Open("../../test/manifests/nginx-svc-ipv4-ipv6.yml")
+	if err != nil {
+		t.Fatalf("open manifest - %v", err)
+	}
+	defer f.Close()
+
+	svcs, err := readServices(f)
+	if err != nil {
+		t.Fatalf("read services - %v", err)
+	}
+	if len(svcs) != 1 || svcs[0].Namespace != "default" || svcs[0].Name != "nginx-ipv4-ipv6" {
+		t.Errorf("wrong services - %+v", svcs)
+	}
+
+	// Objects except services are ignored
+	svcs, err = readServices(strings.NewReader("kind: Deployment\n---\n{\"kind\": \"Service\", \"metadata\": {\"name\": \"test\"}}\n"))
+	if err != nil {
+		t.Fatalf("read services - %v", err)
+	}
+	if len(svcs) != 1 || svcs[0].Name != "test" {
+		t.Errorf("wrong services - %+v", svcs)
+	}
+}
+
+func TestAllocateClusterIPs(t *testing.T) {
+	svcs := &corev1.ServiceList{
+		Items: []corev1.Service{
+			{Spec: corev1.ServiceSpec{IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}}},
+			{Spec: corev1.ServiceSpec{}},
+			{Spec: corev1.ServiceSpec{ClusterIP: "10.96.100.1"}},
+		},
+	}
+
+	if err := allocateClusterIPs(svcs, defaultServiceCIDRIPv4, defaultServiceCIDRIPv6); err != nil {
+		t.Fatalf("allocate clusterIPs - %v", err)
+	}
+	if clusterIPs := svcs.Items[0].Spec.ClusterIPs; len(clusterIPs) != 2 || clusterIPs[0] != "10.96.0.1" || clusterIPs[1] != "fd00:10:96::1" {
+		t.Errorf("wrong clusterIPs - %v", clusterIPs)
+	}
+	if clusterIP := svcs.Items[1].Spec.ClusterIP; clusterIP != "10.96.0.2" {
+		t.Errorf("wrong clusterIP - %s", clusterIP)
+	}
+	if clusterIP := svcs.Items[2].Spec.ClusterIP; clusterIP != "10.96.100.1" {
+		t.Errorf("wrong clusterIP - %s", clusterIP)
+	}
+}
@@ -2,10 +2,17 @@ package configs
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/util/yaml"
+
 	"github.com/kakao/network-node-manager/pkg/ip"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/sysctl"
 )
 
 const (
@@ -15,10 +22,104 @@ const (
 	EnvPodCIDRIPv4 = "POD_CIDR_IPV4"
 	EnvPodCIDRIPv6 = "POD_CIDR_IPV6"
 
-	EnvRuleDropInvalidInputEnable = "RULE_DROP_INVALID_INPUT_ENABLE"
-	EnvRuleExternalClusterEnable  = "RULE_EXTERNAL_CLUSTER_ENABLE"
+	EnvKubeProxyMode = "KUBE_PROXY_MODE"
+	EnvNodeName      = "NODE_NAME"
+
+	EnvRuleDropInvalidInputEnable    = "RULE_DROP_INVALID_INPUT_ENABLE"
+	EnvRuleDropInvalidForwardEnable  = "RULE_DROP_INVALID_FORWARD_ENABLE"
+	EnvRuleExternalClusterEnable     = "RULE_EXTERNAL_CLUSTER_ENABLE"
+	EnvRuleTCPMSSClampEnable         = "RULE_TCPMSS_CLAMP_ENABLE"
+	EnvRuleNodeLocalDNSEnable        = "RULE_NODE_LOCAL_DNS_ENABLE"
+	EnvRuleMasqEnable                = "RULE_MASQ_ENABLE"
+	EnvRuleBlockMetadataEnable       = "RULE_BLOCK_METADATA_ENABLE"
+	EnvRuleExternalIPAllowlistEnable = "RULE_EXTERNAL_IP_ALLOWLIST_ENABLE"
+	EnvRuleSysctlEnable              = "RULE_SYSCTL_ENABLE"
+
+	EnvRuleDropInvalidInterfaces        = "RULE_DROP_INVALID_INTERFACES"
+	EnvRuleDropInvalidSrcCIDRs          = "RULE_DROP_INVALID_SRC_CIDRS"
+	EnvRuleDropInvalidDstCIDRs          = "RULE_DROP_INVALID_DST_CIDRS"
+	EnvRuleDropInvalidProtocols         = "RULE_DROP_INVALID_PROTOCOLS"
+	EnvRuleDropInvalidExcludeICMPErrors = "RULE_DROP_INVALID_EXCLUDE_ICMP_ERRORS"
+	EnvRuleDropInvalidLog               = "RULE_DROP_INVALID_LOG"
+	EnvRuleDropInvalidLogLimit          = "RULE_DROP_INVALID_LOG_LIMIT"
+	EnvRuleDropInvalidNFLOGGroup        = "RULE_DROP_INVALID_NFLOG_GROUP"
+
+	EnvRuleExternalClusterMasqMarkBit       = "RULE_EXTERNAL_CLUSTER_MASQ_MARK_BIT"
+	EnvRuleExternalClusterLocalEndpoints    = "RULE_EXTERNAL_CLUSTER_LOCAL_ENDPOINTS"
+	EnvRuleExternalClusterRejectNoEndpoints = "RULE_EXTERNAL_CLUSTER_REJECT_NO_ENDPOINTS"
+	EnvRuleExternalClusterSrcCIDRsIPv4      = "RULE_EXTERNAL_CLUSTER_SRC_CIDRS_IPV4"
+	EnvRuleExternalClusterSrcCIDRsIPv6      = "RULE_EXTERNAL_CLUSTER_SRC_CIDRS_IPV6"
+	EnvRuleExternalClusterSrcInterfacesIPv4 = "RULE_EXTERNAL_CLUSTER_SRC_INTERFACES_IPV4"
+	EnvRuleExternalClusterSrcInterfacesIPv6 = "RULE_EXTERNAL_CLUSTER_SRC_INTERFACES_IPV6"
+	EnvRuleExternalClusterOutputExcludeIPv4 = "RULE_EXTERNAL_CLUSTER_OUTPUT_EXCLUDE_IPV4"
+	EnvRuleExternalClusterOutputExcludeIPv6 = "RULE_EXTERNAL_CLUSTER_OUTPUT_EXCLUDE_IPV6"
+	EnvRuleExternalClusterOutputIncludeIPv4 = "RULE_EXTERNAL_CLUSTER_OUTPUT_INCLUDE_IPV4"
+	EnvRuleExternalClusterOutputIncludeIPv6 = "RULE_EXTERNAL_CLUSTER_OUTPUT_INCLUDE_IPV6"
+	EnvRuleExternalClusterGatewayEnable     = "RULE_EXTERNAL_CLUSTER_GATEWAY_ENABLE"
+	EnvRuleExternalClusterIngressEnable     = "RULE_EXTERNAL_CLUSTER_INGRESS_ENABLE"
+	EnvRuleExternalClusterIngressService    = "RULE_EXTERNAL_CLUSTER_INGRESS_SERVICE"
+	EnvRuleExternalClusterBackingServices   = "RULE_EXTERNAL_CLUSTER_BACKING_SERVICES"
+
+	EnvRuleTCPMSSClampMSS = "RULE_TCPMSS_CLAMP_MSS"
+
+	EnvRuleNodeLocalDNSAddrs = "RULE_NODE_LOCAL_DNS_ADDRS"
+	EnvRuleNodeLocalDNSPort  = "RULE_NODE_LOCAL_DNS_PORT"
+
+	EnvRuleMasqNonMasqCIDRsIPv4 = "RULE_MASQ_NON_MASQ_CIDRS_IPV4"
+	EnvRuleMasqNonMasqCIDRsIPv6 = "RULE_MASQ_NON_MASQ_CIDRS_IPV6"
+	EnvRuleMasqConfigFile       = "RULE_MASQ_CONFIG_FILE"
+
+	EnvRuleBlockMetadataDests             = "RULE_BLOCK_METADATA_DESTS"
+	EnvRuleBlockMetadataAllowedNamespaces = "RULE_BLOCK_METADATA_ALLOWED_NAMESPACES"
+
+	EnvRuleExternalIPAllowedCIDRs     = "RULE_EXTERNAL_IP_ALLOWED_CIDRS"
+	EnvRuleExternalIPApprovedServices = "RULE_EXTERNAL_IP_APPROVED_SERVICES"
+
+	EnvRuleSysctlParams    = "RULE_SYSCTL_PARAMS"
+	EnvRuleSysctlStateFile = "RULE_SYSCTL_STATE_FILE"
+
+	OwnerUID    = "uid"
+	OwnerGID    = "gid"
+	OwnerCgroup = "cgroup"
+
+	LogNone  = "none"
+	LogLOG   = "log"
+	LogNFLOG = "nflog"
+
+	defaultDropInvalidLogLimit   = "10/min"
+	defaultDropInvalidNFLOGGroup = 1
+
+	defaultExternalClusterMasqMarkBit = 13
+	maxMarkBit                        = 31
+
+	TCPMSSClampPMTU = "pmtu"
+	minTCPMSS       = 536
+	maxTCPMSS       = 65495
+
+	defaultNodeLocalDNSAddr = "169.254.20.10"
+	defaultNodeLocalDNSPort = 53
+
+	defaultBlockMetadataDests = "169.254.169.254,fd00:ec2::254"
+
+	defaultSysctlStateFile = "/var/lib/network-node-manager/sysctl.json"
 )
 
+// Vars
+var (
+	regexpInterface = regexp.MustCompile(`^[a-zA-Z0-9_.:@-]{1,15}\+?$`)
+	regexpLimit     = regexp.MustCompile(`^([0-9]+)/(s|sec|second|m|min|minute|h|hour|d|day)$`)
+	regexpOwnerID   = regexp.MustCompile(`^[0-9]{1,10}$`)
+	regexpCgroup    = regexp.MustCompile(`^[a-zA-Z0-9_.:@/\\-]+$`)
+
+	dropInvalidProtocols = []string{"tcp", "udp", "sctp"}
+)
+
+// Owner is a UID, GID or cgroup path of locally generated packets
+type Owner struct {
+	Type  string
+	Value string
+}
+
 func GetConfigPodCIDRIPv4() (string, error) {
 	cidr := os.Getenv(EnvPodCIDRIPv4)
 	cidr = strings.Replace(cidr, " ", "", -1)
@@ -43,30 +144,510 @@ func GetConfigPodCIDRIPv6() (string, error) {
 	return cidr, nil
 }
 
-func GetConfigRuleDropInvalidInputEnabled() (bool, error) {
-	config := os.Getenv(EnvRuleDropInvalidInputEnable)
+// GetConfigKubeProxyMode returns the kube-proxy mode to override the detection, or the unknown mode if it isn't set
+func GetConfigKubeProxyMode() (proxymode.Mode, error) {
+	mode, err := proxymode.Parse(os.Getenv(EnvKubeProxyMode))
+	if err != nil {
+		return proxymode.ModeUnknown, fmt.Errorf("wrong config for %s : %s", EnvKubeProxyMode, os.Getenv(EnvKubeProxyMode))
+	}
+	return mode, nil
+}
+
+// GetConfigNodeName returns the name of the node set by the downward API
+func GetConfigNodeName() (string, error) {
+	name := strings.TrimSpace(os.Getenv(EnvNodeName))
+	if name == "" {
+		return "", fmt.Errorf("node name isn't set")
+	}
+	return name, nil
+}
+
+func GetConfigRuleEnabled(key string, defaultEnabled bool) (bool, error) {
+	return GetConfigBool(key, defaultEnabled)
+}
+
+// GetConfigBool returns the "true" or "false" config, or the default value if the config isn't set
+func GetConfigBool(key string, defaultValue bool) (bool, error) {
+	config := os.Getenv(key)
 	config = strings.ToLower(config)
 
 	if config == "" {
-		return true, nil
+		return defaultValue, nil
 	} else if config == EnvConfigFalse {
 		return false, nil
 	} else if config == EnvConfigTrue {
 		return true, nil
 	}
-	return false, fmt.Errorf("wrong config for drop invalid packet in INPUT chain : %s", config)
+	return false, fmt.Errorf("wrong config for %s : %s", key, config)
 }
 
-func GetConfigRuleExternalClusterEnabled() (bool, error) {
-	config := os.Getenv(EnvRuleExternalClusterEnable)
-	config = strings.ToLower(config)
+// GetConfigRuleExternalClusterLocalEndpoints returns whether packets to the externalIPs of the services
+// with the local external traffic policy are DNATed to the local endpoints instead of the clusterIP
+func GetConfigRuleExternalClusterLocalEndpoints() (bool, error) {
+	return GetConfigBool(EnvRuleExternalClusterLocalEndpoints, false)
+}
 
+// GetConfigRuleExternalClusterRejectNoEndpoints returns whether packets to the externalIPs of the services
+// without ready endpoints are rejected instead of DNATed
+func GetConfigRuleExternalClusterRejectNoEndpoints() (bool, error) {
+	return GetConfigBool(EnvRuleExternalClusterRejectNoEndpoints, false)
+}
+
+// GetConfigRuleExternalClusterGatewayEnabled returns whether the addresses in the status of Gateway API gateways
+// are DNATed to the clusterIP of their backing services
+func GetConfigRuleExternalClusterGatewayEnabled() (bool, error) {
+	return GetConfigBool(EnvRuleExternalClusterGatewayEnable, false)
+}
+
+// GetConfigRuleExternalClusterIngressEnabled returns whether the addresses in the status of ingresses
+// are DNATed to the clusterIP of their backing services
+func GetConfigRuleExternalClusterIngressEnabled() (bool, error) {
+	return GetConfigBool(EnvRuleExternalClusterIngressEnable, false)
+}
+
+// GetConfigRuleExternalClusterIngressService returns the "namespace/name" of the backing service of the ingresses
+// without the backing service annotation. It's usually the service of the ingress controller.
+func GetConfigRuleExternalClusterIngressService() (string, error) {
+	config := strings.TrimSpace(os.Getenv(EnvRuleExternalClusterIngressService))
 	if config == "" {
-		return false, nil
-	} else if config == EnvConfigFalse {
-		return false, nil
-	} else if config == EnvConfigTrue {
-		return true, nil
+		return "", nil
+	}
+
+	if !isNamespacedName(config) {
+		return "", fmt.Errorf("wrong config for %s : %s", EnvRuleExternalClusterIngressService, config)
+	}
+	return config, nil
+}
+
+// GetConfigRuleExternalClusterBackingServices returns the "namespace/name" of the services which the backing service
+// annotation of gateways and ingresses can reference in other namespaces
+func GetConfigRuleExternalClusterBackingServices() ([]string, error) {
+	services := GetConfigList(EnvRuleExternalClusterBackingServices)
+	for _, service := range services {
+		if !isNamespacedName(service) {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleExternalClusterBackingServices, service)
+		}
+	}
+	return services, nil
+}
+
+func isNamespacedName(s string) bool {
+	names := strings.Split(s, "/")
+	return len(names) == 2 && names[0] != "" && names[1] != ""
+}
+
+// GetConfigRuleExternalClusterMasqMarkBit returns the bit of the packet mark to masquerade packets
+// when KUBE-MARK-MASQ chain of kube-proxy doesn't exist
+func GetConfigRuleExternalClusterMasqMarkBit() (int, error) {
+	config := strings.TrimSpace(os.Getenv(EnvRuleExternalClusterMasqMarkBit))
+	if config == "" {
+		return defaultExternalClusterMasqMarkBit, nil
+	}
+
+	bit, err := strconv.Atoi(config)
+	if err != nil || bit < 0 || bit > maxMarkBit {
+		return 0, fmt.Errorf("wrong config for %s : %s", EnvRuleExternalClusterMasqMarkBit, config)
+	}
+	return bit, nil
+}
+
+// GetConfigRuleExternalClusterSrcCIDRsIPv4 returns the IPv4 source CIDRs of the packets DNATed in PREROUTING
+// in addition to the pod CIDR
+func GetConfigRuleExternalClusterSrcCIDRsIPv4() ([]string, error) {
+	cidrs, err := GetConfigCIDRs(EnvRuleExternalClusterSrcCIDRsIPv4)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range cidrs {
+		if !ip.IsIPv4CIDR(cidr) {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleExternalClusterSrcCIDRsIPv4, cidr)
+		}
+	}
+	return cidrs, nil
+}
+
+// GetConfigRuleExternalClusterSrcCIDRsIPv6 returns the IPv6 source CIDRs of the packets DNATed in PREROUTING
+// in addition to the pod CIDR
+func GetConfigRuleExternalClusterSrcCIDRsIPv6() ([]string, error) {
+	cidrs, err := GetConfigCIDRs(EnvRuleExternalClusterSrcCIDRsIPv6)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range cidrs {
+		if !ip.IsIPv6CIDR(cidr) {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleExternalClusterSrcCIDRsIPv6, cidr)
+		}
+	}
+	return cidrs, nil
+}
+
+// GetConfigRuleExternalClusterSrcInterfacesIPv4 returns the input interfaces of the IPv4 packets DNATed in PREROUTING
+// in addition to the pod CIDR
+func GetConfigRuleExternalClusterSrcInterfacesIPv4() ([]string, error) {
+	return GetConfigInterfaces(EnvRuleExternalClusterSrcInterfacesIPv4)
+}
+
+// GetConfigRuleExternalClusterSrcInterfacesIPv6 returns the input interfaces of the IPv6 packets DNATed in PREROUTING
+// in addition to the pod CIDR
+func GetConfigRuleExternalClusterSrcInterfacesIPv6() ([]string, error) {
+	return GetConfigInterfaces(EnvRuleExternalClusterSrcInterfacesIPv6)
+}
+
+// GetConfigRuleExternalClusterOutputOwnersIPv4 returns the owners of the locally generated IPv4 packets
+// excluded from the DNAT in OUTPUT, or the only owners included if include is true
+func GetConfigRuleExternalClusterOutputOwnersIPv4() (owners []Owner, include bool, err error) {
+	return getConfigExcludeOrIncludeOwners(EnvRuleExternalClusterOutputExcludeIPv4, EnvRuleExternalClusterOutputIncludeIPv4)
+}
+
+// GetConfigRuleExternalClusterOutputOwnersIPv6 returns the owners of the locally generated IPv6 packets
+// excluded from the DNAT in OUTPUT, or the only owners included if include is true
+func GetConfigRuleExternalClusterOutputOwnersIPv6() (owners []Owner, include bool, err error) {
+	return getConfigExcludeOrIncludeOwners(EnvRuleExternalClusterOutputExcludeIPv6, EnvRuleExternalClusterOutputIncludeIPv6)
+}
+
+func getConfigExcludeOrIncludeOwners(excludeKey, includeKey string) ([]Owner, bool, error) {
+	excludes, err := GetConfigOwners(excludeKey)
+	if err != nil {
+		return nil, false, err
+	}
+	includes, err := GetConfigOwners(includeKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(excludes) != 0 && len(includes) != 0 {
+		return nil, false, fmt.Errorf("wrong config for %s : %s is also set", excludeKey, includeKey)
+	}
+	if len(includes) != 0 {
+		return includes, true, nil
+	}
+	return excludes, false, nil
+}
+
+// GetConfigOwners returns the comma separated owners of the config like "uid:1000,gid:2000,cgroup:system.slice/foo.service".
+// UIDs and GIDs are numeric IDs as iptables-save prints them, and cgroup paths are relative to the cgroup v2 root.
+func GetConfigOwners(key string) ([]Owner, error) {
+	result := []Owner{}
+	for _, value := range GetConfigList(key) {
+		fields := strings.SplitN(value, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("wrong config for %s : %s", key, value)
+		}
+		owner := Owner{Type: strings.ToLower(strings.TrimSpace(fields[0])), Value: strings.TrimSpace(fields[1])}
+
+		valid := false
+		switch owner.Type {
+		case OwnerUID, OwnerGID:
+			valid = regexpOwnerID.MatchString(owner.Value)
+		case OwnerCgroup:
+			valid = regexpCgroup.MatchString(owner.Value)
+		}
+		if !valid {
+			return nil, fmt.Errorf("wrong config for %s : %s", key, value)
+		}
+		result = append(result, owner)
+	}
+	return result, nil
+}
+
+// GetConfigList returns the comma separated values of the config
+func GetConfigList(key string) []string {
+	result := []string{}
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// GetConfigCIDRs returns the comma separated IPv4 and IPv6 CIDRs of the config
+// in the notation of iptables-save
+func GetConfigCIDRs(key string) ([]string, error) {
+	result := []string{}
+	for _, value := range GetConfigList(key) {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("wrong config for %s : %s", key, value)
+		}
+		result = append(result, ipNet.String())
+	}
+	return result, nil
+}
+
+// GetConfigAddrs returns the comma separated IPv4 and IPv6 addresses of the config
+func GetConfigAddrs(key string) ([]string, error) {
+	result := []string{}
+	for _, value := range GetConfigList(key) {
+		addr := net.ParseIP(value)
+		if addr == nil {
+			return nil, fmt.Errorf("wrong config for %s : %s", key, value)
+		}
+		result = append(result, addr.String())
+	}
+	return result, nil
+}
+
+// GetConfigHostCIDRs returns the comma separated IPv4 and IPv6 addresses and CIDRs of the config as CIDRs
+// in the notation of iptables-save. Addresses are returned with the host prefix length.
+func GetConfigHostCIDRs(key string) ([]string, error) {
+	return parseHostCIDRs(key, GetConfigList(key))
+}
+
+func parseHostCIDRs(key string, values []string) ([]string, error) {
+	result := []string{}
+	for _, value := range values {
+		if addr := net.ParseIP(value); addr != nil {
+			if addr.To4() != nil {
+				result = append(result, addr.String()+"/32")
+			} else {
+				result = append(result, addr.String()+"/128")
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("wrong config for %s : %s", key, value)
+		}
+		result = append(result, ipNet.String())
+	}
+	return result, nil
+}
+
+// GetConfigInterfaces returns the comma separated interface names of the config.
+// A name can end with "+" to match all interfaces with the prefix like iptables.
+func GetConfigInterfaces(key string) ([]string, error) {
+	result := GetConfigList(key)
+	for _, iface := range result {
+		if !regexpInterface.MatchString(iface) {
+			return nil, fmt.Errorf("wrong config for %s : %s", key, iface)
+		}
+	}
+	return result, nil
+}
+
+// GetConfigPort returns the port number of the config, or the default port if the config isn't set
+func GetConfigPort(key string, defaultPort int) (int, error) {
+	config := strings.TrimSpace(os.Getenv(key))
+	if config == "" {
+		return defaultPort, nil
+	}
+
+	port, err := strconv.Atoi(config)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("wrong config for %s : %s", key, config)
+	}
+	return port, nil
+}
+
+func GetConfigRuleDropInvalidInterfaces() ([]string, error) {
+	return GetConfigInterfaces(EnvRuleDropInvalidInterfaces)
+}
+
+func GetConfigRuleDropInvalidSrcCIDRs() ([]string, error) {
+	return GetConfigCIDRs(EnvRuleDropInvalidSrcCIDRs)
+}
+
+func GetConfigRuleDropInvalidDstCIDRs() ([]string, error) {
+	return GetConfigCIDRs(EnvRuleDropInvalidDstCIDRs)
+}
+
+func GetConfigRuleDropInvalidProtocols() ([]string, error) {
+	result := []string{}
+	for _, protocol := range GetConfigList(EnvRuleDropInvalidProtocols) {
+		protocol = strings.ToLower(protocol)
+		valid := false
+		for _, p := range dropInvalidProtocols {
+			if protocol == p {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleDropInvalidProtocols, protocol)
+		}
+		result = append(result, protocol)
+	}
+	return result, nil
+}
+
+func GetConfigRuleDropInvalidExcludeICMPErrors() (bool, error) {
+	return GetConfigBool(EnvRuleDropInvalidExcludeICMPErrors, false)
+}
+
+func GetConfigRuleDropInvalidLog() (string, error) {
+	config := strings.ToLower(os.Getenv(EnvRuleDropInvalidLog))
+
+	switch config {
+	case "", LogNone:
+		return LogNone, nil
+	case LogLOG, LogNFLOG:
+		return config, nil
+	}
+	return "", fmt.Errorf("wrong config for %s : %s", EnvRuleDropInvalidLog, config)
+}
+
+// GetConfigRuleDropInvalidLogLimit returns the rate limit of logs in the notation of iptables-save like "10/min"
+func GetConfigRuleDropInvalidLogLimit() (string, error) {
+	config := strings.ToLower(strings.TrimSpace(os.Getenv(EnvRuleDropInvalidLogLimit)))
+	if config == "" {
+		return defaultDropInvalidLogLimit, nil
+	}
+
+	matches := regexpLimit.FindStringSubmatch(config)
+	if matches == nil {
+		return "", fmt.Errorf("wrong config for %s : %s", EnvRuleDropInvalidLogLimit, config)
+	}
+	unit := map[string]string{"s": "sec", "m": "min", "h": "hour", "d": "day"}[matches[2][:1]]
+	return matches[1] + "/" + unit, nil
+}
+
+func GetConfigRuleDropInvalidNFLOGGroup() (int, error) {
+	config := strings.TrimSpace(os.Getenv(EnvRuleDropInvalidNFLOGGroup))
+	if config == "" {
+		return defaultDropInvalidNFLOGGroup, nil
+	}
+
+	group, err := strconv.Atoi(config)
+	if err != nil || group < 1 || group > 65535 {
+		return 0, fmt.Errorf("wrong config for %s : %s", EnvRuleDropInvalidNFLOGGroup, config)
+	}
+	return group, nil
+}
+
+// GetConfigRuleTCPMSSClampMSS returns the fixed MSS value, or 0 to clamp MSS to PMTU
+func GetConfigRuleTCPMSSClampMSS() (int, error) {
+	config := strings.ToLower(strings.TrimSpace(os.Getenv(EnvRuleTCPMSSClampMSS)))
+	if config == "" || config == TCPMSSClampPMTU {
+		return 0, nil
+	}
+
+	mss, err := strconv.Atoi(config)
+	if err != nil || mss < minTCPMSS || mss > maxTCPMSS {
+		return 0, fmt.Errorf("wrong config for %s : %s", EnvRuleTCPMSSClampMSS, config)
+	}
+	return mss, nil
+}
+
+func GetConfigRuleNodeLocalDNSAddrs() ([]string, error) {
+	if os.Getenv(EnvRuleNodeLocalDNSAddrs) == "" {
+		return []string{defaultNodeLocalDNSAddr}, nil
+	}
+	return GetConfigAddrs(EnvRuleNodeLocalDNSAddrs)
+}
+
+func GetConfigRuleNodeLocalDNSPort() (int, error) {
+	return GetConfigPort(EnvRuleNodeLocalDNSPort, defaultNodeLocalDNSPort)
+}
+
+func GetConfigRuleMasqNonMasqCIDRsIPv4() ([]string, error) {
+	cidrs, err := GetConfigCIDRs(EnvRuleMasqNonMasqCIDRsIPv4)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range cidrs {
+		if !ip.IsIPv4CIDR(cidr) {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleMasqNonMasqCIDRsIPv4, cidr)
+		}
+	}
+	return cidrs, nil
+}
+
+func GetConfigRuleMasqNonMasqCIDRsIPv6() ([]string, error) {
+	cidrs, err := GetConfigCIDRs(EnvRuleMasqNonMasqCIDRsIPv6)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range cidrs {
+		if !ip.IsIPv6CIDR(cidr) {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleMasqNonMasqCIDRsIPv6, cidr)
+		}
+	}
+	return cidrs, nil
+}
+
+// GetConfigRuleMasqFileNonMasqCIDRs returns the non-masquerade CIDRs of both families in the config file
+// of ip-masq-agent format. The file is read every time to reload the config. If the config file isn't set, ok is false.
+func GetConfigRuleMasqFileNonMasqCIDRs() (cidrs []string, ok bool, err error) {
+	path := strings.TrimSpace(os.Getenv(EnvRuleMasqConfigFile))
+	if path == "" {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, true, err
+	}
+	defer f.Close()
+
+	config := struct {
+		NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs"`
+	}{}
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&config); err != nil {
+		return nil, true, fmt.Errorf("wrong config file %s : %v", path, err)
+	}
+	for _, value := range config.NonMasqueradeCIDRs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(value))
+		if err != nil {
+			return nil, true, fmt.Errorf("wrong config file %s : %s", path, value)
+		}
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs, true, nil
+}
+
+func GetConfigRuleBlockMetadataEnabled() (bool, error) {
+	return GetConfigRuleEnabled(EnvRuleBlockMetadataEnable, false)
+}
+
+func GetConfigRuleBlockMetadataDests() ([]string, error) {
+	if os.Getenv(EnvRuleBlockMetadataDests) == "" {
+		return parseHostCIDRs(EnvRuleBlockMetadataDests, strings.Split(defaultBlockMetadataDests, ","))
+	}
+	return GetConfigHostCIDRs(EnvRuleBlockMetadataDests)
+}
+
+func GetConfigRuleBlockMetadataAllowedNamespaces() []string {
+	return GetConfigList(EnvRuleBlockMetadataAllowedNamespaces)
+}
+
+func GetConfigRuleExternalIPAllowlistEnabled() (bool, error) {
+	return GetConfigRuleEnabled(EnvRuleExternalIPAllowlistEnable, false)
+}
+
+func GetConfigRuleExternalIPAllowedCIDRs() ([]string, error) {
+	return GetConfigHostCIDRs(EnvRuleExternalIPAllowedCIDRs)
+}
+
+// GetConfigRuleExternalIPApprovedServices returns the "namespace/name" of the services whose all externalIPs are allowed.
+// "namespace/*" approves all services in the namespace.
+func GetConfigRuleExternalIPApprovedServices() ([]string, error) {
+	services := GetConfigList(EnvRuleExternalIPApprovedServices)
+	for _, service := range services {
+		if !isNamespacedName(service) {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleExternalIPApprovedServices, service)
+		}
+	}
+	return services, nil
+}
+
+// GetConfigRuleSysctlParams returns the comma separated sysctl params in "name=value" format
+func GetConfigRuleSysctlParams() ([]sysctl.Param, error) {
+	result := []sysctl.Param{}
+	names := map[string]bool{}
+	for _, value := range GetConfigList(EnvRuleSysctlParams) {
+		param, err := sysctl.ParseParam(value)
+		if err != nil || names[param.Name] {
+			return nil, fmt.Errorf("wrong config for %s : %s", EnvRuleSysctlParams, value)
+		}
+		names[param.Name] = true
+		result = append(result, param)
+	}
+	return result, nil
+}
+
+func GetConfigRuleSysctlStateFile() string {
+	if config := strings.TrimSpace(os.Getenv(EnvRuleSysctlStateFile)); config != "" {
+		return config
 	}
-	return false, fmt.Errorf("wrong config for externalIP to clusterIP DNAT : %s", config)
+	return defaultSysctlStateFile
 }
@@ -2,6 +2,7 @@ package configs
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -26,27 +27,244 @@ func TestGetConfigPodCIDR(t *testing.T) {
 }
 
 func TestGetConfigRuleExternalCluster(t *testing.T) {
+	defer os.Unsetenv(EnvRuleExternalClusterEnable)
+
 	os.Setenv(EnvRuleExternalClusterEnable, "")
-	enabled, _ := GetConfigRuleExternalClusterEnabled()
-	if enabled {
+	if enabled, _ := GetConfigRuleEnabled(EnvRuleExternalClusterEnable, false); enabled {
 		t.Errorf("wrong result - %s", "")
 	}
+	if enabled, _ := GetConfigRuleEnabled(EnvRuleExternalClusterEnable, true); !enabled {
+		t.Errorf("wrong result - %s", "default")
+	}
 
 	os.Setenv(EnvRuleExternalClusterEnable, "false")
-	enabled, _ = GetConfigRuleExternalClusterEnabled()
-	if enabled {
+	if enabled, _ := GetConfigRuleEnabled(EnvRuleExternalClusterEnable, true); enabled {
 		t.Errorf("wrong result - %s", "false")
 	}
 
 	os.Setenv(EnvRuleExternalClusterEnable, "true")
-	enabled, _ = GetConfigRuleExternalClusterEnabled()
-	if !enabled {
+	if enabled, _ := GetConfigRuleEnabled(EnvRuleExternalClusterEnable, false); !enabled {
 		t.Errorf("wrong result - %s", "true")
 	}
 
 	os.Setenv(EnvRuleExternalClusterEnable, "none")
-	_, err := GetConfigRuleExternalClusterEnabled()
+	if _, err := GetConfigRuleEnabled(EnvRuleExternalClusterEnable, false); err == nil {
+		t.Errorf("wrong result - %s", "none")
+	}
+}
+
+func TestGetConfigRuleExternalClusterMasqMarkBit(t *testing.T) {
+	for config, expected := range map[string]int{"": 13, "0": 0, " 14 ": 14, "31": 31} {
+		os.Setenv(EnvRuleExternalClusterMasqMarkBit, config)
+		bit, err := GetConfigRuleExternalClusterMasqMarkBit()
+		if err != nil || bit != expected {
+			t.Errorf("wrong result - %s : %d %v", config, bit, err)
+		}
+	}
+	for _, config := range []string{"-1", "32", "0x4000"} {
+		os.Setenv(EnvRuleExternalClusterMasqMarkBit, config)
+		if _, err := GetConfigRuleExternalClusterMasqMarkBit(); err == nil {
+			t.Errorf("wrong result - %s", config)
+		}
+	}
+	os.Unsetenv(EnvRuleExternalClusterMasqMarkBit)
+}
+
+func TestGetConfigRuleExternalClusterSrcs(t *testing.T) {
+	os.Setenv(EnvRuleExternalClusterSrcCIDRsIPv4, "10.10.0.1/16, 172.30.0.0/24")
+	cidrs, err := GetConfigRuleExternalClusterSrcCIDRsIPv4()
+	if err != nil || len(cidrs) != 2 || cidrs[0] != "10.10.0.0/16" || cidrs[1] != "172.30.0.0/24" {
+		t.Errorf("wrong result - %v %v", cidrs, err)
+	}
+	os.Setenv(EnvRuleExternalClusterSrcCIDRsIPv4, "fd00::/64")
+	if _, err := GetConfigRuleExternalClusterSrcCIDRsIPv4(); err == nil {
+		t.Errorf("wrong result - %s", "fd00::/64")
+	}
+	os.Unsetenv(EnvRuleExternalClusterSrcCIDRsIPv4)
+
+	os.Setenv(EnvRuleExternalClusterSrcCIDRsIPv6, "10.10.0.0/16")
+	if _, err := GetConfigRuleExternalClusterSrcCIDRsIPv6(); err == nil {
+		t.Errorf("wrong result - %s", "10.10.0.0/16")
+	}
+	os.Unsetenv(EnvRuleExternalClusterSrcCIDRsIPv6)
+
+	os.Setenv(EnvRuleExternalClusterSrcInterfacesIPv4, "virbr0, net1+")
+	ifaces, err := GetConfigRuleExternalClusterSrcInterfacesIPv4()
+	if err != nil || len(ifaces) != 2 || ifaces[0] != "virbr0" || ifaces[1] != "net1+" {
+		t.Errorf("wrong result - %v %v", ifaces, err)
+	}
+	os.Setenv(EnvRuleExternalClusterSrcInterfacesIPv4, "eth 0")
+	if _, err := GetConfigRuleExternalClusterSrcInterfacesIPv4(); err == nil {
+		t.Errorf("wrong result - %s", "eth 0")
+	}
+	os.Unsetenv(EnvRuleExternalClusterSrcInterfacesIPv4)
+}
+
+func TestGetConfigRuleExternalClusterOutputOwners(t *testing.T) {
+	os.Setenv(EnvRuleExternalClusterOutputExcludeIPv4, "uid:1000, GID:2000,cgroup:system.slice/node-exporter.service")
+	owners, include, err := GetConfigRuleExternalClusterOutputOwnersIPv4()
+	if err != nil || include || !reflect.DeepEqual(owners, []Owner{
+		{OwnerUID, "1000"}, {OwnerGID, "2000"}, {OwnerCgroup, "system.slice/node-exporter.service"},
+	}) {
+		t.Errorf("wrong result - %v %v %v", owners, include, err)
+	}
+
+	// Both exclude and include
+	os.Setenv(EnvRuleExternalClusterOutputIncludeIPv4, "uid:0")
+	if _, _, err := GetConfigRuleExternalClusterOutputOwnersIPv4(); err == nil {
+		t.Errorf("no error for both exclude and include")
+	}
+	os.Unsetenv(EnvRuleExternalClusterOutputExcludeIPv4)
+	owners, include, err = GetConfigRuleExternalClusterOutputOwnersIPv4()
+	if err != nil || !include || !reflect.DeepEqual(owners, []Owner{{OwnerUID, "0"}}) {
+		t.Errorf("wrong result - %v %v %v", owners, include, err)
+	}
+	os.Unsetenv(EnvRuleExternalClusterOutputIncludeIPv4)
+
+	for _, config := range []string{"1000", "uid:root", "pid:1", "cgroup:a b"} {
+		os.Setenv(EnvRuleExternalClusterOutputExcludeIPv6, config)
+		if _, _, err := GetConfigRuleExternalClusterOutputOwnersIPv6(); err == nil {
+			t.Errorf("wrong result - %s", config)
+		}
+	}
+	os.Unsetenv(EnvRuleExternalClusterOutputExcludeIPv6)
+}
+
+func TestGetConfigRuleExternalClusterIngressService(t *testing.T) {
+	os.Setenv(EnvRuleExternalClusterIngressService, " ingress-nginx/ingress-nginx-controller ")
+	if service, err := GetConfigRuleExternalClusterIngressService(); err != nil || service != "ingress-nginx/ingress-nginx-controller" {
+		t.Errorf("wrong result - %s %v", service, err)
+	}
+
+	for _, config := range []string{"ingress-nginx-controller", "/ingress-nginx-controller", "a/b/c"} {
+		os.Setenv(EnvRuleExternalClusterIngressService, config)
+		if _, err := GetConfigRuleExternalClusterIngressService(); err == nil {
+			t.Errorf("wrong result - %s", config)
+		}
+	}
+	os.Unsetenv(EnvRuleExternalClusterIngressService)
+}
+
+func TestGetConfigRuleExternalClusterBackingServices(t *testing.T) {
+	os.Setenv(EnvRuleExternalClusterBackingServices, "ingress-nginx/ingress-nginx-controller, istio-system/istio-ingressgateway")
+	defer os.Unsetenv(EnvRuleExternalClusterBackingServices)
+	services, err := GetConfigRuleExternalClusterBackingServices()
+	if err != nil || !reflect.DeepEqual(services, []string{"ingress-nginx/ingress-nginx-controller", "istio-system/istio-ingressgateway"}) {
+		t.Errorf("wrong result - %v %v", services, err)
+	}
+
+	os.Setenv(EnvRuleExternalClusterBackingServices, "ingress-nginx/ingress-nginx-controller,istio-ingressgateway")
+	if _, err := GetConfigRuleExternalClusterBackingServices(); err == nil {
+		t.Errorf("no error for wrong config")
+	}
+}
+
+func TestGetConfigRuleExternalIPApprovedServices(t *testing.T) {
+	os.Setenv(EnvRuleExternalIPApprovedServices, "default/nginx, kube-system/*")
+	defer os.Unsetenv(EnvRuleExternalIPApprovedServices)
+	services, err := GetConfigRuleExternalIPApprovedServices()
+	if err != nil || !reflect.DeepEqual(services, []string{"default/nginx", "kube-system/*"}) {
+		t.Errorf("wrong result - %v %v", services, err)
+	}
+
+	os.Setenv(EnvRuleExternalIPApprovedServices, "default/nginx,kube-system")
+	if _, err := GetConfigRuleExternalIPApprovedServices(); err == nil {
+		t.Errorf("no error for wrong config")
+	}
+}
+
+func TestGetConfigRuleEnabled(t *testing.T) {
+	key := "RULE_TEST_ENABLE"
+
+	os.Setenv(key, "")
+	enabled, _ := GetConfigRuleEnabled(key, true)
+	if !enabled {
+		t.Errorf("wrong result - %s", "default")
+	}
+
+	os.Setenv(key, "False")
+	enabled, _ = GetConfigRuleEnabled(key, true)
+	if enabled {
+		t.Errorf("wrong result - %s", "False")
+	}
+
+	os.Setenv(key, "none")
+	_, err := GetConfigRuleEnabled(key, true)
 	if err == nil {
 		t.Errorf("wrong result - %s", "none")
 	}
 }
+
+func TestGetConfigRuleDropInvalid(t *testing.T) {
+	os.Setenv(EnvRuleDropInvalidSrcCIDRs, "10.0.0.1/8, fd00::1/64")
+	cidrs, err := GetConfigRuleDropInvalidSrcCIDRs()
+	if err != nil || len(cidrs) != 2 || cidrs[0] != "10.0.0.0/8" || cidrs[1] != "fd00::/64" {
+		t.Errorf("wrong result - %v %v", cidrs, err)
+	}
+	os.Setenv(EnvRuleDropInvalidSrcCIDRs, "10.0.0.1")
+	if _, err := GetConfigRuleDropInvalidSrcCIDRs(); err == nil {
+		t.Errorf("wrong result - %s", "10.0.0.1")
+	}
+	os.Unsetenv(EnvRuleDropInvalidSrcCIDRs)
+
+	os.Setenv(EnvRuleDropInvalidProtocols, "icmp")
+	if _, err := GetConfigRuleDropInvalidProtocols(); err == nil {
+		t.Errorf("wrong result - %s", "icmp")
+	}
+	os.Unsetenv(EnvRuleDropInvalidProtocols)
+
+	for config, expected := range map[string]string{"": "10/min", "5/second": "5/sec", "1/h": "1/hour", "3/minutes": ""} {
+		os.Setenv(EnvRuleDropInvalidLogLimit, config)
+		limit, err := GetConfigRuleDropInvalidLogLimit()
+		if limit != expected || (expected == "") != (err != nil) {
+			t.Errorf("wrong result - %s : %s %v", config, limit, err)
+		}
+	}
+	os.Unsetenv(EnvRuleDropInvalidLogLimit)
+
+	os.Setenv(EnvRuleDropInvalidLog, "syslog")
+	if _, err := GetConfigRuleDropInvalidLog(); err == nil {
+		t.Errorf("wrong result - %s", "syslog")
+	}
+	os.Unsetenv(EnvRuleDropInvalidLog)
+}
+
+func TestGetConfigRuleTCPMSSClampMSS(t *testing.T) {
+	for config, expected := range map[string]int{"": 0, "PMTU": 0, "1400": 1400} {
+		os.Setenv(EnvRuleTCPMSSClampMSS, config)
+		mss, err := GetConfigRuleTCPMSSClampMSS()
+		if err != nil || mss != expected {
+			t.Errorf("wrong result - %s : %d %v", config, mss, err)
+		}
+	}
+	for _, config := range []string{"100", "auto"} {
+		os.Setenv(EnvRuleTCPMSSClampMSS, config)
+		if _, err := GetConfigRuleTCPMSSClampMSS(); err == nil {
+			t.Errorf("wrong result - %s", config)
+		}
+	}
+	os.Unsetenv(EnvRuleTCPMSSClampMSS)
+}
+
+func TestGetConfigRuleNodeLocalDNS(t *testing.T) {
+	addrs, err := GetConfigRuleNodeLocalDNSAddrs()
+	if err != nil || len(addrs) != 1 || addrs[0] != "169.254.20.10" {
+		t.Errorf("wrong result - %v %v", addrs, err)
+	}
+	os.Setenv(EnvRuleNodeLocalDNSAddrs, "169.254.20.10,fd00::0a")
+	addrs, err = GetConfigRuleNodeLocalDNSAddrs()
+	if err != nil || len(addrs) != 2 || addrs[1] != "fd00::a" {
+		t.Errorf("wrong result - %v %v", addrs, err)
+	}
+	os.Setenv(EnvRuleNodeLocalDNSAddrs, "169.254.20.10/32")
+	if _, err := GetConfigRuleNodeLocalDNSAddrs(); err == nil {
+		t.Errorf("wrong result - %s", "169.254.20.10/32")
+	}
+	os.Unsetenv(EnvRuleNodeLocalDNSAddrs)
+
+	os.Setenv(EnvRuleNodeLocalDNSPort, "65536")
+	if _, err := GetConfigRuleNodeLocalDNSPort(); err == nil {
+		t.Errorf("wrong result - %s", "65536")
+	}
+	os.Unsetenv(EnvRuleNodeLocalDNSPort)
+}
@@ -0,0 +1,126 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Deleter deletes the conntrack entries matched with any of the filters in the same family
+// by dumping entries once and returns the number of deleted entries
+type Deleter func(filters []Filter) (int, error)
+
+// Filter selects conntrack entries by the original destination and the reply source
+type Filter struct {
+	// Protocol is the IP protocol number. 0 matches all protocols.
+	Protocol uint8
+	// OrigDst is the original destination address
+	OrigDst net.IP
+	// ReplySrc is the reply source address, which is the DNAT destination of the original destination.
+	// nil matches all addresses.
+	ReplySrc net.IP
+}
+
+// Const
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+
+	FamilyIPv4 = "IPv4"
+	FamilyIPv6 = "IPv6"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+// Vars
+var (
+	lock            = &sync.Mutex{}
+	deleter Deleter = deleteEntries
+
+	dryRun       = false
+	dryRunLogger logr.Logger
+
+	deleteTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "network_node_manager_conntrack_delete_total",
+		Help: "Number of conntrack delete operations by family and result",
+	}, []string{"family", "result"})
+	deletedEntriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "network_node_manager_conntrack_deleted_entries_total",
+		Help: "Number of deleted conntrack entries by family",
+	}, []string{"family"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(deleteTotal, deletedEntriesTotal)
+}
+
+// SetDeleter replaces the deleter of conntrack entries and returns the previous one. It's used for tests.
+func SetDeleter(d Deleter) Deleter {
+	lock.Lock()
+	defer lock.Unlock()
+
+	prev := deleter
+	deleter = d
+	return prev
+}
+
+// SetDryRun makes conntrack entries be logged instead of being deleted
+func SetDryRun(logger logr.Logger) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	dryRun = true
+	dryRunLogger = logger
+}
+
+// DeleteEntries deletes the conntrack entries matched with any of the filters and returns the number of deleted entries.
+// The entries of each family of the original destinations are dumped once.
+func DeleteEntries(filters []Filter) (int, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if dryRun {
+		for _, filter := range filters {
+			dryRunLogger.Info("dry-run conntrack delete", "family", filter.family(), "protocol", filter.Protocol,
+				"origDst", filter.OrigDst.String(), "replySrc", filter.ReplySrc.String())
+		}
+		return 0, nil
+	}
+
+	// Group filters by family
+	familyFilters := map[string][]Filter{}
+	for _, filter := range filters {
+		familyFilters[filter.family()] = append(familyFilters[filter.family()], filter)
+	}
+
+	total := 0
+	for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+		if len(familyFilters[family]) == 0 {
+			continue
+		}
+		count, err := deleter(familyFilters[family])
+		total += count
+		if err != nil {
+			deleteTotal.WithLabelValues(family, resultFailure).Inc()
+			return total, err
+		}
+		deleteTotal.WithLabelValues(family, resultSuccess).Inc()
+		deletedEntriesTotal.WithLabelValues(family).Add(float64(count))
+	}
+	return total, nil
+}
+
+func (f Filter) match(protocol uint8, origDst, replySrc net.IP) bool {
+	return (f.Protocol == 0 || f.Protocol == protocol) && f.OrigDst.Equal(origDst) && (f.ReplySrc == nil || f.ReplySrc.Equal(replySrc))
+}
+
+func (f Filter) family() string {
+	if f.OrigDst.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
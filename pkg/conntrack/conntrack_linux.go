@@ -0,0 +1,273 @@
+//go:build linux
+// +build linux
+
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Const of ctnetlink. Reference - include/uapi/linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaZone       = 18
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum = 1
+
+	sizeofNfgenmsg = 4
+	recvBufferSize = 65536
+
+	nlaTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+)
+
+// Vars
+var (
+	nativeEndian binary.ByteOrder
+	sequence     uint32
+)
+
+type netlinkAttr struct {
+	attrType uint16
+	data     []byte
+	raw      []byte
+}
+
+func init() {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// deleteEntries dumps the conntrack entries of the family through netlink and deletes the matched ones
+func deleteEntries(filters []Filter) (int, error) {
+	if len(filters) == 0 {
+		return 0, nil
+	}
+	family := uint8(unix.AF_INET6)
+	if filters[0].OrigDst.To4() != nil {
+		family = unix.AF_INET
+	}
+
+	// Open netlink socket
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, err
+	}
+
+	// Get matched entries. Entries are deleted after the dump is done.
+	msgs, err := request(fd, newRequest(ipctnlMsgCtGet, unix.NLM_F_DUMP, family, nil))
+	if err != nil {
+		return 0, err
+	}
+	var targets [][]byte
+	for _, msg := range msgs {
+		if attrs, ok := matchEntry(msg, filters); ok {
+			targets = append(targets, attrs)
+		}
+	}
+
+	// Delete entries
+	count := 0
+	for _, attrs := range targets {
+		if _, err := request(fd, newRequest(ipctnlMsgCtDelete, unix.NLM_F_ACK, family, attrs)); err != nil {
+			if err == unix.ENOENT {
+				// Already expired
+				continue
+			}
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// newRequest returns a ctnetlink message with the attributes
+func newRequest(msgType uint16, flags uint16, family uint8, attrs []byte) []byte {
+	b := make([]byte, unix.SizeofNlMsghdr+sizeofNfgenmsg+len(attrs))
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:6], uint16(unix.NFNL_SUBSYS_CTNETLINK<<8)|msgType)
+	nativeEndian.PutUint16(b[6:8], unix.NLM_F_REQUEST|flags)
+	nativeEndian.PutUint32(b[8:12], atomic.AddUint32(&sequence, 1))
+	b[unix.SizeofNlMsghdr] = family
+	b[unix.SizeofNlMsghdr+1] = unix.NFNETLINK_V0
+	copy(b[unix.SizeofNlMsghdr+sizeofNfgenmsg:], attrs)
+	return b
+}
+
+// request sends the message and returns the payloads of the response messages until the request is done
+func request(fd int, msg []byte) ([][]byte, error) {
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	return receive(func(buf []byte) (int, error) {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		return n, err
+	}, nativeEndian.Uint32(msg[8:12]))
+}
+
+// receive returns the payloads of the response messages of the sequence read by recv until the request is done.
+// A dump spans several reads, so the payloads are copied out of the read buffer reused by each read.
+func receive(recv func(buf []byte) (int, error), seq uint32) ([][]byte, error) {
+	var result [][]byte
+	buf := make([]byte, recvBufferSize)
+	for {
+		n, err := recv(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 || n > len(buf) {
+			return nil, unix.EIO
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return result, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, unix.EINVAL
+				}
+				if errno := -int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, unix.Errno(errno)
+				}
+				return result, nil
+			}
+			result = append(result, append([]byte(nil), m.Data...))
+			if m.Header.Flags&unix.NLM_F_MULTI == 0 {
+				return result, nil
+			}
+		}
+	}
+}
+
+// matchEntry returns the attributes to delete the entry if the entry in the payload is matched with any of the filters
+func matchEntry(payload []byte, filters []Filter) ([]byte, bool) {
+	if len(payload) < sizeofNfgenmsg {
+		return nil, false
+	}
+
+	var tuple, reply, zone *netlinkAttr
+	for _, attr := range parseAttrs(payload[sizeofNfgenmsg:]) {
+		attr := attr
+		switch attr.attrType {
+		case ctaTupleOrig:
+			tuple = &attr
+		case ctaTupleReply:
+			reply = &attr
+		case ctaZone:
+			zone = &attr
+		}
+	}
+	if tuple == nil {
+		return nil, false
+	}
+
+	// Get the destination and the protocol of the original direction and the source of the reply direction
+	_, dst, protocol := parseTuple(tuple)
+	var replySrc net.IP
+	if reply != nil {
+		replySrc, _, _ = parseTuple(reply)
+	}
+	matched := false
+	for _, filter := range filters {
+		if filter.match(protocol, dst, replySrc) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil, false
+	}
+
+	// The original tuple and the zone identify the entry
+	var b bytes.Buffer
+	for _, attr := range []*netlinkAttr{tuple, zone} {
+		if attr != nil {
+			b.Write(attr.raw)
+			b.Write(make([]byte, nlaAlign(len(attr.raw))-len(attr.raw)))
+		}
+	}
+	return b.Bytes(), true
+}
+
+// parseTuple returns the source, the destination and the protocol of the tuple
+func parseTuple(tuple *netlinkAttr) (net.IP, net.IP, uint8) {
+	var src, dst net.IP
+	var protocol uint8
+	for _, attr := range parseAttrs(tuple.data) {
+		switch attr.attrType {
+		case ctaTupleIP:
+			for _, ipAttr := range parseAttrs(attr.data) {
+				switch ipAttr.attrType {
+				case ctaIPv4Src, ctaIPv6Src:
+					src = net.IP(ipAttr.data)
+				case ctaIPv4Dst, ctaIPv6Dst:
+					dst = net.IP(ipAttr.data)
+				}
+			}
+		case ctaTupleProto:
+			for _, protoAttr := range parseAttrs(attr.data) {
+				if protoAttr.attrType == ctaProtoNum && len(protoAttr.data) == 1 {
+					protocol = protoAttr.data[0]
+				}
+			}
+		}
+	}
+	return src, dst, protocol
+}
+
+func parseAttrs(b []byte) []netlinkAttr {
+	var result []netlinkAttr
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		if length < unix.SizeofNlAttr || length > len(b) {
+			break
+		}
+		result = append(result, netlinkAttr{
+			attrType: nativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			data:     b[unix.SizeofNlAttr:length],
+			raw:      b[:length],
+		})
+		if nlaAlign(length) >= len(b) {
+			break
+		}
+		b = b[nlaAlign(length):]
+	}
+	return result
+}
+
+func nlaAlign(length int) int {
+	return (length + unix.NLA_ALIGNTO - 1) & ^(unix.NLA_ALIGNTO - 1)
+}
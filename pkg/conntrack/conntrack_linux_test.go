@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package conntrack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newAttr(attrType uint16, data []byte) []byte {
+	b := make([]byte, nlaAlign(unix.SizeofNlAttr+len(data)))
+	nativeEndian.PutUint16(b[0:2], uint16(unix.SizeofNlAttr+len(data)))
+	nativeEndian.PutUint16(b[2:4], attrType)
+	copy(b[unix.SizeofNlAttr:], data)
+	return b
+}
+
+func newTuple(tupleType uint16, protocol uint8, src, dst net.IP) []byte {
+	return newAttr(tupleType|unix.NLA_F_NESTED, append(
+		newAttr(ctaTupleIP|unix.NLA_F_NESTED, append(
+			newAttr(ctaIPv4Src, src.To4()),
+			newAttr(ctaIPv4Dst, dst.To4())...)),
+		newAttr(ctaTupleProto|unix.NLA_F_NESTED, newAttr(ctaProtoNum, []byte{protocol}))...))
+}
+
+// newEntry returns the payload of the entry DNATed from dst to replySrc, and the attributes to delete it
+func newEntry(protocol uint8, dst, replySrc net.IP) ([]byte, []byte) {
+	src := net.ParseIP("10.244.0.5")
+	tuple := newTuple(ctaTupleOrig, protocol, src, dst)
+	zone := newAttr(ctaZone|unix.NLA_F_NET_BYTEORDER, []byte{0, 0})
+	payload := append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, tuple...)
+	payload = append(payload, newTuple(ctaTupleReply, protocol, replySrc, src)...)
+	payload = append(payload, zone...)
+	return payload, append(tuple, zone...)
+}
+
+func TestMatchEntry(t *testing.T) {
+	payload, attrs := newEntry(ProtocolUDP, net.ParseIP("192.168.0.10"), net.ParseIP("10.244.1.10"))
+
+	result, ok := matchEntry(payload, []Filter{{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.10")}})
+	if !ok || !bytes.Equal(result, attrs) {
+		t.Errorf("wrong match - %v %v", ok, result)
+	}
+	if _, ok := matchEntry(payload, []Filter{{OrigDst: net.ParseIP("192.168.0.10")}}); !ok {
+		t.Errorf("not matched for all protocols")
+	}
+	if _, ok := matchEntry(payload, []Filter{{Protocol: ProtocolTCP, OrigDst: net.ParseIP("192.168.0.10")}}); ok {
+		t.Errorf("matched with other protocol")
+	}
+	if _, ok := matchEntry(payload, []Filter{{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.20")}}); ok {
+		t.Errorf("matched with other destination")
+	}
+
+	// Reply source is the DNAT destination
+	if _, ok := matchEntry(payload, []Filter{{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.10"), ReplySrc: net.ParseIP("10.244.1.10")}}); !ok {
+		t.Errorf("not matched with reply source")
+	}
+	if _, ok := matchEntry(payload, []Filter{{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.10"), ReplySrc: net.ParseIP("10.244.1.20")}}); ok {
+		t.Errorf("matched with other reply source")
+	}
+	if _, ok := matchEntry(payload, []Filter{
+		{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.10"), ReplySrc: net.ParseIP("10.244.1.20")},
+		{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.10"), ReplySrc: net.ParseIP("10.244.1.10")},
+	}); !ok {
+		t.Errorf("not matched with one of filters")
+	}
+}
+
+// newMessage returns a netlink message of the sequence with the payload
+func newMessage(msgType uint16, flags uint16, seq uint32, payload []byte) []byte {
+	b := make([]byte, nlaAlign(unix.SizeofNlMsghdr+len(payload)))
+	nativeEndian.PutUint32(b[0:4], uint32(unix.SizeofNlMsghdr+len(payload)))
+	nativeEndian.PutUint16(b[4:6], msgType)
+	nativeEndian.PutUint16(b[6:8], flags)
+	nativeEndian.PutUint32(b[8:12], seq)
+	copy(b[unix.SizeofNlMsghdr:], payload)
+	return b
+}
+
+func TestReceiveMultipart(t *testing.T) {
+	entry1, _ := newEntry(ProtocolUDP, net.ParseIP("192.168.0.10"), net.ParseIP("10.244.1.10"))
+	entry2, _ := newEntry(ProtocolTCP, net.ParseIP("192.168.0.20"), net.ParseIP("10.244.1.20"))
+	entry3, _ := newEntry(ProtocolUDP, net.ParseIP("192.168.0.30"), net.ParseIP("10.244.1.30"))
+	msgType := uint16(unix.NFNL_SUBSYS_CTNETLINK<<8) | ipctnlMsgCtGet
+
+	// The dump spans several reads into the same buffer, and has a message of another sequence
+	reads := [][]byte{
+		append(newMessage(msgType, unix.NLM_F_MULTI, 7, entry1), newMessage(msgType, unix.NLM_F_MULTI, 6, entry3)...),
+		newMessage(msgType, unix.NLM_F_MULTI, 7, entry2),
+		append(newMessage(msgType, unix.NLM_F_MULTI, 7, entry3), newMessage(unix.NLMSG_DONE, unix.NLM_F_MULTI, 7, []byte{0, 0, 0, 0})...),
+	}
+	recv := func(buf []byte) (int, error) {
+		if len(reads) == 0 {
+			t.Fatalf("read after the dump is done")
+		}
+		n := copy(buf, reads[0])
+		reads = reads[1:]
+		return n, nil
+	}
+	payloads, err := receive(recv, 7)
+	if err != nil || len(payloads) != 3 {
+		t.Fatalf("failed to receive - %d %v", len(payloads), err)
+	}
+	for i, entry := range [][]byte{entry1, entry2, entry3} {
+		if !bytes.Equal(payloads[i], entry) {
+			t.Errorf("payload %d is overwritten - %v", i, payloads[i])
+		}
+	}
+
+	// Error of read and error message
+	if _, err := receive(func(buf []byte) (int, error) { return -1, unix.EINTR }, 7); err != unix.EINTR {
+		t.Errorf("wrong error of read - %v", err)
+	}
+	errno := make([]byte, 4)
+	code := -int32(unix.ENOENT)
+	nativeEndian.PutUint32(errno, uint32(code))
+	msg := newMessage(unix.NLMSG_ERROR, 0, 7, errno)
+	if _, err := receive(func(buf []byte) (int, error) { return copy(buf, msg), nil }, 7); err != unix.ENOENT {
+		t.Errorf("wrong error of message - %v", err)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	attrs := []byte{1, 2, 3, 4}
+	b := newRequest(ipctnlMsgCtDelete, unix.NLM_F_ACK, unix.AF_INET6, attrs)
+	if int(nativeEndian.Uint32(b[0:4])) != len(b) || len(b) != unix.SizeofNlMsghdr+sizeofNfgenmsg+len(attrs) {
+		t.Errorf("wrong length - %d", len(b))
+	}
+	if nativeEndian.Uint16(b[4:6]) != unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtDelete {
+		t.Errorf("wrong type - %d", nativeEndian.Uint16(b[4:6]))
+	}
+	if nativeEndian.Uint16(b[6:8]) != unix.NLM_F_REQUEST|unix.NLM_F_ACK {
+		t.Errorf("wrong flags - %d", nativeEndian.Uint16(b[6:8]))
+	}
+	if b[unix.SizeofNlMsghdr] != unix.AF_INET6 || !bytes.Equal(b[len(b)-len(attrs):], attrs) {
+		t.Errorf("wrong payload - %v", b)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package conntrack
+
+import "errors"
+
+func deleteEntries(filters []Filter) (int, error) {
+	return 0, errors.New("conntrack is only supported on linux")
+}
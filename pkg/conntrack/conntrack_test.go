@@ -0,0 +1,43 @@
+package conntrack
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeleteEntries(t *testing.T) {
+	dumps := 0
+	prev := SetDeleter(func(filters []Filter) (int, error) {
+		dumps++
+		if filters[0].OrigDst.To4() != nil {
+			return len(filters), nil
+		}
+		return 0, errors.New("netlink error")
+	})
+	defer SetDeleter(prev)
+
+	// Filters of a family are deleted by a dump
+	count, err := DeleteEntries([]Filter{
+		{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.10"), ReplySrc: net.ParseIP("10.244.1.10")},
+		{Protocol: ProtocolUDP, OrigDst: net.ParseIP("192.168.0.20"), ReplySrc: net.ParseIP("10.244.1.10")},
+	})
+	if err != nil || count != 2 || dumps != 1 {
+		t.Errorf("wrong result - %d %d %v", count, dumps, err)
+	}
+	if _, err := DeleteEntries([]Filter{{Protocol: ProtocolUDP, OrigDst: net.ParseIP("fd00:192:168::10")}}); err == nil {
+		t.Errorf("no error")
+	}
+
+	if v := testutil.ToFloat64(deleteTotal.WithLabelValues(FamilyIPv4, resultSuccess)); v != 1 {
+		t.Errorf("wrong IPv4 success count - %v", v)
+	}
+	if v := testutil.ToFloat64(deletedEntriesTotal.WithLabelValues(FamilyIPv4)); v != 2 {
+		t.Errorf("wrong IPv4 deleted entries - %v", v)
+	}
+	if v := testutil.ToFloat64(deleteTotal.WithLabelValues(FamilyIPv6, resultFailure)); v != 1 {
+		t.Errorf("wrong IPv6 failure count - %v", v)
+	}
+}
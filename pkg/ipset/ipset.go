@@ -0,0 +1,238 @@
+// Tested with ipset version 7.11 in alpine
+package ipset
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// Type
+type Type string
+
+// Family is the address family of a set
+type Family string
+
+// Runner runs a command and returns its stdout, or its stderr if the command fails
+type Runner func(name string, args ...string) ([]byte, error)
+
+// Const
+const (
+	ipsetCmd = "ipset"
+
+	ipsetMembers = "Members:"
+
+	TypeHashIP Type = "hash:ip"
+
+	FamilyIPv4 Family = "inet"
+	FamilyIPv6 Family = "inet6"
+)
+
+// Var
+var (
+	lock   = &sync.Mutex{}
+	runner = Runner(runCommand)
+
+	dryRun           = false
+	dryRunLogger     logr.Logger
+	dryRunCommands   []string
+	dryRunCommandSet = map[string]bool{}
+)
+
+// SetRunner replaces the runner of ipset commands and returns the previous one. It's used for tests.
+func SetRunner(r Runner) Runner {
+	lock.Lock()
+	defer lock.Unlock()
+
+	prev := runner
+	runner = r
+	return prev
+}
+
+// SetDryRun makes all mutating commands be recorded and logged instead of being executed.
+// Read commands are still executed to inspect the real state.
+func SetDryRun(logger logr.Logger) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	dryRun = true
+	dryRunLogger = logger
+}
+
+// GetDryRunCommands returns the recorded mutating commands without duplication in dry-run mode
+func GetDryRunCommands() []string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return append([]string{}, dryRunCommands...)
+}
+
+// IsAvailable returns whether the ipset command exists in the node
+func IsAvailable() bool {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := runner(ipsetCmd, "version")
+	return err == nil
+}
+
+// IsExistSet
+func IsExistSet(name string) bool {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := runner(ipsetCmd, "list", "-n", name)
+	return err == nil
+}
+
+// CreateSet
+func CreateSet(name string, setType Type, family Family) (string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Create set. If already exists, return success
+	out, err := mutateIpset("create", name, string(setType), "family", string(family), "-exist")
+	if err != nil {
+		return string(out), err
+	}
+
+	return string(out), nil
+}
+
+// DestroySet
+func DestroySet(name string) (string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Check set
+	out, err := runner(ipsetCmd, "list", "-n", name)
+	if err != nil {
+		// If set isn't exist, return success
+		return string(out), nil
+	}
+
+	// Destroy set
+	out, err = mutateIpset("destroy", name)
+	if err != nil {
+		return string(out), err
+	}
+
+	return string(out), nil
+}
+
+// GetSets
+func GetSets() ([]string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Get sets
+	out, err := runner(ipsetCmd, "list", "-n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Parsing and set result
+	var result []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+
+	return result, nil
+}
+
+// GetEntries
+func GetEntries(name string) ([]string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Get set
+	out, err := runner(ipsetCmd, "list", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parsing and set result. Entries are listed after the members line
+	var result []string
+	members := false
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == ipsetMembers {
+			members = true
+		} else if members && line != "" {
+			result = append(result, line)
+		}
+	}
+
+	return result, nil
+}
+
+// AddEntry
+func AddEntry(name string, entry string) (string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Add entry. If already exists, return success
+	out, err := mutateIpset("add", name, entry, "-exist")
+	if err != nil {
+		return string(out), err
+	}
+
+	return string(out), nil
+}
+
+// DeleteEntry
+func DeleteEntry(name string, entry string) (string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Delete entry. If entry isn't exist, return success
+	out, err := mutateIpset("del", name, entry, "-exist")
+	if err != nil {
+		return string(out), err
+	}
+
+	return string(out), nil
+}
+
+// Run mutating ipset command within lock. In dry-run mode, record it instead of running
+func mutateIpset(args ...string) ([]byte, error) {
+	if !dryRun {
+		return runner(ipsetCmd, args...)
+	}
+
+	command := strings.Join(append([]string{ipsetCmd}, args...), " ")
+	if !dryRunCommandSet[command] {
+		dryRunCommandSet[command] = true
+		dryRunCommands = append(dryRunCommands, command)
+		dryRunLogger.Info("dry-run ipset command", "command", command)
+	}
+	return nil, nil
+}
+
+// Run command and return stdout. If the command fails, return stderr
+func runCommand(name string, args ...string) ([]byte, error) {
+	// Set command
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// Run command
+	if err := cmd.Run(); err != nil {
+		return stderr.Bytes(), err
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+package ipset
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	setTest = "TestSet"
+
+	listTest = `Name: TestSet
+Type: hash:ip
+Revision: 4
+Header: family inet hashsize 1024 maxelem 65536
+Size in memory: 248
+References: 1
+Number of entries: 2
+Members:
+192.168.0.10
+192.168.0.20
+`
+)
+
+// setFakeRunner replaces the runner with the fake which returns the outputs of the commands and records the commands
+func setFakeRunner(t *testing.T, outputs map[string]string) *[]string {
+	commands := []string{}
+	prev := SetRunner(func(name string, args ...string) ([]byte, error) {
+		command := strings.Join(append([]string{name}, args...), " ")
+		commands = append(commands, command)
+		out, ok := outputs[command]
+		if !ok {
+			return []byte("ipset v7.11: The set with the given name does not exist"), errors.New("exit status 1")
+		}
+		return []byte(out), nil
+	})
+	t.Cleanup(func() { SetRunner(prev) })
+	return &commands
+}
+
+func TestGetEntries(t *testing.T) {
+	setFakeRunner(t, map[string]string{"ipset list " + setTest: listTest})
+
+	entries, err := GetEntries(setTest)
+	if err != nil {
+		t.Fatalf("failed to get entries : %v", err)
+	}
+	if !reflect.DeepEqual(entries, []string{"192.168.0.10", "192.168.0.20"}) {
+		t.Errorf("wrong entries - %v", entries)
+	}
+	if _, err := GetEntries("Unknown"); err == nil {
+		t.Errorf("no error for unknown set")
+	}
+}
+
+func TestGetSets(t *testing.T) {
+	setFakeRunner(t, map[string]string{"ipset list -n": "TestSet\nTestSet6\n"})
+
+	sets, err := GetSets()
+	if err != nil || !reflect.DeepEqual(sets, []string{"TestSet", "TestSet6"}) {
+		t.Errorf("wrong sets - %v %v", sets, err)
+	}
+}
+
+func TestCreateDestroySet(t *testing.T) {
+	commands := setFakeRunner(t, map[string]string{
+		"ipset create " + setTest + " hash:ip family inet6 -exist": "",
+	})
+
+	if out, err := CreateSet(setTest, TypeHashIP, FamilyIPv6); err != nil {
+		t.Errorf("failed to create set - out:%s", out)
+	}
+
+	// Destroy the set not exist
+	if out, err := DestroySet(setTest); err != nil {
+		t.Errorf("failed to destroy set - out:%s", out)
+	}
+	if !reflect.DeepEqual(*commands, []string{
+		"ipset create " + setTest + " hash:ip family inet6 -exist",
+		"ipset list -n " + setTest,
+	}) {
+		t.Errorf("wrong commands - %v", *commands)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	commands := setFakeRunner(t, map[string]string{})
+	SetDryRun(log.NullLogger{})
+	defer func() { dryRun = false }()
+
+	AddEntry(setTest, "192.168.0.10")
+	AddEntry(setTest, "192.168.0.10")
+	DeleteEntry(setTest, "192.168.0.20")
+	if len(*commands) != 0 {
+		t.Errorf("mutating commands are executed - %v", *commands)
+	}
+	if dryRunCommands := GetDryRunCommands(); !reflect.DeepEqual(dryRunCommands, []string{
+		"ipset add " + setTest + " 192.168.0.10 -exist",
+		"ipset del " + setTest + " 192.168.0.20 -exist",
+	}) {
+		t.Errorf("wrong dry-run commands - %v", dryRunCommands)
+	}
+}
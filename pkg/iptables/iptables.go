@@ -3,14 +3,29 @@ package iptables
 
 import (
 	"bytes"
+	"errors"
 	"os/exec"
 	"strings"
 	"sync"
+
+	"github.com/go-logr/logr"
 )
 
 // Type
 type Table string
 
+// Family is an IP family with its iptables commands
+type Family struct {
+	Name             string
+	HostPrefixLength int
+
+	cmd     string
+	saveCmd string
+}
+
+// Runner runs a command and returns its stdout, or its stderr if the command fails
+type Runner func(name string, args ...string) ([]byte, error)
+
 // Const
 const (
 	iptablesCmdIPv4     = "iptables"
@@ -24,59 +39,112 @@ const (
 
 	iptablesErrNoRule   = "No chain/target/match by that name"
 	iptablesErrNoTarget = "Couldn't load target"
+	iptablesErrBadRule  = "does a matching rule exist"
+	iptablesErrNoTable  = "Table does not exist"
 
 	TableNAT    Table = "nat"
 	TableFilter Table = "filter"
+	TableMangle Table = "mangle"
 	TableRaw    Table = "raw"
 )
 
 // Var
 var (
-	lock = &sync.Mutex{}
+	FamilyIPv4 = &Family{Name: "IPv4", HostPrefixLength: 32, cmd: iptablesCmdIPv4, saveCmd: iptablesSaveCmdIPv4}
+	FamilyIPv6 = &Family{Name: "IPv6", HostPrefixLength: 128, cmd: iptablesCmdIPv6, saveCmd: iptablesSaveCmdIPv6}
+
+	lock   = &sync.Mutex{}
+	runner = Runner(runCommand)
+
+	// ErrNoTable is returned when the table isn't loaded in the kernel
+	ErrNoTable = errors.New("table does not exist")
+
+	dryRun           = false
+	dryRunLogger     logr.Logger
+	dryRunCommands   []string
+	dryRunCommandSet = map[string]bool{}
 )
 
+// SetRunner replaces the runner of iptables commands and returns the previous one. It's used for tests.
+func SetRunner(r Runner) Runner {
+	lock.Lock()
+	defer lock.Unlock()
+
+	prev := runner
+	runner = r
+	return prev
+}
+
+// SetDryRun makes all mutating commands be recorded and logged instead of being executed.
+// Read commands are still executed to inspect the real state.
+func SetDryRun(logger logr.Logger) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	dryRun = true
+	dryRunLogger = logger
+}
+
+// GetDryRunCommands returns the recorded mutating commands without duplication in dry-run mode
+func GetDryRunCommands() []string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return append([]string{}, dryRunCommands...)
+}
+
+// IsAvailable returns whether the iptables commands of the family exist in the node
+func (f *Family) IsAvailable() bool {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := runner(f.saveCmd, "--version")
+	return err == nil
+}
+
 // IsExistChain
 func IsExistChainIPv4(table Table, chain string) bool {
-	return isExistChain(iptablesCmdIPv4, table, chain)
+	return FamilyIPv4.IsExistChain(table, chain)
 }
 
 func IsExistChainIPv6(table Table, chain string) bool {
-	return isExistChain(iptablesCmdIPv6, table, chain)
+	return FamilyIPv6.IsExistChain(table, chain)
 }
 
-func isExistChain(iptablesCmd string, table Table, chain string) bool {
+func (f *Family) IsExistChain(table Table, chain string) bool {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
 
 	// Check chain
-	_, err := runIptables(iptablesCmd, table, "-nL", chain)
+	_, err := f.runIptables(table, "-nL", chain)
 	return err == nil
 }
 
 // CreateChain
 func CreateChainIPv4(table Table, chain string) (string, error) {
-	return createChain(iptablesCmdIPv4, table, chain)
+	return FamilyIPv4.CreateChain(table, chain)
 }
 
 func CreateChainIPv6(table Table, chain string) (string, error) {
-	return createChain(iptablesCmdIPv6, table, chain)
+	return FamilyIPv6.CreateChain(table, chain)
 }
 
-func createChain(iptablesCmd string, table Table, chain string) (string, error) {
+func (f *Family) CreateChain(table Table, chain string) (string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
 
 	// Check chain
-	out, err := runIptables(iptablesCmd, table, "-nL", chain)
+	out, err := f.runIptables(table, "-nL", chain)
 	if err == nil {
 		// If already exists, return success
 		return string(out), nil
 	}
 
 	// Create chain
-	out, err = runIptables(iptablesCmd, table, "-N", chain)
+	out, err = f.mutateIptables(table, "-N", chain)
 	if err != nil {
 		return string(out), err
 	}
@@ -86,33 +154,63 @@ func createChain(iptablesCmd string, table Table, chain string) (string, error)
 
 // DeleteChain
 func DeleteChainIPv4(table Table, chain string) (string, error) {
-	return deleteChain(iptablesCmdIPv4, table, chain)
+	return FamilyIPv4.DeleteChain(table, chain)
 }
 
 func DeleteChainIPv6(table Table, chain string) (string, error) {
-	return deleteChain(iptablesCmdIPv6, table, chain)
+	return FamilyIPv6.DeleteChain(table, chain)
 }
 
-func deleteChain(iptablesCmd string, table Table, chain string) (string, error) {
+func (f *Family) DeleteChain(table Table, chain string) (string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
 
 	// Check chain
-	out, err := runIptables(iptablesCmd, table, "-nL", chain)
+	out, err := f.runIptables(table, "-nL", chain)
 	if err != nil {
 		// If chain isn't exist, return success
 		return string(out), nil
 	}
 
 	// Flush chain
-	out, err = runIptables(iptablesCmd, table, "-F", chain)
+	out, err = f.mutateIptables(table, "-F", chain)
 	if err != nil {
 		return string(out), err
 	}
 
 	// Delete chain
-	out, err = runIptables(iptablesCmd, table, "-X", chain)
+	out, err = f.mutateIptables(table, "-X", chain)
+	if err != nil {
+		return string(out), err
+	}
+
+	return string(out), nil
+}
+
+// FlushChain
+func FlushChainIPv4(table Table, chain string) (string, error) {
+	return FamilyIPv4.FlushChain(table, chain)
+}
+
+func FlushChainIPv6(table Table, chain string) (string, error) {
+	return FamilyIPv6.FlushChain(table, chain)
+}
+
+func (f *Family) FlushChain(table Table, chain string) (string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Check chain
+	out, err := f.runIptables(table, "-nL", chain)
+	if err != nil {
+		// If chain isn't exist, return success
+		return string(out), nil
+	}
+
+	// Flush chain
+	out, err = f.mutateIptables(table, "-F", chain)
 	if err != nil {
 		return string(out), err
 	}
@@ -122,14 +220,14 @@ func deleteChain(iptablesCmd string, table Table, chain string) (string, error)
 
 // IsExistRule
 func IsExistRuleIPv4(table Table, chain string, comment string, rule ...string) bool {
-	return isExistRule(iptablesCmdIPv4, table, chain, comment, rule...)
+	return FamilyIPv4.IsExistRule(table, chain, comment, rule...)
 }
 
 func IsExistRuleIPv6(table Table, chain string, comment string, rule ...string) bool {
-	return isExistRule(iptablesCmdIPv6, table, chain, comment, rule...)
+	return FamilyIPv6.IsExistRule(table, chain, comment, rule...)
 }
 
-func isExistRule(iptablesCmd string, table Table, chain string, comment string, rule ...string) bool {
+func (f *Family) IsExistRule(table Table, chain string, comment string, rule ...string) bool {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
@@ -141,43 +239,71 @@ func isExistRule(iptablesCmd string, table Table, chain string, comment string,
 	}
 
 	// Check rule
-	_, err := runIptables(iptablesCmd, table, append(args, rule...)...)
+	_, err := f.runIptables(table, append(args, rule...)...)
 	return err == nil
 }
 
 // GetRules
 func GetRulesIPv4(table Table, chain string) ([]string, error) {
-	return getRules(iptablesSaveCmdIPv4, table, chain)
+	return FamilyIPv4.GetRules(table, chain)
 }
 
 func GetRulesIPv6(table Table, chain string) ([]string, error) {
-	return getRules(iptablesSaveCmdIPv6, table, chain)
+	return FamilyIPv6.GetRules(table, chain)
 }
 
-func getRules(iptablesSaveCmd string, table Table, chain string) ([]string, error) {
+func (f *Family) GetRules(table Table, chain string) ([]string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
 
-	// Set Common args
-	args := []string{"-t", string(table)}
+	// Get rules
+	out, err := f.runIptablesSave(table)
+	if err != nil {
+		return nil, err
+	}
 
-	// Set command
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(iptablesSaveCmd, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Parsing and set result. Match the chain name with the following space
+	// not to get the rules of the chains prefixed with the chain name. Empty chain gets all rules.
+	prefix := "-A " + chain + " "
+	if chain == "" {
+		prefix = "-A "
+	}
+	var result []string
+	for _, rule := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(rule, prefix) {
+			result = append(result, rule)
+		}
+	}
 
-	// Check rule
-	if err := cmd.Run(); err != nil {
+	return result, nil
+}
+
+// GetChains
+func GetChainsIPv4(table Table) ([]string, error) {
+	return FamilyIPv4.GetChains(table)
+}
+
+func GetChainsIPv6(table Table) ([]string, error) {
+	return FamilyIPv6.GetChains(table)
+}
+
+func (f *Family) GetChains(table Table) ([]string, error) {
+	// Lock
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Get rules
+	out, err := f.runIptablesSave(table)
+	if err != nil {
 		return nil, err
 	}
 
-	// Parsing and set result
+	// Parsing and set result. Chains are declared as ":CHAIN POLICY [PACKETS:BYTES]"
 	var result []string
-	for _, rule := range strings.Split(stdout.String(), "\n") {
-		if strings.HasPrefix(rule, "-A "+chain) {
-			result = append(result, rule)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, ":") {
+			result = append(result, strings.Fields(line[1:])[0])
 		}
 	}
 
@@ -186,14 +312,14 @@ func getRules(iptablesSaveCmd string, table Table, chain string) ([]string, erro
 
 // CreateRuleFirst
 func CreateRuleFirstIPv4(table Table, chain string, comment string, rule ...string) (string, error) {
-	return createRuleFirst(iptablesCmdIPv4, table, chain, comment, rule...)
+	return FamilyIPv4.CreateRuleFirst(table, chain, comment, rule...)
 }
 
 func CreateRuleFirstIPv6(table Table, chain string, comment string, rule ...string) (string, error) {
-	return createRuleFirst(iptablesCmdIPv6, table, chain, comment, rule...)
+	return FamilyIPv6.CreateRuleFirst(table, chain, comment, rule...)
 }
 
-func createRuleFirst(iptablesCmd string, table Table, chain string, comment string, rule ...string) (string, error) {
+func (f *Family) CreateRuleFirst(table Table, chain string, comment string, rule ...string) (string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
@@ -205,13 +331,13 @@ func createRuleFirst(iptablesCmd string, table Table, chain string, comment stri
 	}
 
 	// Check rule
-	out, err := runIptables(iptablesCmd, table, append(append(args, "-C", chain), rule...)...)
+	out, err := f.runIptables(table, append(append(args, "-C", chain), rule...)...)
 	if err == nil { // If already exists, return success
 		return string(out), nil
 	}
 
 	// Create rule
-	out, err = runIptables(iptablesCmd, table, append(append(args, "-I", chain, "1"), rule...)...)
+	out, err = f.mutateIptables(table, append(append(args, "-I", chain, "1"), rule...)...)
 	if err != nil {
 		return string(out), err
 	}
@@ -221,14 +347,14 @@ func createRuleFirst(iptablesCmd string, table Table, chain string, comment stri
 
 // CreateRuleLast
 func CreateRuleLastIPv4(table Table, chain string, comment string, rule ...string) (string, error) {
-	return createRuleLast(iptablesCmdIPv4, table, chain, comment, rule...)
+	return FamilyIPv4.CreateRuleLast(table, chain, comment, rule...)
 }
 
 func CreateRuleLastIPv6(table Table, chain string, comment string, rule ...string) (string, error) {
-	return createRuleLast(iptablesCmdIPv6, table, chain, comment, rule...)
+	return FamilyIPv6.CreateRuleLast(table, chain, comment, rule...)
 }
 
-func createRuleLast(iptablesCmd string, table Table, chain string, comment string, rule ...string) (string, error) {
+func (f *Family) CreateRuleLast(table Table, chain string, comment string, rule ...string) (string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
@@ -240,14 +366,14 @@ func createRuleLast(iptablesCmd string, table Table, chain string, comment strin
 	}
 
 	// Check rule
-	out, err := runIptables(iptablesCmd, table, append(append(args, "-C", chain), rule...)...)
+	out, err := f.runIptables(table, append(append(args, "-C", chain), rule...)...)
 	if err == nil {
 		// If already exists, return success
 		return string(out), nil
 	}
 
 	// Create rule
-	out, err = runIptables(iptablesCmd, table, append(append(args, "-A", chain), rule...)...)
+	out, err = f.mutateIptables(table, append(append(args, "-A", chain), rule...)...)
 	if err != nil {
 		return string(out), err
 	}
@@ -257,14 +383,14 @@ func createRuleLast(iptablesCmd string, table Table, chain string, comment strin
 
 // DeleteRule
 func DeleteRuleIPv4(table Table, chain string, comment string, rule ...string) (string, error) {
-	return deleteRule(iptablesCmdIPv4, table, chain, comment, rule...)
+	return FamilyIPv4.DeleteRule(table, chain, comment, rule...)
 }
 
 func DeleteRuleIPv6(table Table, chain string, comment string, rule ...string) (string, error) {
-	return deleteRule(iptablesCmdIPv6, table, chain, comment, rule...)
+	return FamilyIPv6.DeleteRule(table, chain, comment, rule...)
 }
 
-func deleteRule(iptablesCmd string, table Table, chain string, comment string, rule ...string) (string, error) {
+func (f *Family) DeleteRule(table Table, chain string, comment string, rule ...string) (string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
@@ -276,7 +402,7 @@ func deleteRule(iptablesCmd string, table Table, chain string, comment string, r
 	}
 
 	// Check rule
-	out, err := runIptables(iptablesCmd, table, append(append(args, "-C", chain), rule...)...)
+	out, err := f.runIptables(table, append(append(args, "-C", chain), rule...)...)
 	if err != nil {
 		if strings.Contains(string(out), iptablesErrNoRule) {
 			// If rule isn't exist, return success
@@ -284,12 +410,15 @@ func deleteRule(iptablesCmd string, table Table, chain string, comment string, r
 		} else if strings.Contains(string(out), iptablesErrNoTarget) {
 			// If target isn't exit, return success
 			return string(out), nil
+		} else if strings.Contains(string(out), iptablesErrBadRule) {
+			// If rule isn't exist in chain, return success
+			return string(out), nil
 		}
 		return string(out), err
 	}
 
 	// Delete rule
-	out, err = runIptables(iptablesCmd, table, append(append(args, "-D", chain), rule...)...)
+	out, err = f.mutateIptables(table, append(append(args, "-D", chain), rule...)...)
 	if err != nil {
 		return string(out), err
 	}
@@ -299,30 +428,33 @@ func deleteRule(iptablesCmd string, table Table, chain string, comment string, r
 
 // DeleteRuleRaw
 func DeleteRuleRawIPv4(table Table, rule ...string) (string, error) {
-	return deleteRuleRaw(iptablesCmdIPv4, table, rule...)
+	return FamilyIPv4.DeleteRuleRaw(table, rule...)
 }
 
 func DeleteRuleRawIPv6(table Table, rule ...string) (string, error) {
-	return deleteRuleRaw(iptablesCmdIPv6, table, rule...)
+	return FamilyIPv6.DeleteRuleRaw(table, rule...)
 }
 
-func deleteRuleRaw(iptablesCmd string, table Table, rule ...string) (string, error) {
+func (f *Family) DeleteRuleRaw(table Table, rule ...string) (string, error) {
 	// Lock
 	lock.Lock()
 	defer lock.Unlock()
 
 	// Check rule
-	out, err := runIptables(iptablesCmd, table, append([]string{"-C"}, rule...)...)
+	out, err := f.runIptables(table, append([]string{"-C"}, rule...)...)
 	if err != nil {
 		if strings.Contains(string(out), iptablesErrNoRule) {
 			// If rule isn't exist, return success
 			return string(out), nil
+		} else if strings.Contains(string(out), iptablesErrBadRule) {
+			// If rule isn't exist in chain, return success
+			return string(out), nil
 		}
 		return string(out), err
 	}
 
 	// Delete rule
-	out, err = runIptables(iptablesCmd, table, append([]string{"-D"}, rule...)...)
+	out, err = f.mutateIptables(table, append([]string{"-D"}, rule...)...)
 	if err != nil {
 		return string(out), err
 	}
@@ -330,8 +462,23 @@ func deleteRuleRaw(iptablesCmd string, table Table, rule ...string) (string, err
 	return string(out), nil
 }
 
+// Run mutating iptables command within lock. In dry-run mode, record it instead of running
+func (f *Family) mutateIptables(table Table, args ...string) ([]byte, error) {
+	if !dryRun {
+		return f.runIptables(table, args...)
+	}
+
+	command := strings.Join(append([]string{f.cmd, "-t", string(table)}, args...), " ")
+	if !dryRunCommandSet[command] {
+		dryRunCommandSet[command] = true
+		dryRunCommands = append(dryRunCommands, command)
+		dryRunLogger.Info("dry-run iptables command", "command", command)
+	}
+	return nil, nil
+}
+
 // Run iptables within lock
-func runIptables(iptablesCmd string, table Table, args ...string) ([]byte, error) {
+func (f *Family) runIptables(table Table, args ...string) ([]byte, error) {
 	// Build arguments list
 	fullArgs := []string{
 		"-w", iptablesWaitSeconds,
@@ -340,15 +487,30 @@ func runIptables(iptablesCmd string, table Table, args ...string) ([]byte, error
 	}
 	fullArgs = append(fullArgs, args...)
 
+	// Apply rule
+	return runner(f.cmd, fullArgs...)
+}
+
+// Run iptables-save within lock
+func (f *Family) runIptablesSave(table Table) ([]byte, error) {
+	out, err := runner(f.saveCmd, "-t", string(table))
+	if err != nil && strings.Contains(string(out), iptablesErrNoTable) {
+		return out, ErrNoTable
+	}
+	return out, err
+}
+
+// Run command and return stdout. If the command fails, return stderr
+func runCommand(name string, args ...string) ([]byte, error) {
 	// Set command
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(iptablesCmd, fullArgs...)
+	cmd := exec.Command(name, args...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	// Apply rule
+	// Run command
 	if err := cmd.Run(); err != nil {
-		return nil, err
+		return stderr.Bytes(), err
 	}
 	return stdout.Bytes(), nil
 }
@@ -1,6 +1,7 @@
 package iptables
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -18,6 +19,10 @@ func getValue(rule, opt string) string {
 	return ""
 }
 
+func GetRuleChain(rule string) string {
+	return getValue(rule, "-A")
+}
+
 func GetRuleComment(rule string) string {
 	return strings.Trim(getValue(rule, "--comment"), "\"")
 }
@@ -41,3 +46,55 @@ func GetRuleDNATDest(rule string) string {
 func ChangeRuleToDelete(rule string) []string {
 	return strings.Split(strings.ReplaceAll(rule[3:], "\"", ""), " ")
 }
+
+// MakeRule returns the rule in iptables-save format
+func MakeRule(chain string, comment string, rule ...string) string {
+	args := []string{"-A", chain}
+	if comment != "" {
+		args = append(args, "-m", "comment", "--comment", comment)
+	}
+	return strings.Join(append(args, rule...), " ")
+}
+
+// GetRuleKey returns a key to compare rules regardless of the option order and
+// the iptables-save notation like quotes and the host prefix length of addresses
+func GetRuleKey(rule string) string {
+	tokens := strings.Fields(strings.ReplaceAll(rule, "\"", ""))
+
+	// Group each option with its values
+	var opts []string
+	for i := 0; i < len(tokens); i++ {
+		opt := tokens[i]
+		if opt == "!" && i+1 < len(tokens) {
+			i++
+			opt = "! " + tokens[i]
+		} else if !strings.HasPrefix(opt, "-") {
+			continue
+		}
+
+		// Get values of option
+		values := []string{}
+		for i+1 < len(tokens) && !strings.HasPrefix(tokens[i+1], "-") && tokens[i+1] != "!" {
+			i++
+			values = append(values, tokens[i])
+		}
+		if strings.TrimPrefix(opt, "! ") == "-s" || strings.TrimPrefix(opt, "! ") == "-d" {
+			values = normalizeAddrs(values)
+		}
+		opts = append(opts, strings.Join(append([]string{opt}, values...), " "))
+	}
+
+	sort.Strings(opts)
+	return strings.Join(opts, " ")
+}
+
+func normalizeAddrs(values []string) []string {
+	if len(values) == 1 && !strings.Contains(values[0], "/") {
+		if strings.Contains(values[0], ":") {
+			values[0] += "/128"
+		} else {
+			values[0] += "/32"
+		}
+	}
+	return values
+}
@@ -20,6 +20,13 @@ func TestGetValue(t *testing.T) {
 	}
 }
 
+func TestGetRuleChain(t *testing.T) {
+	value := GetRuleChain(ruleTest)
+	if value != "testChain" {
+		t.Errorf("get rule chain")
+	}
+}
+
 func TestGetRuleComment(t *testing.T) {
 	value := GetRuleComment(ruleTest)
 	if value != "testComment" {
@@ -47,3 +54,24 @@ func TestChangeRuleToDelete(t *testing.T) {
 		t.Errorf("change rule to delete. expected:%+v / actual:%+v", ruleDeleteTest, value)
 	}
 }
+
+func TestMakeRule(t *testing.T) {
+	value := MakeRule("testChain", "testComment", "-s", "192.168.0.1", "-j", "DROP")
+	expected := "-A testChain -m comment --comment testComment -s 192.168.0.1 -j DROP"
+	if value != expected {
+		t.Errorf("make rule. expected:%s / actual:%s", expected, value)
+	}
+}
+
+func TestGetRuleKey(t *testing.T) {
+	saved := "-A testChain -s 192.168.0.1/32 -d fdaa::1/128 -m comment --comment \"testComment\" -m addrtype --src-type LOCAL -j DROP"
+	made := MakeRule("testChain", "testComment", "-m", "addrtype", "--src-type", "LOCAL", "-d", "fdaa::1", "-s", "192.168.0.1", "-j", "DROP")
+	if GetRuleKey(saved) != GetRuleKey(made) {
+		t.Errorf("get rule key. saved:%s / made:%s", GetRuleKey(saved), GetRuleKey(made))
+	}
+
+	diff := MakeRule("testChain", "testComment", "-s", "192.168.0.2", "-j", "DROP")
+	if GetRuleKey(saved) == GetRuleKey(diff) {
+		t.Errorf("get rule key. same key for different rules")
+	}
+}
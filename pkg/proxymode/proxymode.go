@@ -0,0 +1,132 @@
+package proxymode
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kakao/network-node-manager/pkg/iptables"
+)
+
+// Mode is the proxy mode of kube-proxy
+type Mode string
+
+// Source is where the proxy mode is detected from
+type Source string
+
+// Const
+const (
+	ModeIPTables Mode = "iptables"
+	ModeIPVS     Mode = "ipvs"
+	ModeUnknown  Mode = "unknown"
+
+	SourceConfig    Source = "config"
+	SourceConfigMap Source = "configmap"
+	SourceInterface Source = "interface"
+	SourceIPTables  Source = "iptables"
+	SourceNone      Source = "none"
+
+	configMapNamespace = "kube-system"
+	configMapName      = "kube-proxy"
+	configMapKey       = "config.conf"
+
+	interfaceIPVS = "kube-ipvs0"
+	chainServices = "KUBE-SERVICES"
+)
+
+// Vars
+var (
+	interfaceExists = func(name string) bool {
+		_, err := net.InterfaceByName(name)
+		return err == nil
+	}
+	servicesChainExists = func() bool {
+		return iptables.FamilyIPv4.IsExistChain(iptables.TableNAT, chainServices) ||
+			iptables.FamilyIPv6.IsExistChain(iptables.TableNAT, chainServices)
+	}
+)
+
+// Parse returns the mode of the config value. An empty value is the unknown mode.
+func Parse(value string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(value))) {
+	case ModeIPTables:
+		return ModeIPTables, nil
+	case ModeIPVS:
+		return ModeIPVS, nil
+	case "":
+		return ModeUnknown, nil
+	}
+	return ModeUnknown, fmt.Errorf("wrong kube-proxy mode : %s", value)
+}
+
+// Get returns the mode overridden by the config, or the detected mode if the override is unknown
+func Get(ctx context.Context, reader client.Reader, override Mode) (Mode, Source, error) {
+	if override != ModeUnknown {
+		return override, SourceConfig, nil
+	}
+	return Detect(ctx, reader)
+}
+
+// Detect returns the active kube-proxy mode of the node. It checks the mode in the kube-proxy ConfigMap,
+// the kube-ipvs0 interface of IPVS mode and the KUBE-SERVICES chain of iptables mode in order.
+// The reader can be nil to skip the ConfigMap.
+func Detect(ctx context.Context, reader client.Reader) (Mode, Source, error) {
+	// kube-proxy ConfigMap of kubeadm
+	if reader != nil {
+		mode, ok, err := getModeFromConfigMap(ctx, reader)
+		if err != nil {
+			return ModeUnknown, SourceNone, err
+		}
+		if ok {
+			return mode, SourceConfigMap, nil
+		}
+	}
+
+	// Node
+	if interfaceExists(interfaceIPVS) {
+		return ModeIPVS, SourceInterface, nil
+	}
+	if servicesChainExists() {
+		return ModeIPTables, SourceIPTables, nil
+	}
+	return ModeUnknown, SourceNone, nil
+}
+
+// getModeFromConfigMap returns the mode in the kube-proxy ConfigMap. If there is no ConfigMap, no permission
+// to get it, a wrong config or a mode not handled, it returns false. The empty mode is iptables mode, the default of kube-proxy on linux.
+func getModeFromConfigMap(ctx context.Context, reader client.Reader) (Mode, bool, error) {
+	cm := &corev1.ConfigMap{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: configMapNamespace, Name: configMapName}, cm); err != nil {
+		if apierror.IsNotFound(err) || apierror.IsForbidden(err) {
+			return ModeUnknown, false, nil
+		}
+		return ModeUnknown, false, err
+	}
+	data, ok := cm.Data[configMapKey]
+	if !ok {
+		return ModeUnknown, false, nil
+	}
+
+	config := struct {
+		Mode string `json:"mode"`
+	}{}
+	if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(data), 4096).Decode(&config); err != nil {
+		return ModeUnknown, false, nil
+	}
+	mode, err := Parse(config.Mode)
+	if err != nil {
+		// Modes not handled like userspace
+		return ModeUnknown, false, nil
+	}
+	if mode == ModeUnknown {
+		mode = ModeIPTables
+	}
+	return mode, true, nil
+}
@@ -0,0 +1,76 @@
+package proxymode
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func setFakeNode(t *testing.T, ipvsInterface, servicesChain bool) {
+	prevInterface, prevChain := interfaceExists, servicesChainExists
+	interfaceExists = func(name string) bool { return ipvsInterface && name == interfaceIPVS }
+	servicesChainExists = func() bool { return servicesChain }
+	t.Cleanup(func() { interfaceExists, servicesChainExists = prevInterface, prevChain })
+}
+
+func newConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: configMapNamespace, Name: configMapName},
+		Data:       data,
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name          string
+		configMap     *corev1.ConfigMap
+		ipvsInterface bool
+		servicesChain bool
+		mode          Mode
+		source        Source
+	}{
+		{"configmap ipvs", newConfigMap(map[string]string{configMapKey: "kind: KubeProxyConfiguration\nmode: ipvs\n"}), false, true, ModeIPVS, SourceConfigMap},
+		{"configmap empty mode", newConfigMap(map[string]string{configMapKey: "kind: KubeProxyConfiguration\nmode: \"\"\n"}), true, true, ModeIPTables, SourceConfigMap},
+		{"configmap unknown mode", newConfigMap(map[string]string{configMapKey: "mode: userspace\n"}), true, true, ModeIPVS, SourceInterface},
+		{"configmap without config", newConfigMap(map[string]string{}), false, true, ModeIPTables, SourceIPTables},
+		{"interface", nil, true, true, ModeIPVS, SourceInterface},
+		{"iptables", nil, false, true, ModeIPTables, SourceIPTables},
+		{"none", nil, false, false, ModeUnknown, SourceNone},
+	}
+	for _, test := range tests {
+		setFakeNode(t, test.ipvsInterface, test.servicesChain)
+		c := fake.NewClientBuilder().Build()
+		if test.configMap != nil {
+			c = fake.NewClientBuilder().WithObjects(test.configMap).Build()
+		}
+
+		mode, source, err := Detect(context.Background(), c)
+		if err != nil || mode != test.mode || source != test.source {
+			t.Errorf("wrong result of %s - %s %s %v", test.name, mode, source, err)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	setFakeNode(t, true, true)
+	if mode, source, err := Get(context.Background(), nil, ModeIPTables); err != nil || mode != ModeIPTables || source != SourceConfig {
+		t.Errorf("wrong overridden mode - %s %s %v", mode, source, err)
+	}
+	if mode, source, err := Get(context.Background(), nil, ModeUnknown); err != nil || mode != ModeIPVS || source != SourceInterface {
+		t.Errorf("wrong detected mode - %s %s %v", mode, source, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for value, expected := range map[string]Mode{"iptables": ModeIPTables, " IPVS ": ModeIPVS, "": ModeUnknown} {
+		if mode, err := Parse(value); err != nil || mode != expected {
+			t.Errorf("wrong mode of %q - %s %v", value, mode, err)
+		}
+	}
+	if _, err := Parse("userspace"); err == nil {
+		t.Errorf("no error for wrong mode")
+	}
+}
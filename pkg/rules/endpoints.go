@@ -0,0 +1,142 @@
+package rules
+
+import (
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+)
+
+// LocalEndpoint is a ready endpoint of a service port on the node
+type LocalEndpoint struct {
+	Addr     string
+	PortName string
+	Protocol corev1.Protocol
+	Port     int32
+}
+
+// Vars
+var (
+	// Local endpoints of each service
+	localEndpoints     = map[string][]LocalEndpoint{}
+	localEndpointsLock = &sync.Mutex{}
+
+	// Services without ready endpoints. Services not set are regarded as having endpoints.
+	noEndpoints     = map[string]bool{}
+	noEndpointsLock = &sync.Mutex{}
+)
+
+// SetLocalEndpoints sets the local endpoints of the service. They're used by the rules reconciled after it.
+func SetLocalEndpoints(nsName string, endpoints []LocalEndpoint) {
+	localEndpointsLock.Lock()
+	defer localEndpointsLock.Unlock()
+
+	if len(endpoints) == 0 {
+		delete(localEndpoints, nsName)
+	} else {
+		localEndpoints[nsName] = endpoints
+	}
+}
+
+// SetNoEndpoints sets whether the service has no ready endpoints. It's used by the rules reconciled after it.
+func SetNoEndpoints(nsName string, value bool) {
+	noEndpointsLock.Lock()
+	defer noEndpointsLock.Unlock()
+
+	if value {
+		noEndpoints[nsName] = true
+	} else {
+		delete(noEndpoints, nsName)
+	}
+}
+
+// HasReadyEndpoints returns whether the endpoint slices of a service have ready endpoints on any node
+func HasReadyEndpoints(slices []discoveryv1beta1.EndpointSlice) bool {
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			// Nil ready condition means ready
+			if (endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready) && len(endpoint.Addresses) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetLocalEndpoints returns the ready endpoints on the node in the endpoint slices of a service in order of addresses.
+// Endpoints are on the node if their node name or hostname topology is the node name.
+func GetLocalEndpoints(slices []discoveryv1beta1.EndpointSlice, nodeName string) []LocalEndpoint {
+	result := []LocalEndpoint{}
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1beta1.AddressTypeIPv4 && slice.AddressType != discoveryv1beta1.AddressTypeIPv6 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// Nil ready condition means ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if (endpoint.NodeName == nil || *endpoint.NodeName != nodeName) && endpoint.Topology[corev1.LabelHostname] != nodeName {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				for _, port := range slice.Ports {
+					// Nil port means all ports, which isn't used for services with selectors
+					if port.Port == nil {
+						continue
+					}
+					endpoint := LocalEndpoint{Addr: addr, Protocol: corev1.ProtocolTCP, Port: *port.Port}
+					if port.Name != nil {
+						endpoint.PortName = *port.Name
+					}
+					if port.Protocol != nil {
+						endpoint.Protocol = *port.Protocol
+					}
+					result = append(result, endpoint)
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Addr != result[j].Addr {
+			return result[i].Addr < result[j].Addr
+		}
+		if result[i].PortName != result[j].PortName {
+			return result[i].PortName < result[j].PortName
+		}
+		return result[i].Protocol < result[j].Protocol
+	})
+
+	// Remove the same endpoints in multiple slices while they're updated
+	deduped := []LocalEndpoint{}
+	for i, endpoint := range result {
+		if i == 0 || endpoint != result[i-1] {
+			deduped = append(deduped, endpoint)
+		}
+	}
+	return deduped
+}
+
+// getLocalEndpoints returns the local endpoints of the service port in the family
+func getLocalEndpoints(family *Family, nsName string, port corev1.ServicePort) []LocalEndpoint {
+	localEndpointsLock.Lock()
+	defer localEndpointsLock.Unlock()
+
+	result := []LocalEndpoint{}
+	for _, endpoint := range localEndpoints[nsName] {
+		if family.IsAddr(endpoint.Addr) && endpoint.PortName == port.Name && endpoint.Protocol == port.Protocol {
+			result = append(result, endpoint)
+		}
+	}
+	return result
+}
+
+// HasNoEndpoints returns whether the service is set to have no ready endpoints
+func HasNoEndpoints(nsName string) bool {
+	noEndpointsLock.Lock()
+	defer noEndpointsLock.Unlock()
+
+	return noEndpoints[nsName]
+}
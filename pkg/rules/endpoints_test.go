@@ -0,0 +1,61 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+)
+
+func TestGetLocalEndpoints(t *testing.T) {
+	node, other := "node-a", "node-b"
+	ready, notReady := true, false
+	name, protocol, port := "http", corev1.ProtocolTCP, int32(8080)
+	slice := discoveryv1beta1.EndpointSlice{
+		AddressType: discoveryv1beta1.AddressTypeIPv4,
+		Endpoints: []discoveryv1beta1.Endpoint{
+			{Addresses: []string{"10.244.0.11"}, NodeName: &node, Conditions: discoveryv1beta1.EndpointConditions{Ready: &ready}},
+			{Addresses: []string{"10.244.0.10"}, Topology: map[string]string{corev1.LabelHostname: node}},
+			{Addresses: []string{"10.244.0.12"}, NodeName: &node, Conditions: discoveryv1beta1.EndpointConditions{Ready: &notReady}},
+			{Addresses: []string{"10.244.1.10"}, NodeName: &other},
+		},
+		Ports: []discoveryv1beta1.EndpointPort{{Name: &name, Protocol: &protocol, Port: &port}},
+	}
+	fqdn := slice
+	fqdn.AddressType = discoveryv1beta1.AddressTypeFQDN
+
+	// The same endpoints in multiple slices are returned once
+	endpoints := GetLocalEndpoints([]discoveryv1beta1.EndpointSlice{slice, slice, fqdn}, node)
+	if !reflect.DeepEqual(endpoints, []LocalEndpoint{
+		{Addr: "10.244.0.10", PortName: "http", Protocol: corev1.ProtocolTCP, Port: 8080},
+		{Addr: "10.244.0.11", PortName: "http", Protocol: corev1.ProtocolTCP, Port: 8080},
+	}) {
+		t.Errorf("wrong local endpoints - %+v", endpoints)
+	}
+}
+
+func TestHasReadyEndpoints(t *testing.T) {
+	ready, notReady := true, false
+	slice := discoveryv1beta1.EndpointSlice{
+		AddressType: discoveryv1beta1.AddressTypeIPv4,
+		Endpoints: []discoveryv1beta1.Endpoint{
+			{Addresses: []string{"10.244.0.10"}, Conditions: discoveryv1beta1.EndpointConditions{Ready: &notReady}},
+		},
+	}
+	if HasReadyEndpoints(nil) || HasReadyEndpoints([]discoveryv1beta1.EndpointSlice{slice}) {
+		t.Errorf("wrong result for no ready endpoints")
+	}
+	slice.Endpoints = append(slice.Endpoints, discoveryv1beta1.Endpoint{Addresses: []string{"10.244.1.10"}, Conditions: discoveryv1beta1.EndpointConditions{Ready: &ready}})
+	if !HasReadyEndpoints([]discoveryv1beta1.EndpointSlice{slice}) {
+		t.Errorf("wrong result for ready endpoints")
+	}
+}
+
+func TestGetProbability(t *testing.T) {
+	for n, expected := range map[int]string{2: "0.50000000000", 3: "0.33333333349", 4: "0.25000000000"} {
+		if probability := getProbability(n); probability != expected {
+			t.Errorf("wrong probability for %d - %s", n, probability)
+		}
+	}
+}
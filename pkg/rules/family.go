@@ -0,0 +1,46 @@
+package rules
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kakao/network-node-manager/pkg/ip"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+)
+
+// Family is an IP family that rules are set for. Rules are written once
+// and executed for each family whose pod CIDR is set.
+type Family struct {
+	*iptables.Family
+
+	IPFamily corev1.IPFamily
+	PodCIDR  string
+}
+
+// Vars
+var (
+	familyIPv4 = &Family{Family: iptables.FamilyIPv4, IPFamily: corev1.IPv4Protocol}
+	familyIPv6 = &Family{Family: iptables.FamilyIPv6, IPFamily: corev1.IPv6Protocol}
+)
+
+// IsAddr returns whether the address belongs to the family
+func (f *Family) IsAddr(addr string) bool {
+	if f.IPFamily == corev1.IPv6Protocol {
+		return ip.IsIPv6Addr(addr)
+	}
+	return ip.IsIPv4Addr(addr)
+}
+
+// IsCIDR returns whether the CIDR belongs to the family
+func (f *Family) IsCIDR(cidr string) bool {
+	if f.IPFamily == corev1.IPv6Protocol {
+		return ip.IsIPv6CIDR(cidr)
+	}
+	return ip.IsIPv4CIDR(cidr)
+}
+
+// HostCIDR returns the address with the host prefix length of the family like iptables-save prints
+func (f *Family) HostCIDR(addr string) string {
+	return addr + "/" + strconv.Itoa(f.HostPrefixLength)
+}
@@ -0,0 +1,172 @@
+package rules
+
+import (
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/utils"
+)
+
+// Vars
+var (
+	// IPs of the pods in the allowed namespaces set by the pod controller
+	metadataAllowedPods = map[types.NamespacedName][]string{}
+	metadataLock        = &sync.Mutex{}
+)
+
+// ruleBlockMetadata blocks packets from pods to cloud metadata endpoints except the pods in the allowed namespaces
+type ruleBlockMetadata struct{}
+
+func init() {
+	Register(&ruleBlockMetadata{})
+}
+
+func (r *ruleBlockMetadata) Name() string {
+	return FeatureBlockMetadata
+}
+
+func (r *ruleBlockMetadata) ConfigKey() string {
+	return configs.EnvRuleBlockMetadataEnable
+}
+
+func (r *ruleBlockMetadata) DefaultEnabled(mode proxymode.Mode) bool {
+	return false
+}
+
+func (r *ruleBlockMetadata) Chains() []string {
+	return []string{ChainFilterBlockMetadataForward, ChainFilterBlockMetadataOutput}
+}
+
+func (r *ruleBlockMetadata) Init(logger logr.Logger, family *Family) error {
+	// Lock
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	return initBlockMetadata(logger, family)
+}
+
+func (r *ruleBlockMetadata) Cleanup(logger logr.Logger, family *Family) error {
+	if err := cleanupChain(logger, family, iptables.TableFilter, ChainBaseForward, ChainFilterBlockMetadataForward); err != nil {
+		return err
+	}
+	return cleanupChain(logger, family, iptables.TableFilter, ChainBaseOutput, ChainFilterBlockMetadataOutput)
+}
+
+func (r *ruleBlockMetadata) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	return nil
+}
+
+func (r *ruleBlockMetadata) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	return nil
+}
+
+// Desired returns the rules with the allowed pod IPs known to the process. Init reports the wrong configs.
+func (r *ruleBlockMetadata) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	rules, _ := getRulesBlockMetadata(family)
+	return append(getChainRuleSpecs(iptables.TableFilter, ChainBaseForward, ChainFilterBlockMetadataForward, rules),
+		getChainRuleSpecs(iptables.TableFilter, ChainBaseOutput, ChainFilterBlockMetadataOutput, rules)...)
+}
+
+// SetMetadataAllowedPod sets the IPs of the pod in the allowed namespaces and updates the rules of all families.
+// If ips is empty, the pod is removed.
+func SetMetadataAllowedPod(logger logr.Logger, pod types.NamespacedName, ips []string) error {
+	// Lock
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	// Update allowed pods
+	if utils.IsSameStrings(metadataAllowedPods[pod], ips) {
+		return nil
+	}
+	if len(ips) == 0 {
+		delete(metadataAllowedPods, pod)
+	} else {
+		metadataAllowedPods[pod] = ips
+	}
+
+	// Set rules. Before the pod CIDRs are initialized, there is no family and rules are set by Init
+	for _, family := range GetFamilies() {
+		if err := initBlockMetadata(logger, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMetadataAllowedPods replaces the IPs of the pods in the allowed namespaces without updating rules.
+// It's used to compute the desired rules out of the pod controller.
+func SetMetadataAllowedPods(pods map[types.NamespacedName][]string) {
+	// Lock
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	metadataAllowedPods = map[types.NamespacedName][]string{}
+	for pod, ips := range pods {
+		if len(ips) != 0 {
+			metadataAllowedPods[pod] = ips
+		}
+	}
+}
+
+func initBlockMetadata(logger logr.Logger, family *Family) error {
+	// Set the same rules in FORWARD and OUTPUT chains
+	rules, err := getRulesBlockMetadata(family)
+	if err != nil {
+		logger.Error(err, "failed to get block metadata rules")
+		return err
+	}
+	if err := setChainRules(logger, family, iptables.TableFilter, ChainBaseForward, ChainFilterBlockMetadataForward, rules); err != nil {
+		return err
+	}
+	return setChainRules(logger, family, iptables.TableFilter, ChainBaseOutput, ChainFilterBlockMetadataOutput, rules)
+}
+
+// getRulesBlockMetadata returns RETURN rules for the allowed pod IPs and DROP rules for the metadata endpoints
+// from the pod CIDR. It should be called within lock.
+func getRulesBlockMetadata(family *Family) ([][]string, error) {
+	dests, err := configs.GetConfigRuleBlockMetadataDests()
+	if err != nil {
+		return nil, err
+	}
+	dests = filterCIDRs(family, dests)
+	if len(dests) == 0 {
+		return [][]string{}, nil
+	}
+
+	// Get the allowed pod IPs of the family in order
+	ipSet := map[string]bool{}
+	for _, ips := range metadataAllowedPods {
+		for _, ip := range ips {
+			if family.IsAddr(ip) {
+				ipSet[ip] = true
+			}
+		}
+	}
+	allowedIPs := []string{}
+	for ip := range ipSet {
+		allowedIPs = append(allowedIPs, ip)
+	}
+	sort.Strings(allowedIPs)
+
+	rules := [][]string{}
+	for _, ip := range allowedIPs {
+		for _, dest := range dests {
+			rules = append(rules, []string{"-s", family.HostCIDR(ip), "-d", dest, "-j", "RETURN"})
+		}
+	}
+	for _, dest := range dests {
+		rules = append(rules, []string{"-s", family.PodCIDR, "-d", dest, "-j", "DROP"})
+	}
+	return rules, nil
+}
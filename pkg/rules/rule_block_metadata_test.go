@@ -0,0 +1,75 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestSetMetadataAllowedPod(t *testing.T) {
+	pod := types.NamespacedName{Namespace: "kube-system", Name: "metadata-proxy"}
+	defer func() { metadataAllowedPods = map[types.NamespacedName][]string{} }()
+
+	// Before the pod CIDRs are initialized, only the allowed pods are updated
+	Init("", "")
+	fake := setFakeIptables(t)
+	if err := SetMetadataAllowedPod(log.NullLogger{}, pod, []string{"10.244.0.5", "fd00:10:244::5"}); err != nil {
+		t.Fatalf("failed to set allowed pod : %v", err)
+	}
+	if len(fake.commands) != 0 {
+		t.Errorf("rules are set before init - %v", fake.commands)
+	}
+
+	// Set rules of both families
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	for _, family := range GetFamilies() {
+		if err := (&ruleBlockMetadata{}).Init(log.NullLogger{}, family); err != nil {
+			t.Fatalf("failed to init : %v", err)
+		}
+	}
+	expected := map[string][]string{
+		"iptables filter " + ChainFilterBlockMetadataForward: {
+			"-A NMANAGER_BLOCK_METADATA_FORWARD -s 10.244.0.5/32 -d 169.254.169.254/32 -j RETURN",
+			"-A NMANAGER_BLOCK_METADATA_FORWARD -s 10.244.0.0/16 -d 169.254.169.254/32 -j DROP",
+		},
+		"ip6tables filter " + ChainFilterBlockMetadataOutput: {
+			"-A NMANAGER_BLOCK_METADATA_OUTPUT -s fd00:10:244::5/128 -d fd00:ec2::254/128 -j RETURN",
+			"-A NMANAGER_BLOCK_METADATA_OUTPUT -s fd00:10:244::/64 -d fd00:ec2::254/128 -j DROP",
+		},
+	}
+	for key, rules := range expected {
+		if strings.Join(fake.rules[key], "\n") != strings.Join(rules, "\n") {
+			t.Errorf("wrong rules of %s - %v", key, fake.rules[key])
+		}
+	}
+
+	// Remove the pod
+	if err := SetMetadataAllowedPod(log.NullLogger{}, pod, nil); err != nil {
+		t.Fatalf("failed to remove allowed pod : %v", err)
+	}
+	if rules := fake.rules["iptables filter "+ChainFilterBlockMetadataForward]; len(rules) != 1 {
+		t.Errorf("wrong rules after removing pod - %v", rules)
+	}
+}
+
+func TestSetMetadataAllowedPods(t *testing.T) {
+	defer func() { metadataAllowedPods = map[types.NamespacedName][]string{} }()
+	Init("10.244.0.0/16", "")
+	SetMetadataAllowedPods(map[types.NamespacedName][]string{
+		{Namespace: "kube-system", Name: "metadata-proxy"}: {"10.244.0.5"},
+		{Namespace: "kube-system", Name: "finished"}:       nil,
+	})
+
+	// Desired rules include the RETURN rules of the allowed pods
+	returns := 0
+	for _, spec := range (&ruleBlockMetadata{}).Desired(familyIPv4, nil) {
+		if containsString(spec.Rule, "RETURN") {
+			returns++
+		}
+	}
+	if returns != 2 {
+		t.Errorf("wrong number of RETURN rules - %d", returns)
+	}
+}
@@ -0,0 +1,201 @@
+package rules
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+)
+
+// Constants
+const (
+	dropInvalidLogLimitBurst = "5"
+)
+
+// Vars
+var (
+	ruleMatchInvalid = []string{"-m", "conntrack", "--ctstate", "INVALID"}
+
+	// ICMP errors needed for PMTU discovery and error reporting of connections
+	icmpErrorTypesIPv4 = []string{"3", "11", "12"}
+	icmpErrorTypesIPv6 = []string{"1", "2", "3", "4"}
+)
+
+// dropInvalidConfig is the scope and the log of drop invalid packet rules
+type dropInvalidConfig struct {
+	interfaces        []string
+	srcCIDRs          []string
+	dstCIDRs          []string
+	protocols         []string
+	excludeICMPErrors bool
+	log               string
+	logLimit          string
+	nflogGroup        int
+}
+
+// ruleDropInvalid drops invalid packets in a base chain of filter table
+type ruleDropInvalid struct {
+	feature        string
+	configKey      string
+	defaultEnabled bool
+	baseChain      string
+	chain          string
+}
+
+func init() {
+	Register(&ruleDropInvalid{
+		feature:        FeatureDropInvalidInput,
+		configKey:      configs.EnvRuleDropInvalidInputEnable,
+		defaultEnabled: true,
+		baseChain:      ChainBaseInput,
+		chain:          ChainFilterDropInvalidInput,
+	})
+	Register(&ruleDropInvalid{
+		feature:        FeatureDropInvalidForward,
+		configKey:      configs.EnvRuleDropInvalidForwardEnable,
+		defaultEnabled: false,
+		baseChain:      ChainBaseForward,
+		chain:          ChainFilterDropInvalidForward,
+	})
+}
+
+func (r *ruleDropInvalid) Name() string {
+	return r.feature
+}
+
+func (r *ruleDropInvalid) ConfigKey() string {
+	return r.configKey
+}
+
+func (r *ruleDropInvalid) DefaultEnabled(mode proxymode.Mode) bool {
+	return r.defaultEnabled
+}
+
+func (r *ruleDropInvalid) Chains() []string {
+	return []string{r.chain}
+}
+
+func (r *ruleDropInvalid) Init(logger logr.Logger, family *Family) error {
+	// Set drop rules
+	rules, err := r.getRules(family)
+	if err != nil {
+		logger.Error(err, "failed to get drop invalid packet rules", "feature", r.feature)
+		return err
+	}
+	return setChainRules(logger, family, iptables.TableFilter, r.baseChain, r.chain, rules)
+}
+
+func (r *ruleDropInvalid) Cleanup(logger logr.Logger, family *Family) error {
+	return cleanupChain(logger, family, iptables.TableFilter, r.baseChain, r.chain)
+}
+
+func (r *ruleDropInvalid) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	return nil
+}
+
+func (r *ruleDropInvalid) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	return nil
+}
+
+// Desired returns the rules without the drop rules if the configs are wrong. Init reports the wrong configs.
+func (r *ruleDropInvalid) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	rules, _ := r.getRules(family)
+	return getChainRuleSpecs(iptables.TableFilter, r.baseChain, r.chain, rules)
+}
+
+// getRules returns the rules in the chain of the rule in order by the configs
+func (r *ruleDropInvalid) getRules(family *Family) ([][]string, error) {
+	config, err := getDropInvalidConfig()
+	if err != nil {
+		return nil, err
+	}
+	rules := [][]string{}
+
+	// Return ICMP errors before dropping
+	if config.excludeICMPErrors {
+		if family.IPFamily == corev1.IPv6Protocol {
+			for _, icmpType := range icmpErrorTypesIPv6 {
+				rules = append(rules, []string{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", icmpType, "-j", "RETURN"})
+			}
+		} else {
+			for _, icmpType := range icmpErrorTypesIPv4 {
+				rules = append(rules, []string{"-p", "icmp", "-m", "icmp", "--icmp-type", icmpType, "-j", "RETURN"})
+			}
+		}
+	}
+
+	// Get CIDRs of the family. If CIDRs are set only for the other family, don't drop packets of the family
+	srcCIDRs, dstCIDRs := filterCIDRs(family, config.srcCIDRs), filterCIDRs(family, config.dstCIDRs)
+	if (len(config.srcCIDRs) != 0 && len(srcCIDRs) == 0) || (len(config.dstCIDRs) != 0 && len(dstCIDRs) == 0) {
+		return rules, nil
+	}
+
+	// Set log and drop rules for each scope
+	for _, iface := range orEmpty(config.interfaces) {
+		for _, protocol := range orEmpty(config.protocols) {
+			for _, src := range orEmpty(srcCIDRs) {
+				for _, dst := range orEmpty(dstCIDRs) {
+					match := []string{}
+					if iface != "" {
+						match = append(match, "-i", iface)
+					}
+					if protocol != "" {
+						match = append(match, "-p", protocol)
+					}
+					if src != "" {
+						match = append(match, "-s", src)
+					}
+					if dst != "" {
+						match = append(match, "-d", dst)
+					}
+					match = append(match, ruleMatchInvalid...)
+
+					limit := []string{"-m", "limit", "--limit", config.logLimit, "--limit-burst", dropInvalidLogLimitBurst}
+					switch config.log {
+					case configs.LogLOG:
+						rules = append(rules, concatArgs(match, limit, []string{"-j", "LOG", "--log-prefix", r.feature + ":"}))
+					case configs.LogNFLOG:
+						rules = append(rules, concatArgs(match, limit, []string{"-j", "NFLOG", "--nflog-prefix", r.feature + ":", "--nflog-group", strconv.Itoa(config.nflogGroup)}))
+					}
+					rules = append(rules, concatArgs(match, []string{"-j", "DROP"}))
+				}
+			}
+		}
+	}
+	return rules, nil
+}
+
+func getDropInvalidConfig() (*dropInvalidConfig, error) {
+	var err error
+	config := &dropInvalidConfig{}
+	if config.interfaces, err = configs.GetConfigRuleDropInvalidInterfaces(); err != nil {
+		return nil, err
+	}
+	if config.srcCIDRs, err = configs.GetConfigRuleDropInvalidSrcCIDRs(); err != nil {
+		return nil, err
+	}
+	if config.dstCIDRs, err = configs.GetConfigRuleDropInvalidDstCIDRs(); err != nil {
+		return nil, err
+	}
+	if config.protocols, err = configs.GetConfigRuleDropInvalidProtocols(); err != nil {
+		return nil, err
+	}
+	if config.excludeICMPErrors, err = configs.GetConfigRuleDropInvalidExcludeICMPErrors(); err != nil {
+		return nil, err
+	}
+	if config.log, err = configs.GetConfigRuleDropInvalidLog(); err != nil {
+		return nil, err
+	}
+	if config.logLimit, err = configs.GetConfigRuleDropInvalidLogLimit(); err != nil {
+		return nil, err
+	}
+	if config.nflogGroup, err = configs.GetConfigRuleDropInvalidNFLOGGroup(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,78 @@
+package rules
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+)
+
+func TestDropInvalidGetRules(t *testing.T) {
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	r := &ruleDropInvalid{feature: FeatureDropInvalidInput, baseChain: ChainBaseInput, chain: ChainFilterDropInvalidInput}
+	defer func() {
+		for _, key := range []string{configs.EnvRuleDropInvalidInterfaces, configs.EnvRuleDropInvalidSrcCIDRs,
+			configs.EnvRuleDropInvalidProtocols, configs.EnvRuleDropInvalidExcludeICMPErrors, configs.EnvRuleDropInvalidLog} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	// Default
+	rules, err := r.getRules(familyIPv4)
+	if err != nil || !reflect.DeepEqual(rules, [][]string{{"-m", "conntrack", "--ctstate", "INVALID", "-j", "DROP"}}) {
+		t.Errorf("wrong default rules - %v %v", rules, err)
+	}
+
+	// Scoped and logged
+	os.Setenv(configs.EnvRuleDropInvalidInterfaces, "eth0, eth1")
+	os.Setenv(configs.EnvRuleDropInvalidSrcCIDRs, "10.0.0.1/8")
+	os.Setenv(configs.EnvRuleDropInvalidProtocols, "TCP")
+	os.Setenv(configs.EnvRuleDropInvalidExcludeICMPErrors, "true")
+	os.Setenv(configs.EnvRuleDropInvalidLog, "log")
+	rules, err = r.getRules(familyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get rules : %v", err)
+	}
+	expected := []string{
+		"-p icmp -m icmp --icmp-type 3 -j RETURN",
+		"-p icmp -m icmp --icmp-type 11 -j RETURN",
+		"-p icmp -m icmp --icmp-type 12 -j RETURN",
+		"-i eth0 -p tcp -s 10.0.0.0/8 -m conntrack --ctstate INVALID -m limit --limit 10/min --limit-burst 5 -j LOG --log-prefix drop-invalid-input:",
+		"-i eth0 -p tcp -s 10.0.0.0/8 -m conntrack --ctstate INVALID -j DROP",
+		"-i eth1 -p tcp -s 10.0.0.0/8 -m conntrack --ctstate INVALID -m limit --limit 10/min --limit-burst 5 -j LOG --log-prefix drop-invalid-input:",
+		"-i eth1 -p tcp -s 10.0.0.0/8 -m conntrack --ctstate INVALID -j DROP",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("wrong number of rules. expected:%d / actual:%d", len(expected), len(rules))
+	}
+	for i := range rules {
+		if strings.Join(rules[i], " ") != expected[i] {
+			t.Errorf("wrong rule. expected:%s / actual:%s", expected[i], strings.Join(rules[i], " "))
+		}
+	}
+
+	// Source CIDRs are set only for IPv4
+	rules, _ = r.getRules(familyIPv6)
+	for _, rule := range rules {
+		if !strings.Contains(strings.Join(rule, " "), "RETURN") {
+			t.Errorf("wrong IPv6 rule - %v", rule)
+		}
+	}
+
+	// Init sets rules again when the configs are changed
+	fake := setFakeIptables(t)
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	os.Setenv(configs.EnvRuleDropInvalidLog, "none")
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if n := len(fake.rules["iptables filter "+ChainFilterDropInvalidInput]); n != 5 {
+		t.Errorf("wrong number of rules after config change. expected:5 / actual:%d", n)
+	}
+}
@@ -1,516 +1,1024 @@
 package rules
 
 import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
 	corev1 "k8s.io/api/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"github.com/go-logr/logr"
-	"github.com/kakao/network-node-manager/pkg/ip"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/conntrack"
+	"github.com/kakao/network-node-manager/pkg/ipset"
 	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
 	"github.com/kakao/network-node-manager/pkg/utils"
 )
 
-func InitRulesExternalCluster(logger logr.Logger) error {
+// Vars
+var (
+	// Chain to mark packets to be masqueraded of each family. It's detected once, so that the rules of services
+	// don't change while running. network-node-manager should be restarted after kube-proxy is installed or removed.
+	markMasqChains = map[string]string{}
+	markMasqLock   = &sync.Mutex{}
+)
+
+// ruleExternalCluster DNATs packets from pods and the host to externalIPs to the service's clusterIP.
+// Packets to the externalIPs in the set of the family are marked to be masqueraded by a single rule in the prerouting
+// and output chains. Each externalIP has a dispatch rule in the chains jumping to the chain of its service,
+// and the chain of the service has the rules to DNAT packets.
+type ruleExternalCluster struct{}
+
+func init() {
+	Register(&ruleExternalCluster{})
+}
+
+func (r *ruleExternalCluster) Name() string {
+	return FeatureExternalCluster
+}
+
+func (r *ruleExternalCluster) ConfigKey() string {
+	return configs.EnvRuleExternalClusterEnable
+}
+
+// DefaultEnabled enables the rule in IPVS mode, where pods and the host can't access externalIPs
+func (r *ruleExternalCluster) DefaultEnabled(mode proxymode.Mode) bool {
+	return mode == proxymode.ModeIPVS
+}
+
+func (r *ruleExternalCluster) Chains() []string {
+	return append(getChainsExternalCluster(), ChainFilterExternalClusterReject, ChainNATMarkMasq, ChainNATMarkMasqPostrouting)
+}
+
+func (r *ruleExternalCluster) Init(logger logr.Logger, family *Family) error {
+	// Check configs
+	if _, err := configs.GetConfigRuleExternalClusterLocalEndpoints(); err != nil {
+		logger.Error(err, "failed to get local endpoints config")
+		return err
+	}
+	reject, err := configs.GetConfigRuleExternalClusterRejectNoEndpoints()
+	if err != nil {
+		logger.Error(err, "failed to get reject config")
+		return err
+	}
+	srcs, err := getSrcsExternalCluster(family)
+	if err != nil {
+		logger.Error(err, "failed to get source config")
+		return err
+	}
+	owners, err := getOwnersExternalCluster(family)
+	if err != nil {
+		logger.Error(err, "failed to get output owner config")
+		return err
+	}
+
 	// Init base chains
-	if err := initBaseChains(logger); err != nil {
+	if err := initBaseChains(logger, family, iptables.TableNAT, ChainBasePrerouting, ChainBaseOutput); err != nil {
 		logger.Error(err, "failed to init base chain for externalIP to clusterIP Rules")
 		return err
 	}
 
-	// IPv4
-	if ip.IsIPv4CIDR(podCIDRIPv4) {
-		// Create chain in nat table
-		out, err := iptables.CreateChainIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting)
-		if err != nil {
-			logger.Error(err, out)
-			return err
-		}
-		out, err = iptables.CreateChainIPv4(iptables.TableNAT, ChainNATExternalClusterOutput)
+	// Create set of externalIPs before the rules matching it
+	setName, setFamily := getSetExternalCluster(family)
+	out, err := ipset.CreateSet(setName, ipset.TypeHashIP, setFamily)
+	if err != nil {
+		logger.Error(err, "failed to create set", "family", family.Name, "set", setName, "output", out)
+		return err
+	}
+
+	// Create chain in nat table
+	for _, chain := range getChainsExternalCluster() {
+		out, err := family.CreateChain(iptables.TableNAT, chain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to create chain", "family", family.Name, "table", iptables.TableNAT, "chain", chain, "output", out)
 			return err
 		}
+	}
 
-		// Set jump rule to each chain in nat table
-		ruleJumpPre := []string{"-j", ChainNATExternalClusterPrerouting}
-		out, err = iptables.CreateRuleFirstIPv4(iptables.TableNAT, ChainBasePrerouting, "", ruleJumpPre...)
+	// Set jump rule to each chain in nat table and delete the jump rules of the removed sources and owners
+	jumps := getRulesExternalClusterJump(srcs, owners)
+	for _, r := range jumps {
+		out, err := family.CreateRuleFirst(iptables.TableNAT, r.chain, "", r.rule...)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to create rule", "family", family.Name, "table", iptables.TableNAT, "chain", r.chain, "rule", strings.Join(r.rule, " "), "output", out)
 			return err
 		}
-		ruleJumpOut := []string{"-j", ChainNATExternalClusterOutput}
-		out, err = iptables.CreateRuleFirstIPv4(iptables.TableNAT, ChainBaseOutput, "", ruleJumpOut...)
-		if err != nil {
-			logger.Error(err, out)
+	}
+	if err := deleteJumpRulesExternalCluster(logger, family, iptables.TableNAT, []string{ChainBasePrerouting, ChainBaseOutput}, getChainsExternalCluster(), jumps); err != nil {
+		return err
+	}
+
+	// Set the chains to masquerade packets if KUBE-MARK-MASQ chain doesn't exist
+	markChain := getMarkMasqChain(family)
+	if markChain == ChainNATMarkMasq {
+		if err := initMarkMasq(logger, family); err != nil {
 			return err
 		}
 	}
-	// IPv6
-	if ip.IsIPv6CIDR(podCIDRIPv6) {
-		// Create chain in nat table
-		out, err := iptables.CreateChainIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting)
+	if err := deleteStaleMarkMasq(logger, family, markChain); err != nil {
+		return err
+	}
+
+	// Set mark rule matching the set in each chain in nat table
+	for _, r := range getRulesExternalClusterMark(family, markChain) {
+		out, err := family.CreateRuleFirst(iptables.TableNAT, r.chain, "", r.rule...)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to create rule", "family", family.Name, "table", iptables.TableNAT, "chain", r.chain, "rule", strings.Join(r.rule, " "), "output", out)
 			return err
 		}
-		out, err = iptables.CreateChainIPv6(iptables.TableNAT, ChainNATExternalClusterOutput)
-		if err != nil {
-			logger.Error(err, out)
+	}
+	if markChain != ChainNATMarkMasq {
+		if err := cleanupMarkMasq(logger, family); err != nil {
 			return err
 		}
+	}
+
+	// Set the chain to reject packets to the services without endpoints
+	if reject {
+		return initRejectExternalCluster(logger, family, srcs, owners)
+	}
+	return cleanupRejectExternalCluster(logger, family)
+}
+
+func (r *ruleExternalCluster) Cleanup(logger logr.Logger, family *Family) error {
+	// Delete jump rule to each chain in nat table regardless of the source configs
+	if err := deleteJumpRulesExternalCluster(logger, family, iptables.TableNAT, []string{ChainBasePrerouting, ChainBaseOutput}, getChainsExternalCluster(), nil); err != nil {
+		return err
+	}
 
-		// Set jump rule to each chain in nat table
-		ruleJumpPre := []string{"-j", ChainNATExternalClusterPrerouting}
-		out, err = iptables.CreateRuleFirstIPv6(iptables.TableNAT, ChainBasePrerouting, "", ruleJumpPre...)
+	// Delete chain in nat table
+	for _, chain := range getChainsExternalCluster() {
+		out, err := family.DeleteChain(iptables.TableNAT, chain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to delete chain", "family", family.Name, "table", iptables.TableNAT, "chain", chain, "output", out)
 			return err
 		}
-		ruleJumpOut := []string{"-j", ChainNATExternalClusterOutput}
-		out, err = iptables.CreateRuleFirstIPv6(iptables.TableNAT, ChainBaseOutput, "", ruleJumpOut...)
+	}
+
+	// Delete the chains of services after the dispatch rules jumping to them are deleted
+	svcChains, err := getServiceChainsExternalCluster(logger, family)
+	if err != nil {
+		return err
+	}
+	for _, chain := range svcChains {
+		out, err := family.DeleteChain(iptables.TableNAT, chain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to delete chain", "family", family.Name, "table", iptables.TableNAT, "chain", chain, "output", out)
 			return err
 		}
 	}
 
-	return nil
+	// Delete the set after the rules matching it are deleted
+	setName, _ := getSetExternalCluster(family)
+	out, err := ipset.DestroySet(setName)
+	if err != nil {
+		logger.Error(err, "failed to destroy set", "family", family.Name, "set", setName, "output", out)
+		return err
+	}
+
+	// Delete the chains to masquerade packets after the rules jumping to them are deleted
+	if err := cleanupMarkMasq(logger, family); err != nil {
+		return err
+	}
+	return cleanupRejectExternalCluster(logger, family)
 }
 
-func DestoryRulesExternalCluster(logger logr.Logger) error {
-	// IPv4
-	if ip.IsIPv4CIDR(podCIDRIPv4) {
-		// Delete jump rule to each chain in nat table
-		ruleJumpPre := []string{"-j", ChainNATExternalClusterPrerouting}
-		out, err := iptables.DeleteRuleIPv4(iptables.TableNAT, ChainBasePrerouting, "", ruleJumpPre...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+// Sync removes the rules of the deleted services. The rules of the other services are set by reconciling them at start.
+func (r *ruleExternalCluster) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	// Make up service map and service chain map
+	svcMap := make(map[string]*corev1.Service)
+	svcChainMap := make(map[string]string)
+	for _, svc := range svcs.Items {
+		if family.IsAddr(utils.GetClusterIPByFamily(family.IPFamily, &svc)) {
+			nsName := svc.Namespace + "/" + svc.Name
+			svcMap[nsName] = svc.DeepCopy()
+			svcChainMap[getServiceChainExternalCluster(nsName)] = nsName
 		}
-		ruleJumpOut := []string{"-j", ChainNATExternalClusterOutput}
-		out, err = iptables.DeleteRuleIPv4(iptables.TableNAT, ChainBaseOutput, "", ruleJumpOut...)
+	}
+
+	// Cleanup prerouting, output and reject chains
+	filters := []conntrack.Filter{}
+	for _, spec := range []RuleSpec{
+		{Table: iptables.TableNAT, Chain: ChainNATExternalClusterPrerouting},
+		{Table: iptables.TableNAT, Chain: ChainNATExternalClusterOutput},
+		{Table: iptables.TableFilter, Chain: ChainFilterExternalClusterReject},
+	} {
+		table, chain := spec.Table, spec.Chain
+		rules, err := family.GetRules(table, chain)
 		if err != nil {
-			logger.Error(err, out)
 			return err
 		}
+		for _, rule := range rules {
+			// Get service info from iptables rules
+			nsName, _, dest, jump, _ := getSvcInfoFromRule(rule)
 
-		// Delete chain in nat table
-		out, err = iptables.DeleteChainIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+			// Check exist and delete iptables rule
+			if _, ok := svcMap[nsName]; ok {
+				continue
+			}
+			logger.Info("there is no service info in k8s. cleanup rule", "service", nsName, "family", family.Name, "table", table, "chain", chain, "rule", rule)
+			out, err := family.DeleteRuleRaw(table, iptables.ChangeRuleToDelete(rule)...)
+			if err != nil {
+				logger.Error(err, "failed to delete rule", "family", family.Name, "table", table, "rule", rule, "output", out)
+				return err
+			}
+			if chain == ChainNATExternalClusterPrerouting && isServiceChainExternalCluster(jump) {
+				svcRules, err := family.GetRules(iptables.TableNAT, jump)
+				if err != nil {
+					logger.Error(err, "failed to get rules", "family", family.Name, "table", iptables.TableNAT, "chain", jump)
+					return err
+				}
+				filters = append(filters, getConntrackFiltersExternalCluster(dest, getDNATAddrsExternalCluster(svcRules))...)
+			}
+		}
+	}
+	flushConntrackExternalCluster(logger, family, filters)
+
+	// Delete the chains of the deleted services
+	svcChains, err := getServiceChainsExternalCluster(logger, family)
+	if err != nil {
+		return err
+	}
+	for _, chain := range svcChains {
+		if _, ok := svcChainMap[chain]; ok {
+			continue
 		}
-		out, err = iptables.DeleteChainIPv4(iptables.TableNAT, ChainNATExternalClusterOutput)
+		logger.Info("there is no service of chain in k8s. cleanup chain", "family", family.Name, "table", iptables.TableNAT, "chain", chain)
+		out, err := family.DeleteChain(iptables.TableNAT, chain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to delete chain", "family", family.Name, "table", iptables.TableNAT, "chain", chain, "output", out)
 			return err
 		}
 	}
-	// IPv6
-	if ip.IsIPv6CIDR(podCIDRIPv6) {
-		// Delete jump rule to each chain in nat table
-		ruleJumpPre := []string{"-j", ChainNATExternalClusterPrerouting}
-		out, err := iptables.DeleteRuleIPv6(iptables.TableNAT, ChainBasePrerouting, "", ruleJumpPre...)
-		if err != nil {
-			logger.Error(err, out)
+
+	return syncSetExternalCluster(logger, family)
+}
+
+// Reconcile sets the rules of the service with the rules in the chains, so that it also applies the changed local endpoints.
+// It changes only the rules of the service. The chains shared by services are set by Init at start and periodically.
+func (r *ruleExternalCluster) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	nsName := req.String()
+	svcChain := getServiceChainExternalCluster(nsName)
+	dispatches, svcRules := getRulesExternalClusterService(family, svc)
+
+	// Get the DNAT destinations in the chain of the service before it's changed
+	oldRules, err := family.GetRules(iptables.TableNAT, svcChain)
+	if err != nil {
+		logger.Error(err, "failed to get rules", "family", family.Name, "table", iptables.TableNAT, "chain", svcChain)
+		return err
+	}
+
+	// Set the chain of the service before the dispatch rules jump to it
+	if len(svcRules) != 0 {
+		if err := setChainRules(logger, family, iptables.TableNAT, "", svcChain, svcRules); err != nil {
 			return err
 		}
-		ruleJumpOut := []string{"-j", ChainNATExternalClusterOutput}
-		out, err = iptables.DeleteRuleIPv6(iptables.TableNAT, ChainBaseOutput, "", ruleJumpOut...)
+	}
+
+	// Add the externalIPs to the set before the dispatch rules, so that dispatched packets are always marked
+	setName, _ := getSetExternalCluster(family)
+	dispatchedIPs := getDispatchedExternalIPs(dispatches)
+	for _, externalIP := range dispatchedIPs {
+		out, err := ipset.AddEntry(setName, externalIP)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to add entry", "service", nsName, "family", family.Name, "set", setName, "entry", externalIP, "output", out)
 			return err
 		}
+	}
 
-		// Delete chain in nat table
-		out, err = iptables.DeleteChainIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	// Set the dispatch rules of the externalIPs
+	externalIPs := []string{}
+	for _, chain := range getChainsExternalCluster() {
+		chainRules := [][]string{}
+		for _, r := range dispatches {
+			if r.chain == chain {
+				chainRules = append(chainRules, r.rule)
+			}
 		}
-		out, err = iptables.DeleteChainIPv6(iptables.TableNAT, ChainNATExternalClusterOutput)
+		deleted, err := setServiceRules(logger, family, iptables.TableNAT, chain, nsName, chainRules)
 		if err != nil {
-			logger.Error(err, out)
 			return err
 		}
+		if chain != ChainNATExternalClusterPrerouting {
+			continue
+		}
+		for _, rule := range chainRules {
+			externalIPs = appendExternalIP(externalIPs, iptables.GetRuleDest(iptables.MakeRule(chain, nsName, rule...)))
+		}
+		for _, rule := range deleted {
+			if isServiceChainExternalCluster(iptables.GetRuleJump(rule)) {
+				externalIPs = appendExternalIP(externalIPs, iptables.GetRuleDest(rule))
+			}
+		}
 	}
 
-	return nil
-}
-
-func CleanupRulesExternalCluster(logger logr.Logger, svcs *corev1.ServiceList) error {
-	// IPv4
-	if ip.IsIPv4CIDR(podCIDRIPv4) {
-		// Make up service map
-		svcMap := make(map[string]*corev1.Service)
-		for _, svc := range svcs.Items {
-			if ip.IsIPv4Addr(utils.GetClusterIPByFamily(corev1.IPv4Protocol, &svc)) {
-				svcMap[svc.Namespace+"/"+svc.Name] = svc.DeepCopy()
-			}
+	// Delete the chain of the service after no dispatch rule jumps to it
+	if len(svcRules) == 0 {
+		if err := cleanupChain(logger, family, iptables.TableNAT, "", svcChain); err != nil {
+			return err
 		}
+	}
 
-		// Cleanup prerouting chain
-		preRules, err := iptables.GetRulesIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting)
+	// Delete the removed externalIPs from the set unless the dispatch rules of other services have them
+	removedIPs := []string{}
+	for _, externalIP := range externalIPs {
+		if !containsString(dispatchedIPs, externalIP) {
+			removedIPs = append(removedIPs, externalIP)
+		}
+	}
+	if len(removedIPs) != 0 {
+		rules, err := family.GetRules(iptables.TableNAT, ChainNATExternalClusterPrerouting)
 		if err != nil {
+			logger.Error(err, "failed to get rules", "family", family.Name, "table", iptables.TableNAT, "chain", ChainNATExternalClusterPrerouting)
 			return err
 		}
-		for _, rule := range preRules {
-			// Get service info from iptables rules
-			nsName, src, dest, jump, dnatDest := getSvcInfoFromRule(rule)
-
-			// Check exist and delete iptables rule
-			svc, ok := svcMap[nsName]
-			if !ok {
-				logger.WithValues("rule", rule).Info("there is no service info in k8s. cleanup prerouting chain IPv4 rule")
-				out, err := iptables.DeleteRuleRawIPv4(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-				continue
-			}
-
-			// Get the service's IPv4 clusterIP and all IPv4 externalIPs
-			clusterIP := utils.GetClusterIPByFamily(corev1.IPv4Protocol, svc)
-			if clusterIP == "" {
+		otherIPs := getDispatchedExternalIPsFromRules(rules)
+		for _, externalIP := range removedIPs {
+			if containsString(otherIPs, externalIP) {
 				continue
 			}
-			externalIPs := []string{}
-			for _, ingress := range svc.Status.LoadBalancer.Ingress {
-				if ip.IsIPv4Addr(ingress.IP) {
-					externalIPs = append(externalIPs, ingress.IP)
-				}
-			}
-			for _, externalIP := range svc.Spec.ExternalIPs {
-				if ip.IsIPv4Addr(externalIP) {
-					externalIPs = append(externalIPs, externalIP)
-				}
+			out, err := ipset.DeleteEntry(setName, externalIP)
+			if err != nil {
+				logger.Error(err, "failed to delete entry", "service", nsName, "family", family.Name, "set", setName, "entry", externalIP, "output", out)
+				return err
 			}
+		}
+	}
 
-			// Compare service info and delete iptables rules
-			for _, externalIP := range externalIPs {
-				externalIP = externalIP + "/32"
-				if (jump == ChainNATKubeMarkMasq && (src == podCIDRIPv4 && dest == externalIP)) ||
-					(jump == "DNAT" && (src == podCIDRIPv4 && dest == externalIP && dnatDest == clusterIP)) {
-					continue
-				}
-				logger.WithValues("rule", rule).Info("service info is diff. cleanup prerouting chain IPv4 rule")
-				out, err := iptables.DeleteRuleRawIPv4(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-			}
+	// Flush conntrack entries DNATed to the removed destinations of the service, or to all the old destinations
+	// for the removed externalIPs. The externalIPs which are just added don't have the conntrack entries DNATed
+	// by the service, so flushing them is harmless.
+	oldDests := getDNATAddrsExternalCluster(oldRules)
+	newRules := []string{}
+	for _, rule := range svcRules {
+		newRules = append(newRules, iptables.MakeRule(svcChain, "", rule...))
+	}
+	newDests := getDNATAddrsExternalCluster(newRules)
+	removedDests := []string{}
+	for _, dest := range oldDests {
+		if !containsString(newDests, dest) {
+			removedDests = append(removedDests, dest)
+		}
+	}
+	filters := []conntrack.Filter{}
+	for _, externalIP := range externalIPs {
+		if containsString(removedIPs, externalIP) {
+			filters = append(filters, getConntrackFiltersExternalCluster(externalIP, oldDests)...)
+		} else {
+			filters = append(filters, getConntrackFiltersExternalCluster(externalIP, removedDests)...)
 		}
+	}
+	flushConntrackExternalCluster(logger, family, filters)
 
-		// Cleanup output chain
-		outRules, err := iptables.GetRulesIPv4(iptables.TableNAT, ChainNATExternalClusterOutput)
-		if err != nil {
+	// Set reject rules. Configs are checked in Init.
+	if reject, _ := configs.GetConfigRuleExternalClusterRejectNoEndpoints(); reject {
+		if _, err := setServiceRules(logger, family, iptables.TableFilter, ChainFilterExternalClusterReject, req.String(),
+			getRulesExternalClusterReject(family, svc)); err != nil {
 			return err
 		}
-		for _, rule := range outRules {
-			// Get service info from iptables rules
-			nsName, _, dest, jump, dnatDest := getSvcInfoFromRule(rule)
-
-			// Check exist and delete iptables rule
-			svc, ok := svcMap[nsName]
-			if !ok {
-				logger.WithValues("rule", rule).Info("there is no service info in k8s. cleanup output chain IPv4 rule")
-				out, err := iptables.DeleteRuleRawIPv4(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-				continue
-			}
+	}
 
-			// Get the service's IPv4 clusterIP and all IPv4 externalIPs
-			clusterIP := utils.GetClusterIPByFamily(corev1.IPv4Protocol, svc)
-			if clusterIP == "" {
-				continue
-			}
-			externalIPs := []string{}
-			for _, ingress := range svc.Status.LoadBalancer.Ingress {
-				if ip.IsIPv4Addr(ingress.IP) {
-					externalIPs = append(externalIPs, ingress.IP)
-				}
-			}
-			for _, externalIP := range svc.Spec.ExternalIPs {
-				if ip.IsIPv4Addr(externalIP) {
-					externalIPs = append(externalIPs, externalIP)
-				}
-			}
+	return nil
+}
 
-			// Compare service info and delete diff iptables rules
-			for _, externalIP := range externalIPs {
-				externalIP = externalIP + "/32"
-				if (jump == ChainNATKubeMarkMasq && dest == externalIP) ||
-					(jump == "DNAT" && (dest == externalIP && dnatDest == clusterIP)) {
-					continue
-				}
-				logger.WithValues("rule", rule).Info("service info is diff. cleanup output chain IPv4 rule")
-				out, err := iptables.DeleteRuleRawIPv4(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-			}
+func (r *ruleExternalCluster) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	result := []RuleSpec{}
+	// Wrong configs are reported by Init
+	srcs, _ := getSrcsExternalCluster(family)
+	owners, _ := getOwnersExternalCluster(family)
+	for _, r := range getRulesExternalClusterJump(srcs, owners) {
+		result = append(result, RuleSpec{iptables.TableNAT, r.chain, "", r.rule})
+	}
+	markChain := getMarkMasqChain(family)
+	if markChain == ChainNATMarkMasq {
+		// Wrong configs are reported by Init
+		if markRules, postroutingRules, err := getRulesMarkMasq(); err == nil {
+			result = append(result, getChainRuleSpecs(iptables.TableNAT, "", ChainNATMarkMasq, markRules)...)
+			result = append(result, getChainRuleSpecs(iptables.TableNAT, ChainBasePostrouting, ChainNATMarkMasqPostrouting, postroutingRules)...)
 		}
 	}
-	// IPv6
-	if ip.IsIPv6CIDR(podCIDRIPv6) {
-		// Make up service map
-		svcMap := make(map[string]*corev1.Service)
-		for _, svc := range svcs.Items {
-			if ip.IsIPv6Addr(utils.GetClusterIPByFamily(corev1.IPv6Protocol, &svc)) {
-				svcMap[svc.Namespace+"/"+svc.Name] = svc.DeepCopy()
-			}
+	for _, r := range getRulesExternalClusterMark(family, markChain) {
+		result = append(result, RuleSpec{iptables.TableNAT, r.chain, "", r.rule})
+	}
+	reject, _ := configs.GetConfigRuleExternalClusterRejectNoEndpoints()
+	if reject {
+		for _, r := range getRulesExternalClusterRejectJump(srcs, owners) {
+			result = append(result, RuleSpec{iptables.TableFilter, r.chain, "", r.rule})
 		}
+	}
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		nsName := svc.Namespace + "/" + svc.Name
+		dispatches, svcRules := getRulesExternalClusterService(family, svc)
+		for _, r := range dispatches {
+			result = append(result, RuleSpec{iptables.TableNAT, r.chain, nsName, r.rule})
+		}
+		if len(svcRules) != 0 {
+			result = append(result, getChainRuleSpecs(iptables.TableNAT, "", getServiceChainExternalCluster(nsName), svcRules)...)
+		}
+		for _, rule := range getRulesExternalClusterReject(family, svc) {
+			result = append(result, RuleSpec{iptables.TableFilter, ChainFilterExternalClusterReject, nsName, rule})
+		}
+	}
+	return result
+}
 
-		// Cleanup prerouting chain
-		preRules, err := iptables.GetRulesIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting)
-		if err != nil {
-			return err
+// getExternalClusterIPs returns the service's clusterIP and the allowed externalIPs of the family.
+// If the service is nil or doesn't have the clusterIP of the family, it returns nothing.
+func getExternalClusterIPs(family *Family, svc *corev1.Service) (string, []string) {
+	if svc == nil {
+		return "", nil
+	}
+	clusterIP := utils.GetClusterIPByFamily(family.IPFamily, svc)
+	if clusterIP == "" {
+		return "", nil
+	}
+
+	externalIPs := []string{}
+	for _, externalIP := range utils.GetExternalIPs(svc) {
+		if family.IsAddr(externalIP) && IsExternalIPAllowed(svc, externalIP) {
+			externalIPs = append(externalIPs, externalIP)
 		}
-		for _, rule := range preRules {
-			// Get service info from iptables rules
-			nsName, src, dest, jump, dnatDest := getSvcInfoFromRule(rule)
+	}
+	return clusterIP, externalIPs
+}
 
-			// Check exist and delete iptables rule
-			svc, ok := svcMap[nsName]
-			if !ok {
-				logger.WithValues("rule", rule).Info("there is no service info in k8s. cleanup prerouting chain IPv6 rule")
-				out, err := iptables.DeleteRuleRawIPv6(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-				continue
-			}
+// getRulesExternalClusterService returns the dispatch rules of the externalIPs jumping to the chain of the service
+// and the DNAT rules in the chain of the service in creation order. The rules in the chain of the service have the comment
+// of the service because the comment isn't set for the rules of a chain. If the service is nil, doesn't have the clusterIP
+// of the family or its externalIPs are rejected, it returns nothing.
+func getRulesExternalClusterService(family *Family, svc *corev1.Service) ([]chainRule, [][]string) {
+	clusterIP, externalIPs := getExternalClusterIPs(family, svc)
+	if clusterIP == "" || len(externalIPs) == 0 || isRejectedExternalCluster(svc) {
+		return nil, nil
+	}
 
-			// Get the service's IPv6 clusterIP and all IPv6 externalIPs
-			clusterIP := utils.GetClusterIPByFamily(corev1.IPv6Protocol, svc)
-			if clusterIP == "" {
-				continue
-			}
-			externalIPs := []string{}
-			for _, ingress := range svc.Status.LoadBalancer.Ingress {
-				if ip.IsIPv6Addr(ingress.IP) {
-					externalIPs = append(externalIPs, ingress.IP)
-				}
-			}
-			for _, externalIP := range svc.Spec.ExternalIPs {
-				if ip.IsIPv6Addr(externalIP) {
-					externalIPs = append(externalIPs, externalIP)
-				}
-			}
+	nsName := svc.Namespace + "/" + svc.Name
+	svcChain := getServiceChainExternalCluster(nsName)
+	dispatches := []chainRule{}
+	for _, externalIP := range externalIPs {
+		dispatches = append(dispatches,
+			// Prerouting
+			chainRule{ChainNATExternalClusterPrerouting, []string{"-d", externalIP, "-j", svcChain}},
+			// Output
+			chainRule{ChainNATExternalClusterOutput, []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", svcChain}},
+		)
+	}
 
-			// Compare service info and delete iptables rules
-			for _, externalIP := range externalIPs {
-				externalIP = externalIP + "/128"
-				if (jump == ChainNATKubeMarkMasq && (src == podCIDRIPv6 && dest == externalIP)) ||
-					(jump == "DNAT" && (src == podCIDRIPv6 && dest == externalIP && dnatDest == clusterIP)) {
-					continue
-				}
-				logger.WithValues("rule", rule).Info("service info is diff. cleanup prerouting chain IPv6 rule")
-				out, err := iptables.DeleteRuleRawIPv6(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-			}
+	comment := []string{"-m", "comment", "--comment", nsName}
+	svcRules := [][]string{}
+	for _, dnat := range getDNATsExternalCluster(family, clusterIP, svc) {
+		svcRules = append(svcRules, concatArgs(comment, dnat))
+	}
+	return dispatches, svcRules
+}
+
+// getServiceChainExternalCluster returns the chain of the service named from the hash of the namespace and name,
+// so that the name is stable and fits in the length limit of chain names
+func getServiceChainExternalCluster(nsName string) string {
+	hash := sha256.Sum256([]byte(nsName))
+	return ChainPrefixNATExternalClusterService + base32.StdEncoding.EncodeToString(hash[:])[:12]
+}
+
+func isServiceChainExternalCluster(chain string) bool {
+	return strings.HasPrefix(chain, ChainPrefixNATExternalClusterService)
+}
+
+// getServiceChainsExternalCluster returns the chains of services in nat table
+func getServiceChainsExternalCluster(logger logr.Logger, family *Family) ([]string, error) {
+	chains, err := family.GetChains(iptables.TableNAT)
+	if err != nil {
+		logger.Error(err, "failed to get chains", "family", family.Name, "table", iptables.TableNAT)
+		return nil, err
+	}
+	result := []string{}
+	for _, chain := range chains {
+		if isServiceChainExternalCluster(chain) {
+			result = append(result, chain)
+		}
+	}
+	return result, nil
+}
+
+// isRejectedExternalCluster returns whether packets to the externalIPs of the service are rejected instead of DNATed
+// because the service has no ready endpoints
+func isRejectedExternalCluster(svc *corev1.Service) bool {
+	reject, err := configs.GetConfigRuleExternalClusterRejectNoEndpoints()
+	return err == nil && reject && svc != nil && HasNoEndpoints(svc.Namespace+"/"+svc.Name)
+}
+
+// getRulesExternalClusterReject returns the filter table rules to reject packets to the externalIPs of the service
+// without endpoints. TCP packets are rejected with TCP reset and the others with ICMP port unreachable.
+func getRulesExternalClusterReject(family *Family, svc *corev1.Service) [][]string {
+	clusterIP, externalIPs := getExternalClusterIPs(family, svc)
+	if clusterIP == "" || !isRejectedExternalCluster(svc) {
+		return nil
+	}
+
+	rejectICMP := "icmp-port-unreachable"
+	if family.IPFamily == corev1.IPv6Protocol {
+		rejectICMP = "icmp6-port-unreachable"
+	}
+	rejects := [][]string{}
+	for _, port := range svc.Spec.Ports {
+		protocol := strings.ToLower(string(port.Protocol))
+		rejectWith := rejectICMP
+		if port.Protocol == corev1.ProtocolTCP {
+			rejectWith = "tcp-reset"
+		}
+		rejects = append(rejects, []string{"-p", protocol, "-m", protocol, "--dport", strconv.Itoa(int(port.Port)), "-j", "REJECT", "--reject-with", rejectWith})
+	}
+	if len(rejects) == 0 {
+		rejects = append(rejects, []string{"-j", "REJECT", "--reject-with", rejectICMP})
+	}
+
+	result := [][]string{}
+	for _, externalIP := range externalIPs {
+		for _, reject := range rejects {
+			result = append(result, concatArgs([]string{"-d", externalIP}, reject))
 		}
+	}
+	return result
+}
 
-		// Cleanup output
-		outRules, err := iptables.GetRulesIPv6(iptables.TableNAT, ChainNATExternalClusterOutput)
+// initRejectExternalCluster sets the chain to reject packets jumped from INPUT, FORWARD and OUTPUT chains in filter table.
+// Packets to externalIPs not DNATed are forwarded or delivered to the host if the externalIPs are on the host.
+// Only the packets from the sources DNATed by the rule are rejected not to reject the packets from outside the cluster.
+func initRejectExternalCluster(logger logr.Logger, family *Family, srcs, owners [][]string) error {
+	if err := initBaseChains(logger, family, iptables.TableFilter, ChainBaseInput, ChainBaseForward, ChainBaseOutput); err != nil {
+		logger.Error(err, "failed to init base chain for reject rules")
+		return err
+	}
+	out, err := family.CreateChain(iptables.TableFilter, ChainFilterExternalClusterReject)
+	if err != nil {
+		logger.Error(err, "failed to create chain", "family", family.Name, "table", iptables.TableFilter, "chain", ChainFilterExternalClusterReject, "output", out)
+		return err
+	}
+	jumps := getRulesExternalClusterRejectJump(srcs, owners)
+	for _, r := range jumps {
+		out, err := family.CreateRuleFirst(iptables.TableFilter, r.chain, "", r.rule...)
 		if err != nil {
+			logger.Error(err, "failed to create rule", "family", family.Name, "table", iptables.TableFilter, "chain", r.chain, "rule", strings.Join(r.rule, " "), "output", out)
 			return err
 		}
-		for _, rule := range outRules {
-			// Get service info from iptables rules
-			nsName, _, dest, jump, dnatDest := getSvcInfoFromRule(rule)
+	}
+	return deleteJumpRulesExternalCluster(logger, family, iptables.TableFilter, []string{ChainBaseInput, ChainBaseForward, ChainBaseOutput},
+		[]string{ChainFilterExternalClusterReject}, jumps)
+}
 
-			// Check exist and delete iptables rule
-			svc, ok := svcMap[nsName]
-			if !ok {
-				logger.WithValues("rule", rule).Info("there is no service info in k8s. cleanup output chain IPv6 rule")
-				out, err := iptables.DeleteRuleRawIPv6(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
-				continue
-			}
+func cleanupRejectExternalCluster(logger logr.Logger, family *Family) error {
+	// Delete jump rule to the reject chain regardless of the source configs
+	if err := deleteJumpRulesExternalCluster(logger, family, iptables.TableFilter, []string{ChainBaseInput, ChainBaseForward, ChainBaseOutput},
+		[]string{ChainFilterExternalClusterReject}, nil); err != nil {
+		return err
+	}
+	out, err := family.DeleteChain(iptables.TableFilter, ChainFilterExternalClusterReject)
+	if err != nil {
+		logger.Error(err, "failed to delete chain", "family", family.Name, "table", iptables.TableFilter, "chain", ChainFilterExternalClusterReject, "output", out)
+		return err
+	}
+	return nil
+}
 
-			// Get the service's IPv6 clusterIP and all IPv6 externalIPs
-			clusterIP := utils.GetClusterIPByFamily(corev1.IPv6Protocol, svc)
-			if clusterIP == "" {
-				continue
-			}
-			externalIPs := []string{}
-			for _, ingress := range svc.Status.LoadBalancer.Ingress {
-				if ip.IsIPv6Addr(ingress.IP) {
-					externalIPs = append(externalIPs, ingress.IP)
-				}
-			}
-			for _, externalIP := range svc.Spec.ExternalIPs {
-				if ip.IsIPv6Addr(externalIP) {
-					externalIPs = append(externalIPs, externalIP)
-				}
-			}
+// getDNATsExternalCluster returns the DNAT args of the rules for the service. Packets are DNATed to the clusterIP by default.
+// If the local endpoints config is enabled and the service has the local external traffic policy, packets to each port are DNATed
+// to the local endpoints of the port distributed by statistic, or to the clusterIP if the port has no local endpoint.
+func getDNATsExternalCluster(family *Family, clusterIP string, svc *corev1.Service) [][]string {
+	dnatClusterIP := [][]string{{"-j", "DNAT", "--to-destination", clusterIP}}
+	enabled, err := configs.GetConfigRuleExternalClusterLocalEndpoints()
+	if err != nil || !enabled || svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal {
+		return dnatClusterIP
+	}
 
-			// Compare service info and delete diff iptables rules
-			for _, externalIP := range externalIPs {
-				externalIP = externalIP + "/128"
-				if (jump == ChainNATKubeMarkMasq && dest == externalIP) ||
-					(jump == "DNAT" && (dest == externalIP && dnatDest == clusterIP)) {
-					continue
-				}
-				logger.WithValues("rule", rule).Info("service info is diff. cleanup output chain IPv6 rule")
-				out, err := iptables.DeleteRuleRawIPv6(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
-				if err != nil {
-					logger.Error(err, out)
-					return err
-				}
+	result := [][]string{}
+	hasLocal := false
+	for _, port := range svc.Spec.Ports {
+		protocol := strings.ToLower(string(port.Protocol))
+		matchPort := []string{"-p", protocol, "-m", protocol, "--dport", strconv.Itoa(int(port.Port))}
+
+		endpoints := getLocalEndpoints(family, svc.Namespace+"/"+svc.Name, port)
+		if len(endpoints) == 0 {
+			result = append(result, concatArgs(matchPort, []string{"-j", "DNAT", "--to-destination", clusterIP}))
+			continue
+		}
+		hasLocal = true
+		for i, endpoint := range endpoints {
+			// The last rule doesn't need the statistic match
+			statistic := []string{}
+			if i < len(endpoints)-1 {
+				statistic = []string{"-m", "statistic", "--mode", "random", "--probability", getProbability(len(endpoints) - i)}
 			}
+			dest := net.JoinHostPort(endpoint.Addr, strconv.Itoa(int(endpoint.Port)))
+			result = append(result, concatArgs(matchPort, statistic, []string{"-j", "DNAT", "--to-destination", dest}))
 		}
 	}
+	if !hasLocal {
+		return dnatClusterIP
+	}
+	return result
+}
 
-	return nil
+// getProbability returns the probability to select one of n endpoints as iptables-save prints it.
+// iptables keeps the probability in 31 bits, so it's rounded before printed to compare the rules.
+func getProbability(n int) string {
+	return fmt.Sprintf("%0.11f", math.Round(0x80000000/float64(n))/0x80000000)
 }
 
-func CreateRulesExternalCluster(logger logr.Logger, req *ctrl.Request, clusterIP, externalIP string) error {
-	// Don't use spec.ipFamily to distingush between IPv4 and IPv6 Address
-	// for kubernetes version that dosen't support IPv6 dualstack
-	if ip.IsIPv4CIDR(podCIDRIPv4) && ip.IsIPv4Addr(clusterIP) {
-		// IPv4
-		// Set prerouting
-		rulePreMasq := []string{"-s", podCIDRIPv4, "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err := iptables.CreateRuleLastIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+// getDNATAddrsExternalCluster returns the addresses of the DNAT destinations in the rules of the chain of the service
+func getDNATAddrsExternalCluster(rules []string) []string {
+	result := []string{}
+	for _, rule := range rules {
+		dest := iptables.GetRuleDNATDest(rule)
+		if host, _, err := net.SplitHostPort(dest); err == nil {
+			dest = host
 		}
-		rulePreDNAT := []string{"-s", podCIDRIPv4, "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.CreateRuleLastIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreDNAT...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+		if addr := net.ParseIP(dest); addr != nil && !containsString(result, addr.String()) {
+			result = append(result, addr.String())
 		}
+	}
+	return result
+}
 
-		// Set output
-		ruleOutMasq := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err = iptables.CreateRuleLastIPv4(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+// getDispatchedExternalIPs returns the externalIPs of the dispatch rules in the prerouting chain
+func getDispatchedExternalIPs(dispatches []chainRule) []string {
+	result := []string{}
+	for _, r := range dispatches {
+		if r.chain == ChainNATExternalClusterPrerouting {
+			result = appendExternalIP(result, iptables.GetRuleDest(iptables.MakeRule(r.chain, "", r.rule...)))
 		}
-		ruleOutDNAT := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.CreateRuleLastIPv4(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutDNAT...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	}
+	return result
+}
+
+// getDispatchedExternalIPsFromRules returns the externalIPs of the dispatch rules in the rules of the prerouting chain
+func getDispatchedExternalIPsFromRules(rules []string) []string {
+	result := []string{}
+	for _, rule := range rules {
+		if isServiceChainExternalCluster(iptables.GetRuleJump(rule)) {
+			result = appendExternalIP(result, iptables.GetRuleDest(rule))
 		}
-	} else if ip.IsIPv6CIDR(podCIDRIPv6) && ip.IsIPv6Addr(clusterIP) {
-		// IPv6
-		// Set prerouting
-		rulePreMasq := []string{"-s", podCIDRIPv6, "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err := iptables.CreateRuleLastIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	}
+	return result
+}
+
+// appendExternalIP appends the externalIP in the canonical form without the host prefix length
+// if it's not in the externalIPs, so that the externalIPs of the rules and the set are compared
+func appendExternalIP(externalIPs []string, externalIP string) []string {
+	addr := net.ParseIP(strings.Split(externalIP, "/")[0])
+	if addr == nil || containsString(externalIPs, addr.String()) {
+		return externalIPs
+	}
+	return append(externalIPs, addr.String())
+}
+
+// syncSetExternalCluster sets the set of the family with the externalIPs of the dispatch rules in the prerouting chain
+func syncSetExternalCluster(logger logr.Logger, family *Family) error {
+	setName, _ := getSetExternalCluster(family)
+	rules, err := family.GetRules(iptables.TableNAT, ChainNATExternalClusterPrerouting)
+	if err != nil {
+		logger.Error(err, "failed to get rules", "family", family.Name, "table", iptables.TableNAT, "chain", ChainNATExternalClusterPrerouting)
+		return err
+	}
+	entries, err := ipset.GetEntries(setName)
+	if err != nil {
+		logger.Error(err, "failed to get entries", "family", family.Name, "set", setName)
+		return err
+	}
+
+	dispatchedIPs := getDispatchedExternalIPsFromRules(rules)
+	currentIPs := []string{}
+	for _, entry := range entries {
+		currentIPs = appendExternalIP(currentIPs, entry)
+	}
+	for _, externalIP := range dispatchedIPs {
+		if containsString(currentIPs, externalIP) {
+			continue
 		}
-		rulePreDNAT := []string{"-s", podCIDRIPv6, "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.CreateRuleLastIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreDNAT...)
+		logger.Info("add entry", "family", family.Name, "set", setName, "entry", externalIP)
+		out, err := ipset.AddEntry(setName, externalIP)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to add entry", "family", family.Name, "set", setName, "entry", externalIP, "output", out)
 			return err
 		}
-
-		// Set output
-		ruleOutMasq := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err = iptables.CreateRuleLastIPv6(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	}
+	for _, externalIP := range currentIPs {
+		if containsString(dispatchedIPs, externalIP) {
+			continue
 		}
-		ruleOutDNAT := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.CreateRuleLastIPv6(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutDNAT...)
+		logger.Info("there is no dispatch rule of entry. delete entry", "family", family.Name, "set", setName, "entry", externalIP)
+		out, err := ipset.DeleteEntry(setName, externalIP)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to delete entry", "family", family.Name, "set", setName, "entry", externalIP, "output", out)
 			return err
 		}
 	}
-
 	return nil
 }
 
-func DeleteRulesExternalCluster(logger logr.Logger, req *ctrl.Request, clusterIP, externalIP string) error {
-	// Don't use spec.ipFamily to distingush between IPv4 and IPv6 Address
-	// for kubernetes version that dosen't support IPv6 dualstack
-	if ip.IsIPv4CIDR(podCIDRIPv4) && ip.IsIPv4Addr(clusterIP) {
-		// IPv4
-		// Unset prerouting
-		rulePreMasq := []string{"-s", podCIDRIPv4, "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err := iptables.DeleteRuleIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+// getSetExternalCluster returns the name and the family of the set of externalIPs of the family
+func getSetExternalCluster(family *Family) (string, ipset.Family) {
+	if family.IPFamily == corev1.IPv6Protocol {
+		return SetExternalClusterIPv6, ipset.FamilyIPv6
+	}
+	return SetExternalClusterIPv4, ipset.FamilyIPv4
+}
+
+// getConntrackFiltersExternalCluster returns the filters of the UDP conntrack entries to the externalIP DNATed to the destinations.
+// The reply source of an entry is its DNAT destination, so the entries DNATed to the other destinations aren't deleted.
+func getConntrackFiltersExternalCluster(externalIP string, dests []string) []conntrack.Filter {
+	addr := net.ParseIP(strings.Split(externalIP, "/")[0])
+	if addr == nil {
+		return nil
+	}
+
+	result := []conntrack.Filter{}
+	for _, dest := range dests {
+		if destAddr := net.ParseIP(dest); destAddr != nil {
+			result = append(result, conntrack.Filter{Protocol: conntrack.ProtocolUDP, OrigDst: addr, ReplySrc: destAddr})
 		}
-		rulePreDNAT := []string{"-s", podCIDRIPv4, "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.DeleteRuleIPv4(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreDNAT...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	}
+	return result
+}
+
+// flushConntrackExternalCluster deletes the UDP conntrack entries matched with the filters by dumping entries once
+// after their DNAT rules are removed, because the packets of existing UDP flows keep being DNATed to the old destination
+// until the entries expire. It's the best effort, so failures are only logged.
+func flushConntrackExternalCluster(logger logr.Logger, family *Family, filters []conntrack.Filter) {
+	if len(filters) == 0 {
+		return
+	}
+
+	count, err := conntrack.DeleteEntries(filters)
+	if err != nil {
+		logger.Error(err, "failed to delete conntrack entries", "family", family.Name, "filters", len(filters))
+		return
+	}
+	logger.Info("delete conntrack entries", "family", family.Name, "filters", len(filters), "entries", count)
+}
+
+// SetKubeMarkMasqExist sets whether KUBE-MARK-MASQ chain exists in both families instead of detecting it,
+// for the rules not set on the node
+func SetKubeMarkMasqExist(exist bool) {
+	markMasqLock.Lock()
+	defer markMasqLock.Unlock()
+
+	chain := ChainNATMarkMasq
+	if exist {
+		chain = ChainNATKubeMarkMasq
+	}
+	for _, family := range []*Family{familyIPv4, familyIPv6} {
+		markMasqChains[family.Name] = chain
+	}
+}
+
+// getMarkMasqChain returns KUBE-MARK-MASQ chain of kube-proxy if it exists. Otherwise kube-proxy is replaced by others
+// like cilium and kube-router, so it returns the chain of network-node-manager.
+func getMarkMasqChain(family *Family) string {
+	markMasqLock.Lock()
+	defer markMasqLock.Unlock()
+
+	if chain, ok := markMasqChains[family.Name]; ok {
+		return chain
+	}
+	chain := ChainNATMarkMasq
+	if family.IsExistChain(iptables.TableNAT, ChainNATKubeMarkMasq) {
+		chain = ChainNATKubeMarkMasq
+	}
+	markMasqChains[family.Name] = chain
+	return chain
+}
+
+// initMarkMasq sets the chain to mark packets and the chain to masquerade the marked packets like kube-proxy
+func initMarkMasq(logger logr.Logger, family *Family) error {
+	markRules, postroutingRules, err := getRulesMarkMasq()
+	if err != nil {
+		logger.Error(err, "failed to get masquerade mark config")
+		return err
+	}
+	if err := setChainRules(logger, family, iptables.TableNAT, "", ChainNATMarkMasq, markRules); err != nil {
+		return err
+	}
+	return setChainRules(logger, family, iptables.TableNAT, ChainBasePostrouting, ChainNATMarkMasqPostrouting, postroutingRules)
+}
+
+func cleanupMarkMasq(logger logr.Logger, family *Family) error {
+	if err := cleanupChain(logger, family, iptables.TableNAT, ChainBasePostrouting, ChainNATMarkMasqPostrouting); err != nil {
+		return err
+	}
+	return cleanupChain(logger, family, iptables.TableNAT, "", ChainNATMarkMasq)
+}
+
+// deleteStaleMarkMasq deletes the rules jumping to the mark chains except the mark rules of the mark chain in use,
+// because they were set before kube-proxy was installed or removed or by the previous versions.
+// The chains of services are also checked for the rules set by the previous versions.
+// All the rules of nat table are got at once, so it's called only at start and periodically by Init, not per service.
+func deleteStaleMarkMasq(logger logr.Logger, family *Family, markChain string) error {
+	markRules := getRulesExternalClusterMark(family, markChain)
+	rules, err := family.GetRules(iptables.TableNAT, "")
+	if err != nil {
+		logger.Error(err, "failed to get rules", "family", family.Name, "table", iptables.TableNAT)
+		return err
+	}
+	for _, rule := range rules {
+		chain := iptables.GetRuleChain(rule)
+		if !containsString(getChainsExternalCluster(), chain) && !isServiceChainExternalCluster(chain) {
+			continue
+		}
+		jump := iptables.GetRuleJump(rule)
+		if (jump != ChainNATKubeMarkMasq && jump != ChainNATMarkMasq) || hasChainRule(markRules, rule) {
+			continue
 		}
 
-		// Unset output
-		ruleOutMasq := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err = iptables.DeleteRuleIPv4(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutMasq...)
+		logger.Info("mark chain is changed. delete rule", "family", family.Name, "table", iptables.TableNAT, "rule", rule, "markChain", markChain)
+		out, err := family.DeleteRuleRaw(iptables.TableNAT, iptables.ChangeRuleToDelete(rule)...)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to delete rule", "family", family.Name, "table", iptables.TableNAT, "rule", rule, "output", out)
 			return err
 		}
-		ruleOutDNAT := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.DeleteRuleIPv4(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutDNAT...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	}
+	return nil
+}
+
+// getRulesMarkMasq returns the rules of the mark chain and the masquerade chain with the configured mark bit.
+// Rules are in iptables-save format to compare them with the rules in the chains.
+func getRulesMarkMasq() (markRules, postroutingRules [][]string, err error) {
+	bit, err := configs.GetConfigRuleExternalClusterMasqMarkBit()
+	if err != nil {
+		return nil, nil, err
+	}
+	mark := fmt.Sprintf("%#x", 1<<uint(bit))
+
+	markRules = [][]string{
+		{"-j", "MARK", "--set-xmark", mark + "/" + mark},
+	}
+	postroutingRules = [][]string{
+		{"-m", "mark", "!", "--mark", mark + "/" + mark, "-j", "RETURN"},
+		// Clear the mark not to masquerade the packet again when it's re-traversing the stack
+		{"-j", "MARK", "--set-xmark", mark + "/0x0"},
+		{"-j", "MASQUERADE"},
+	}
+	return markRules, postroutingRules, nil
+}
+
+// getRulesExternalClusterRejectJump returns the jump rules from base chains to the reject chain in filter table.
+// The jump rules match the same sources and owners as the jump rules to the DNAT chains.
+func getRulesExternalClusterRejectJump(srcs, owners [][]string) []chainRule {
+	result := []chainRule{}
+	for _, src := range srcs {
+		result = append(result, chainRule{ChainBaseInput, concatArgs(src, []string{"-j", ChainFilterExternalClusterReject})})
+		result = append(result, chainRule{ChainBaseForward, concatArgs(src, []string{"-j", ChainFilterExternalClusterReject})})
+	}
+	for _, owner := range owners {
+		result = append(result, chainRule{ChainBaseOutput,
+			concatArgs([]string{"-m", "addrtype", "--src-type", "LOCAL"}, owner, []string{"-j", ChainFilterExternalClusterReject})})
+	}
+	return result
+}
+
+func getChainsExternalCluster() []string {
+	return []string{ChainNATExternalClusterPrerouting, ChainNATExternalClusterOutput}
+}
+
+// getRulesExternalClusterMark returns the rules to mark packets to the externalIPs in the set, which are DNATed
+// by the dispatch rules after them
+func getRulesExternalClusterMark(family *Family, markChain string) []chainRule {
+	setName, _ := getSetExternalCluster(family)
+	return []chainRule{
+		{ChainNATExternalClusterPrerouting, []string{"-m", "set", "--match-set", setName, "dst", "-j", markChain}},
+		{ChainNATExternalClusterOutput, []string{"-m", "addrtype", "--src-type", "LOCAL", "-m", "set", "--match-set", setName, "dst", "-j", markChain}},
+	}
+}
+
+// getRulesExternalClusterJump returns the jump rules from base chains to the chains of the rule.
+// Packets from each source jump to the prerouting chain and packets of each owner jump to the output chain,
+// so that the rules in the chains don't match sources and owners.
+func getRulesExternalClusterJump(srcs, owners [][]string) []chainRule {
+	result := []chainRule{}
+	for _, src := range srcs {
+		result = append(result, chainRule{ChainBasePrerouting, concatArgs(src, []string{"-j", ChainNATExternalClusterPrerouting})})
+	}
+	for _, owner := range owners {
+		result = append(result, chainRule{ChainBaseOutput, concatArgs(owner, []string{"-j", ChainNATExternalClusterOutput})})
+	}
+	return result
+}
+
+// getOwnersExternalCluster returns the owner matches of the locally generated packets DNATed in the output chain.
+// The configured owners of the family are excluded by a single match of all owners, or only included by a match of each owner.
+func getOwnersExternalCluster(family *Family) ([][]string, error) {
+	var owners []configs.Owner
+	var include bool
+	var err error
+	if family.IPFamily == corev1.IPv6Protocol {
+		owners, include, err = configs.GetConfigRuleExternalClusterOutputOwnersIPv6()
+	} else {
+		owners, include, err = configs.GetConfigRuleExternalClusterOutputOwnersIPv4()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if include {
+		result := [][]string{}
+		for _, owner := range owners {
+			result = append(result, getOwnerMatch(owner, false))
 		}
-	} else if ip.IsIPv6CIDR(podCIDRIPv6) && ip.IsIPv6Addr(clusterIP) {
-		// IPv6
-		// Unset prerouting
-		rulePreMasq := []string{"-s", podCIDRIPv6, "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err := iptables.DeleteRuleIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+		return result, nil
+	}
+	exclude := []string{}
+	for _, owner := range owners {
+		exclude = append(exclude, getOwnerMatch(owner, true)...)
+	}
+	return [][]string{exclude}, nil
+}
+
+// getOwnerMatch returns the match of the owner in the form of iptables-save
+func getOwnerMatch(owner configs.Owner, negative bool) []string {
+	not := []string{}
+	if negative {
+		not = []string{"!"}
+	}
+	switch owner.Type {
+	case configs.OwnerUID:
+		return concatArgs([]string{"-m", "owner"}, not, []string{"--uid-owner", owner.Value})
+	case configs.OwnerGID:
+		return concatArgs([]string{"-m", "owner"}, not, []string{"--gid-owner", owner.Value})
+	}
+	return concatArgs([]string{"-m", "cgroup"}, not, []string{"--path", owner.Value})
+}
+
+// getSrcsExternalCluster returns the source matches of the packets DNATed in the prerouting chain,
+// which are the pod CIDR and the configured source CIDRs and input interfaces of the family
+func getSrcsExternalCluster(family *Family) ([][]string, error) {
+	var cidrs, ifaces []string
+	var err error
+	if family.IPFamily == corev1.IPv6Protocol {
+		if cidrs, err = configs.GetConfigRuleExternalClusterSrcCIDRsIPv6(); err != nil {
+			return nil, err
 		}
-		rulePreDNAT := []string{"-s", podCIDRIPv6, "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.DeleteRuleIPv6(iptables.TableNAT, ChainNATExternalClusterPrerouting, req.String(), rulePreDNAT...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+		if ifaces, err = configs.GetConfigRuleExternalClusterSrcInterfacesIPv6(); err != nil {
+			return nil, err
+		}
+	} else {
+		if cidrs, err = configs.GetConfigRuleExternalClusterSrcCIDRsIPv4(); err != nil {
+			return nil, err
 		}
+		if ifaces, err = configs.GetConfigRuleExternalClusterSrcInterfacesIPv4(); err != nil {
+			return nil, err
+		}
+	}
 
-		// Unset output
-		ruleOutMasq := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", ChainNATKubeMarkMasq}
-		out, err = iptables.DeleteRuleIPv6(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutMasq...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+	result := [][]string{{"-s", family.PodCIDR}}
+	for _, cidr := range cidrs {
+		if cidr != family.PodCIDR {
+			result = append(result, []string{"-s", cidr})
 		}
-		ruleOutDNAT := []string{"-m", "addrtype", "--src-type", "LOCAL", "-d", externalIP, "-j", "DNAT", "--to-destination", clusterIP}
-		out, err = iptables.DeleteRuleIPv6(iptables.TableNAT, ChainNATExternalClusterOutput, req.String(), ruleOutDNAT...)
+	}
+	for _, iface := range ifaces {
+		result = append(result, []string{"-i", iface})
+	}
+	return result, nil
+}
+
+// deleteJumpRulesExternalCluster deletes the jump rules to the chains in base chains of the table except the rules to keep
+func deleteJumpRulesExternalCluster(logger logr.Logger, family *Family, table iptables.Table, baseChains, chains []string, keep []chainRule) error {
+	for _, baseChain := range baseChains {
+		rules, err := family.GetRules(table, baseChain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to get rules", "family", family.Name, "table", table, "chain", baseChain)
 			return err
 		}
+		for _, rule := range rules {
+			if !containsString(chains, iptables.GetRuleJump(rule)) || hasChainRule(keep, rule) {
+				continue
+			}
+			out, err := family.DeleteRuleRaw(table, iptables.ChangeRuleToDelete(rule)...)
+			if err != nil {
+				logger.Error(err, "failed to delete rule", "family", family.Name, "table", table, "rule", rule, "output", out)
+				return err
+			}
+		}
 	}
-
 	return nil
 }
 
+// hasChainRule returns whether the rules have the rule in iptables-save format
+func hasChainRule(rules []chainRule, rule string) bool {
+	for _, r := range rules {
+		if iptables.GetRuleKey(iptables.MakeRule(r.chain, "", r.rule...)) == iptables.GetRuleKey(rule) {
+			return true
+		}
+	}
+	return false
+}
+
 func getSvcInfoFromRule(rule string) (nsName, src, dest, jump, dnatDest string) {
 	nsName = iptables.GetRuleComment(rule)
 	src = iptables.GetRuleSrc(rule)
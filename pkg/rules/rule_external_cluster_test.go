@@ -0,0 +1,661 @@
+package rules
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/statusaddr"
+)
+
+func TestExternalClusterFlushConntrack(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"192.168.0.10", "192.168.0.20"},
+		},
+	}
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+
+	// Change the clusterIP and remove an externalIP
+	newSvc := svc.DeepCopy()
+	newSvc.Spec.ClusterIP = "10.96.0.20"
+	newSvc.Spec.ExternalIPs = []string{"192.168.0.10"}
+	fake.commands = nil
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, newSvc, svc); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	// Entries to both externalIPs DNATed to the old clusterIP are deleted by a dump
+	if flushed := getConntrackCommands(fake.commands); !reflect.DeepEqual(flushed, []string{
+		"conntrack -D -p 17 --orig-dst 192.168.0.10 --reply-src 10.96.0.10 , -p 17 --orig-dst 192.168.0.20 --reply-src 10.96.0.10",
+	}) {
+		t.Errorf("wrong conntrack deletes after changing service - %v", flushed)
+	}
+
+	// Sync after the service is deleted
+	fake.commands = nil
+	if err := rule.Sync(log.NullLogger{}, familyIPv4, &corev1.ServiceList{}); err != nil {
+		t.Fatalf("failed to sync : %v", err)
+	}
+	if flushed := getConntrackCommands(fake.commands); !reflect.DeepEqual(flushed, []string{
+		"conntrack -D -p 17 --orig-dst 192.168.0.10 --reply-src 10.96.0.20",
+	}) {
+		t.Errorf("wrong conntrack deletes after sync - %v", flushed)
+	}
+	if fake.chains["iptables nat "+getServiceChainExternalCluster("default/nginx")] {
+		t.Errorf("service chain remains after sync")
+	}
+}
+
+func TestExternalClusterSet(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	newSvc := func(name string, externalIPs ...string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10", ExternalIPs: externalIPs},
+		}
+	}
+	reconcile := func(name string, svc *corev1.Service) {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+		if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+			t.Fatalf("failed to reconcile : %v", err)
+		}
+	}
+
+	// Services sharing an externalIP
+	nginx := newSvc("nginx", "192.168.0.10", "192.168.0.20")
+	reconcile("nginx", nginx)
+	reconcile("web", newSvc("web", "192.168.0.10"))
+	if entries := fake.sets[SetExternalClusterIPv4]; !reflect.DeepEqual(entries, []string{"192.168.0.10", "192.168.0.20"}) {
+		t.Errorf("wrong entries - %v", entries)
+	}
+	for _, chain := range getChainsExternalCluster() {
+		marks := 0
+		for _, rule := range fake.rules["iptables nat "+chain] {
+			if iptables.GetRuleJump(rule) == ChainNATMarkMasq {
+				marks++
+			}
+		}
+		if marks != 1 {
+			t.Errorf("wrong number of mark rules in %s - %v", chain, fake.rules["iptables nat "+chain])
+		}
+	}
+
+	// The externalIP of the other service is kept
+	reconcile("nginx", nil)
+	if entries := fake.sets[SetExternalClusterIPv4]; !reflect.DeepEqual(entries, []string{"192.168.0.10"}) {
+		t.Errorf("wrong entries after deleting service - %v", entries)
+	}
+
+	// Sync adds the missing entries and deletes the stale entries
+	fake.sets[SetExternalClusterIPv4] = []string{"192.168.0.30"}
+	if err := rule.Sync(log.NullLogger{}, familyIPv4, &corev1.ServiceList{Items: []corev1.Service{*newSvc("web", "192.168.0.10")}}); err != nil {
+		t.Fatalf("failed to sync : %v", err)
+	}
+	if entries := fake.sets[SetExternalClusterIPv4]; !reflect.DeepEqual(entries, []string{"192.168.0.10"}) {
+		t.Errorf("wrong entries after sync - %v", entries)
+	}
+
+	// Cleanup destroys the set
+	if err := rule.Cleanup(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	if _, ok := fake.sets[SetExternalClusterIPv4]; ok {
+		t.Errorf("set remains")
+	}
+}
+
+func TestExternalClusterSrcs(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleExternalClusterSrcCIDRsIPv4, "10.10.0.0/16")
+	os.Setenv(configs.EnvRuleExternalClusterSrcInterfacesIPv4, "virbr0,net1+")
+	defer os.Unsetenv(configs.EnvRuleExternalClusterSrcCIDRsIPv4)
+	defer os.Unsetenv(configs.EnvRuleExternalClusterSrcInterfacesIPv4)
+	rule := &ruleExternalCluster{}
+	getJumps := func() []string {
+		result := []string{}
+		for _, rule := range fake.rules["iptables nat "+ChainBasePrerouting] {
+			if iptables.GetRuleJump(rule) == ChainNATExternalClusterPrerouting {
+				result = append(result, rule)
+			}
+		}
+		return result
+	}
+
+	// Packets from the pod CIDR and the extra sources jump to the prerouting chain
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if jumps := getJumps(); !reflect.DeepEqual(jumps, []string{
+		"-A NMANAGER_PREROUTING -i net1+ -j NMANAGER_EX_CLUS_PREROUTING",
+		"-A NMANAGER_PREROUTING -i virbr0 -j NMANAGER_EX_CLUS_PREROUTING",
+		"-A NMANAGER_PREROUTING -s 10.10.0.0/16 -j NMANAGER_EX_CLUS_PREROUTING",
+		"-A NMANAGER_PREROUTING -s 10.244.0.0/16 -j NMANAGER_EX_CLUS_PREROUTING",
+	}) {
+		t.Errorf("wrong jump rules - %v", jumps)
+	}
+
+	// Removed sources
+	os.Unsetenv(configs.EnvRuleExternalClusterSrcInterfacesIPv4)
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if jumps := getJumps(); !reflect.DeepEqual(jumps, []string{
+		"-A NMANAGER_PREROUTING -s 10.10.0.0/16 -j NMANAGER_EX_CLUS_PREROUTING",
+		"-A NMANAGER_PREROUTING -s 10.244.0.0/16 -j NMANAGER_EX_CLUS_PREROUTING",
+	}) {
+		t.Errorf("wrong jump rules after removing sources - %v", jumps)
+	}
+
+	// Wrong config
+	os.Setenv(configs.EnvRuleExternalClusterSrcCIDRsIPv4, "fd00::/64")
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err == nil {
+		t.Errorf("no error for wrong config")
+	}
+	if err := rule.Cleanup(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	if jumps := getJumps(); len(jumps) != 0 {
+		t.Errorf("jump rules remain - %v", jumps)
+	}
+}
+
+func TestExternalClusterOutputOwners(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	defer os.Unsetenv(configs.EnvRuleExternalClusterOutputExcludeIPv4)
+	defer os.Unsetenv(configs.EnvRuleExternalClusterOutputIncludeIPv4)
+	rule := &ruleExternalCluster{}
+	getJumps := func() []string {
+		result := []string{}
+		for _, rule := range fake.rules["iptables nat "+ChainBaseOutput] {
+			if iptables.GetRuleJump(rule) == ChainNATExternalClusterOutput {
+				result = append(result, rule)
+			}
+		}
+		return result
+	}
+
+	// All locally generated packets
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if jumps := getJumps(); !reflect.DeepEqual(jumps, []string{"-A NMANAGER_OUTPUT -j NMANAGER_EX_CLUS_OUTPUT"}) {
+		t.Errorf("wrong jump rules - %v", jumps)
+	}
+
+	// Excluded owners are matched by a single rule
+	os.Setenv(configs.EnvRuleExternalClusterOutputExcludeIPv4, "uid:1000,cgroup:system.slice/prober.service")
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if jumps := getJumps(); !reflect.DeepEqual(jumps, []string{
+		"-A NMANAGER_OUTPUT -m owner ! --uid-owner 1000 -m cgroup ! --path system.slice/prober.service -j NMANAGER_EX_CLUS_OUTPUT",
+	}) {
+		t.Errorf("wrong jump rules for exclude - %v", jumps)
+	}
+
+	// Included owners are matched by each rule
+	os.Unsetenv(configs.EnvRuleExternalClusterOutputExcludeIPv4)
+	os.Setenv(configs.EnvRuleExternalClusterOutputIncludeIPv4, "uid:0,gid:2000")
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if jumps := getJumps(); !reflect.DeepEqual(jumps, []string{
+		"-A NMANAGER_OUTPUT -m owner --gid-owner 2000 -j NMANAGER_EX_CLUS_OUTPUT",
+		"-A NMANAGER_OUTPUT -m owner --uid-owner 0 -j NMANAGER_EX_CLUS_OUTPUT",
+	}) {
+		t.Errorf("wrong jump rules for include - %v", jumps)
+	}
+
+	// Wrong config
+	os.Setenv(configs.EnvRuleExternalClusterOutputExcludeIPv4, "uid:1000")
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err == nil {
+		t.Errorf("no error for both exclude and include")
+	}
+}
+
+func TestExternalClusterAddressService(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleExternalIPAllowlistEnable, "true")
+	defer os.Unsetenv(configs.EnvRuleExternalIPAllowlistEnable)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	backing := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "infra", Name: "gw-svc"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10", ExternalIPs: []string{"192.168.0.20"}},
+	}
+
+	// The addresses of the gateway are DNATed to the clusterIP of the backing service even if externalIPs aren't allowed
+	svc := statusaddr.NewService(statusaddr.KindGateway, &metav1.ObjectMeta{Namespace: "default", Name: "gw"}, backing, []string{"192.168.0.10", "192.168.0.20"})
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}}
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	svcChain := getServiceChainExternalCluster("default/gateway.gw")
+	if rules := fake.rules["iptables nat "+ChainNATExternalClusterPrerouting]; !reflect.DeepEqual(rules, []string{
+		"-A NMANAGER_EX_CLUS_PREROUTING -m set --match-set NMANAGER_EX_CLUS_IPV4 dst -j NMANAGER_MARK_MASQ",
+		"-A NMANAGER_EX_CLUS_PREROUTING -m comment --comment default/gateway.gw -d 192.168.0.10/32 -j " + svcChain,
+	}) {
+		t.Errorf("wrong dispatch rules - %v", rules)
+	}
+	if rules := fake.rules["iptables nat "+svcChain]; !reflect.DeepEqual(rules, []string{
+		"-A " + svcChain + " -m comment --comment default/gateway.gw -j DNAT --to-destination 10.96.0.10",
+	}) {
+		t.Errorf("wrong service rules - %v", rules)
+	}
+
+	// Sync keeps the rules of the address service
+	if err := rule.Sync(log.NullLogger{}, familyIPv4, &corev1.ServiceList{Items: []corev1.Service{*svc}}); err != nil {
+		t.Fatalf("failed to sync : %v", err)
+	}
+	if !fake.chains["iptables nat "+svcChain] {
+		t.Errorf("service chain is deleted by sync")
+	}
+}
+
+func TestGetServiceChainExternalCluster(t *testing.T) {
+	chain := getServiceChainExternalCluster("default/nginx")
+	if !strings.HasPrefix(chain, ChainPrefixNATExternalClusterService) || len(chain) > 28 {
+		t.Errorf("wrong chain name - %s", chain)
+	}
+	if chain != getServiceChainExternalCluster("default/nginx") {
+		t.Errorf("not stable chain name - %s", chain)
+	}
+	if chain == getServiceChainExternalCluster("default/nginx2") {
+		t.Errorf("same chain name for other service - %s", chain)
+	}
+}
+
+func getConntrackCommands(commands []string) []string {
+	result := []string{}
+	for _, command := range commands {
+		if strings.HasPrefix(command, "conntrack") {
+			result = append(result, command)
+		}
+	}
+	return result
+}
+
+func TestExternalClusterMarkMasq(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleExternalClusterMasqMarkBit, "12")
+	defer os.Unsetenv(configs.EnvRuleExternalClusterMasqMarkBit)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"192.168.0.10"},
+		},
+	}
+
+	// Without KUBE-MARK-MASQ, packets are marked and masqueraded by own chains
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if rules := fake.rules["iptables nat "+ChainNATMarkMasq]; !reflect.DeepEqual(rules, []string{
+		"-A NMANAGER_MARK_MASQ -j MARK --set-xmark 0x1000/0x1000",
+	}) {
+		t.Errorf("wrong mark rules - %v", rules)
+	}
+	if rules := fake.rules["iptables nat "+ChainNATMarkMasqPostrouting]; !reflect.DeepEqual(rules, []string{
+		"-A NMANAGER_MARK_MASQ_POSTROUTING -m mark ! --mark 0x1000/0x1000 -j RETURN",
+		"-A NMANAGER_MARK_MASQ_POSTROUTING -j MARK --set-xmark 0x1000/0x0",
+		"-A NMANAGER_MARK_MASQ_POSTROUTING -j MASQUERADE",
+	}) {
+		t.Errorf("wrong masquerade rules - %v", rules)
+	}
+	if jump := iptables.GetRuleJump(fake.rules["iptables nat "+ChainNATExternalClusterPrerouting][0]); jump != ChainNATMarkMasq {
+		t.Errorf("wrong mark chain - %s", jump)
+	}
+
+	// After kube-proxy is installed and restarted, the mark rules are replaced and own chains are deleted
+	resetMarkMasqChains()
+	fake.chains["iptables nat "+ChainNATKubeMarkMasq] = true
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if rules := fake.rules["iptables nat "+ChainNATExternalClusterPrerouting]; len(rules) != 2 || iptables.GetRuleJump(rules[0]) != ChainNATKubeMarkMasq ||
+		fake.chains["iptables nat "+ChainNATMarkMasq] || fake.chains["iptables nat "+ChainNATMarkMasqPostrouting] {
+		t.Errorf("stale rules or chains remain - %v %v", fake.chains, fake.rules)
+	}
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, svc); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if rules := fake.rules["iptables nat "+ChainNATExternalClusterOutput]; len(rules) != 2 || iptables.GetRuleJump(rules[0]) != ChainNATKubeMarkMasq {
+		t.Errorf("wrong mark rules - %v", rules)
+	}
+}
+
+func TestExternalClusterLocalEndpoints(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleExternalClusterLocalEndpoints, "true")
+	defer os.Unsetenv(configs.EnvRuleExternalClusterLocalEndpoints)
+	defer SetLocalEndpoints("default/nginx", nil)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:             "10.96.0.10",
+			ExternalIPs:           []string{"192.168.0.10"},
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53},
+			},
+		},
+	}
+	svcChain := getServiceChainExternalCluster("default/nginx")
+	getDNATs := func() []string {
+		result := []string{}
+		for _, rule := range fake.rules["iptables nat "+svcChain] {
+			if iptables.GetRuleJump(rule) == "DNAT" {
+				result = append(result, strings.TrimPrefix(rule, "-A "+svcChain+" -m comment --comment default/nginx "))
+			}
+		}
+		return result
+	}
+
+	// Local endpoints distributed by statistic, and the clusterIP for the port without local endpoints
+	SetLocalEndpoints("default/nginx", []LocalEndpoint{
+		{Addr: "10.244.0.10", PortName: "http", Protocol: corev1.ProtocolTCP, Port: 8080},
+		{Addr: "10.244.0.11", PortName: "http", Protocol: corev1.ProtocolTCP, Port: 8080},
+	})
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if dnats := getDNATs(); !reflect.DeepEqual(dnats, []string{
+		"-p tcp -m tcp --dport 80 -m statistic --mode random --probability 0.50000000000 -j DNAT --to-destination 10.244.0.10:8080",
+		"-p tcp -m tcp --dport 80 -j DNAT --to-destination 10.244.0.11:8080",
+		"-p udp -m udp --dport 53 -j DNAT --to-destination 10.96.0.10",
+	}) {
+		t.Errorf("wrong DNAT rules - %v", dnats)
+	}
+
+	// Removed endpoint
+	fake.commands = nil
+	SetLocalEndpoints("default/nginx", []LocalEndpoint{
+		{Addr: "10.244.0.10", PortName: "http", Protocol: corev1.ProtocolTCP, Port: 8080},
+	})
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, svc); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if dnats := getDNATs(); !reflect.DeepEqual(dnats, []string{
+		"-p tcp -m tcp --dport 80 -j DNAT --to-destination 10.244.0.10:8080",
+		"-p udp -m udp --dport 53 -j DNAT --to-destination 10.96.0.10",
+	}) {
+		t.Errorf("wrong DNAT rules - %v", dnats)
+	}
+	// Only the entries DNATed to the removed endpoint are deleted
+	if flushed := getConntrackCommands(fake.commands); !reflect.DeepEqual(flushed, []string{
+		"conntrack -D -p 17 --orig-dst 192.168.0.10 --reply-src 10.244.0.11",
+	}) {
+		t.Errorf("wrong conntrack deletes - %v", flushed)
+	}
+
+	// No local endpoint falls back to the clusterIP
+	SetLocalEndpoints("default/nginx", nil)
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, svc); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if dnats := getDNATs(); !reflect.DeepEqual(dnats, []string{"-j DNAT --to-destination 10.96.0.10"}) {
+		t.Errorf("wrong DNAT rules - %v", dnats)
+	}
+}
+
+func TestExternalClusterRejectNoEndpoints(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleExternalClusterRejectNoEndpoints, "true")
+	defer os.Unsetenv(configs.EnvRuleExternalClusterRejectNoEndpoints)
+	defer SetNoEndpoints("default/nginx", false)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"192.168.0.10"},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53},
+			},
+		},
+	}
+
+	// No endpoints replaces DNAT rules with reject rules
+	SetNoEndpoints("default/nginx", true)
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	svcChain := getServiceChainExternalCluster("default/nginx")
+	if rules := fake.rules["iptables nat "+ChainNATExternalClusterPrerouting]; len(rules) != 1 || fake.chains["iptables nat "+svcChain] {
+		t.Errorf("DNAT rules remain - %v", rules)
+	}
+	if rules := fake.rules["iptables filter "+ChainFilterExternalClusterReject]; !reflect.DeepEqual(rules, []string{
+		"-A NMANAGER_EX_CLUS_REJECT -m comment --comment default/nginx -d 192.168.0.10/32 -p tcp -m tcp --dport 80 -j REJECT --reject-with tcp-reset",
+		"-A NMANAGER_EX_CLUS_REJECT -m comment --comment default/nginx -d 192.168.0.10/32 -p udp -m udp --dport 53 -j REJECT --reject-with icmp-port-unreachable",
+	}) {
+		t.Errorf("wrong reject rules - %v", rules)
+	}
+	for chain, jump := range map[string]string{
+		ChainBaseInput:   "-A NMANAGER_INPUT -s 10.244.0.0/16 -j NMANAGER_EX_CLUS_REJECT",
+		ChainBaseForward: "-A NMANAGER_FORWARD -s 10.244.0.0/16 -j NMANAGER_EX_CLUS_REJECT",
+		ChainBaseOutput:  "-A NMANAGER_OUTPUT -m addrtype --src-type LOCAL -j NMANAGER_EX_CLUS_REJECT",
+	} {
+		if rules := fake.rules["iptables filter "+chain]; !reflect.DeepEqual(rules, []string{jump}) {
+			t.Errorf("wrong jump rules to reject chain in %s - %v", chain, rules)
+		}
+	}
+
+	// Endpoints return
+	SetNoEndpoints("default/nginx", false)
+	if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, svc); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if rules := fake.rules["iptables nat "+ChainNATExternalClusterPrerouting]; len(rules) != 2 {
+		t.Errorf("wrong dispatch rules - %v", rules)
+	}
+	if rules := fake.rules["iptables nat "+svcChain]; len(rules) != 1 {
+		t.Errorf("wrong DNAT rules - %v", rules)
+	}
+	if rules := fake.rules["iptables filter "+ChainFilterExternalClusterReject]; len(rules) != 0 {
+		t.Errorf("reject rules remain - %v", rules)
+	}
+
+	// Disabling the reject config removes the chain
+	os.Unsetenv(configs.EnvRuleExternalClusterRejectNoEndpoints)
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if fake.chains["iptables filter "+ChainFilterExternalClusterReject] {
+		t.Errorf("reject chain remains")
+	}
+}
+
+func TestExternalClusterRejectSrcs(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleExternalClusterRejectNoEndpoints, "true")
+	os.Setenv(configs.EnvRuleExternalClusterSrcCIDRsIPv4, "10.10.0.0/16")
+	os.Setenv(configs.EnvRuleExternalClusterSrcInterfacesIPv4, "virbr0")
+	os.Setenv(configs.EnvRuleExternalClusterOutputExcludeIPv4, "uid:1000")
+	defer os.Unsetenv(configs.EnvRuleExternalClusterRejectNoEndpoints)
+	defer os.Unsetenv(configs.EnvRuleExternalClusterSrcCIDRsIPv4)
+	defer os.Unsetenv(configs.EnvRuleExternalClusterSrcInterfacesIPv4)
+	defer os.Unsetenv(configs.EnvRuleExternalClusterOutputExcludeIPv4)
+	rule := &ruleExternalCluster{}
+	getJumps := func(chain string) []string {
+		result := []string{}
+		for _, rule := range fake.rules["iptables filter "+chain] {
+			if iptables.GetRuleJump(rule) == ChainFilterExternalClusterReject {
+				result = append(result, rule)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	// Only the packets from the DNATed sources jump to the reject chain
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	for _, chain := range []string{ChainBaseInput, ChainBaseForward} {
+		if jumps := getJumps(chain); !reflect.DeepEqual(jumps, []string{
+			"-A " + chain + " -i virbr0 -j NMANAGER_EX_CLUS_REJECT",
+			"-A " + chain + " -s 10.10.0.0/16 -j NMANAGER_EX_CLUS_REJECT",
+			"-A " + chain + " -s 10.244.0.0/16 -j NMANAGER_EX_CLUS_REJECT",
+		}) {
+			t.Errorf("wrong jump rules in %s - %v", chain, jumps)
+		}
+	}
+	if jumps := getJumps(ChainBaseOutput); !reflect.DeepEqual(jumps, []string{
+		"-A NMANAGER_OUTPUT -m addrtype --src-type LOCAL -m owner ! --uid-owner 1000 -j NMANAGER_EX_CLUS_REJECT",
+	}) {
+		t.Errorf("wrong jump rules in output - %v", jumps)
+	}
+	desired, installed := []string{}, []string{}
+	for _, r := range rule.Desired(familyIPv4, &corev1.ServiceList{}) {
+		if rule := iptables.MakeRule(r.Chain, "", r.Rule...); r.Table == iptables.TableFilter && iptables.GetRuleJump(rule) == ChainFilterExternalClusterReject {
+			desired = append(desired, iptables.GetRuleKey(rule))
+		}
+	}
+	for _, chain := range []string{ChainBaseInput, ChainBaseForward, ChainBaseOutput} {
+		for _, rule := range getJumps(chain) {
+			installed = append(installed, iptables.GetRuleKey(rule))
+		}
+	}
+	sort.Strings(desired)
+	sort.Strings(installed)
+	if !reflect.DeepEqual(desired, installed) {
+		t.Errorf("wrong desired jump rules - %v", desired)
+	}
+
+	// The jump rules of the removed sources and owners are deleted
+	os.Unsetenv(configs.EnvRuleExternalClusterSrcCIDRsIPv4)
+	os.Unsetenv(configs.EnvRuleExternalClusterSrcInterfacesIPv4)
+	os.Unsetenv(configs.EnvRuleExternalClusterOutputExcludeIPv4)
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if jumps := getJumps(ChainBaseForward); !reflect.DeepEqual(jumps, []string{"-A NMANAGER_FORWARD -s 10.244.0.0/16 -j NMANAGER_EX_CLUS_REJECT"}) {
+		t.Errorf("stale jump rules remain - %v", jumps)
+	}
+	if jumps := getJumps(ChainBaseOutput); !reflect.DeepEqual(jumps, []string{"-A NMANAGER_OUTPUT -m addrtype --src-type LOCAL -j NMANAGER_EX_CLUS_REJECT"}) {
+		t.Errorf("stale jump rules remain - %v", jumps)
+	}
+
+	// Cleanup deletes the jump rules regardless of the source configs
+	if err := rule.Cleanup(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	for _, chain := range []string{ChainBaseInput, ChainBaseForward, ChainBaseOutput} {
+		if jumps := getJumps(chain); len(jumps) != 0 {
+			t.Errorf("jump rules remain in %s - %v", chain, jumps)
+		}
+	}
+}
+
+func TestExternalClusterReconcileOwnChain(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	rule := &ruleExternalCluster{}
+	if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	newSvc := func(name, clusterIP, externalIP string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       corev1.ServiceSpec{ClusterIP: clusterIP, ExternalIPs: []string{externalIP}},
+		}
+	}
+	reconcile := func(svc, oldSvc *corev1.Service) {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: svc.Name}}
+		if err := rule.Reconcile(log.NullLogger{}, familyIPv4, req, svc, oldSvc); err != nil {
+			t.Fatalf("failed to reconcile : %v", err)
+		}
+	}
+	nginx := newSvc("nginx", "10.96.0.10", "192.168.0.10")
+	reconcile(nginx, nil)
+	reconcile(newSvc("redis", "10.96.0.20", "192.168.0.20"), nil)
+	initSaves := func() int {
+		fake.saves = 0
+		if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+			t.Fatalf("failed to init : %v", err)
+		}
+		return fake.saves
+	}
+	saves := initSaves()
+
+	// A stale mark rule in the chain of other service is deleted by Init, not by reconciling a service
+	redisChain := getServiceChainExternalCluster("default/redis")
+	stale := "-A " + redisChain + " -j " + ChainNATKubeMarkMasq
+	fake.rules["iptables nat "+redisChain] = append(fake.rules["iptables nat "+redisChain], stale)
+	fake.commands = nil
+	newNginx := nginx.DeepCopy()
+	newNginx.Spec.ClusterIP = "10.96.0.30"
+	reconcile(newNginx, nginx)
+	for _, command := range fake.commands {
+		if strings.Contains(command, redisChain) || strings.Contains(command, ChainNATMarkMasq+" ") {
+			t.Errorf("other chain is changed by reconciling service - %s", command)
+		}
+	}
+	if !containsString(fake.rules["iptables nat "+redisChain], stale) {
+		t.Errorf("stale mark rule is deleted by reconciling service")
+	}
+
+	// Init gets the rules of nat table once regardless of the number of services
+	for i := 0; i < 3; i++ {
+		reconcile(newSvc("svc"+strconv.Itoa(i), "10.96.1."+strconv.Itoa(i), "192.168.1."+strconv.Itoa(i)), nil)
+	}
+	if n := initSaves(); n != saves {
+		t.Errorf("iptables-save runs of init depend on services - %d %d", saves, n)
+	}
+	if containsString(fake.rules["iptables nat "+redisChain], stale) {
+		t.Errorf("stale mark rule isn't deleted by init")
+	}
+}
@@ -0,0 +1,188 @@
+package rules
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+)
+
+// Vars
+var (
+	// Disallowed externalIPs of each service
+	externalIPDisallowed = map[string][]string{}
+	externalIPLock       = &sync.Mutex{}
+)
+
+// ruleExternalIPAllowlist prevents kube-proxy from DNATing packets to the externalIPs not allowed (CVE-2020-8554)
+type ruleExternalIPAllowlist struct{}
+
+func init() {
+	Register(&ruleExternalIPAllowlist{})
+}
+
+func (r *ruleExternalIPAllowlist) Name() string {
+	return FeatureExternalIPAllowlist
+}
+
+func (r *ruleExternalIPAllowlist) ConfigKey() string {
+	return configs.EnvRuleExternalIPAllowlistEnable
+}
+
+func (r *ruleExternalIPAllowlist) DefaultEnabled(mode proxymode.Mode) bool {
+	return false
+}
+
+// SupportedMode returns false for IPVS mode. IPVS handles the externalIPs bound to the node
+// in INPUT and OUTPUT hooks, so the ACCEPT rules in nat table can't stop it.
+func (r *ruleExternalIPAllowlist) SupportedMode(mode proxymode.Mode) bool {
+	return mode != proxymode.ModeIPVS
+}
+
+func (r *ruleExternalIPAllowlist) Chains() []string {
+	return []string{ChainNATExternalIPBlockPrerouting, ChainNATExternalIPBlockOutput}
+}
+
+func (r *ruleExternalIPAllowlist) Init(logger logr.Logger, family *Family) error {
+	// Lock
+	externalIPLock.Lock()
+	defer externalIPLock.Unlock()
+
+	// Check configs
+	if _, err := configs.GetConfigRuleExternalIPAllowedCIDRs(); err != nil {
+		logger.Error(err, "failed to get externalIP allowlist config")
+		return err
+	}
+	if _, err := configs.GetConfigRuleExternalIPApprovedServices(); err != nil {
+		logger.Error(err, "failed to get externalIP approved services config")
+		return err
+	}
+
+	return initExternalIPAllowlist(logger, family)
+}
+
+func (r *ruleExternalIPAllowlist) Cleanup(logger logr.Logger, family *Family) error {
+	if err := cleanupChain(logger, family, iptables.TableNAT, ChainBasePrerouting, ChainNATExternalIPBlockPrerouting); err != nil {
+		return err
+	}
+	return cleanupChain(logger, family, iptables.TableNAT, ChainBaseOutput, ChainNATExternalIPBlockOutput)
+}
+
+func (r *ruleExternalIPAllowlist) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	// Lock
+	externalIPLock.Lock()
+	defer externalIPLock.Unlock()
+
+	externalIPDisallowed = getExternalIPDisallowedMap(svcs)
+	return initExternalIPAllowlist(logger, family)
+}
+
+func (r *ruleExternalIPAllowlist) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	// Lock
+	externalIPLock.Lock()
+	defer externalIPLock.Unlock()
+
+	// Update disallowed externalIPs of the service
+	var ips []string
+	if svc != nil {
+		ips = GetDisallowedExternalIPs(svc)
+	}
+	if len(ips) == 0 {
+		delete(externalIPDisallowed, req.String())
+	} else {
+		externalIPDisallowed[req.String()] = ips
+	}
+
+	return initExternalIPAllowlist(logger, family)
+}
+
+func (r *ruleExternalIPAllowlist) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	rules := getRulesExternalIPAllowlist(family, getExternalIPDisallowedMap(svcs))
+	return append(getChainRuleSpecs(iptables.TableNAT, ChainBasePrerouting, ChainNATExternalIPBlockPrerouting, rules),
+		getChainRuleSpecs(iptables.TableNAT, ChainBaseOutput, ChainNATExternalIPBlockOutput, rules)...)
+}
+
+// IsExternalIPAllowed returns whether the externalIP of the service is honoured. If the externalIP allowlist
+// rule is disabled, all externalIPs are allowed. Load balancer ingress IPs are always allowed.
+// Approval depends only on the configs of network-node-manager, not on the service which its author controls.
+func IsExternalIPAllowed(svc *corev1.Service, externalIP string) bool {
+	enabled, err := configs.GetConfigRuleExternalIPAllowlistEnabled()
+	if err != nil || !enabled {
+		return true
+	}
+	if !containsString(svc.Spec.ExternalIPs, externalIP) {
+		return true
+	}
+
+	// Configs are checked in Init. If they are wrong, no externalIP is allowed.
+	services, _ := configs.GetConfigRuleExternalIPApprovedServices()
+	if containsString(services, svc.Namespace+"/"+svc.Name) || containsString(services, svc.Namespace+"/*") {
+		return true
+	}
+	cidrs, _ := configs.GetConfigRuleExternalIPAllowedCIDRs()
+	addr := net.ParseIP(externalIP)
+	for _, cidr := range cidrs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && addr != nil && ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDisallowedExternalIPs returns the externalIPs of the service not allowed
+func GetDisallowedExternalIPs(svc *corev1.Service) []string {
+	result := []string{}
+	for _, externalIP := range svc.Spec.ExternalIPs {
+		if !IsExternalIPAllowed(svc, externalIP) {
+			result = append(result, externalIP)
+		}
+	}
+	return result
+}
+
+func getExternalIPDisallowedMap(svcs *corev1.ServiceList) map[string][]string {
+	result := map[string][]string{}
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if ips := GetDisallowedExternalIPs(svc); len(ips) != 0 {
+			result[svc.Namespace+"/"+svc.Name] = ips
+		}
+	}
+	return result
+}
+
+func initExternalIPAllowlist(logger logr.Logger, family *Family) error {
+	// Set the same rules in PREROUTING and OUTPUT chains
+	rules := getRulesExternalIPAllowlist(family, externalIPDisallowed)
+	if err := setChainRules(logger, family, iptables.TableNAT, ChainBasePrerouting, ChainNATExternalIPBlockPrerouting, rules); err != nil {
+		return err
+	}
+	return setChainRules(logger, family, iptables.TableNAT, ChainBaseOutput, ChainNATExternalIPBlockOutput, rules)
+}
+
+// getRulesExternalIPAllowlist returns ACCEPT rules for the disallowed externalIPs of the family in order of services.
+// ACCEPT in nat table stops the nat table traversal before kube-proxy chains, so packets to the externalIPs aren't DNATed.
+func getRulesExternalIPAllowlist(family *Family, disallowed map[string][]string) [][]string {
+	nsNames := []string{}
+	for nsName := range disallowed {
+		nsNames = append(nsNames, nsName)
+	}
+	sort.Strings(nsNames)
+
+	rules := [][]string{}
+	for _, nsName := range nsNames {
+		for _, externalIP := range disallowed[nsName] {
+			if family.IsAddr(externalIP) {
+				rules = append(rules, []string{"-m", "comment", "--comment", nsName, "-d", family.HostCIDR(externalIP), "-j", "ACCEPT"})
+			}
+		}
+	}
+	return rules
+}
@@ -0,0 +1,78 @@
+package rules
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+)
+
+func TestExternalIPAllowlist(t *testing.T) {
+	os.Setenv(configs.EnvRuleExternalIPAllowlistEnable, "true")
+	os.Setenv(configs.EnvRuleExternalIPAllowedCIDRs, "192.168.0.0/24,fd00:192:168::/64")
+	defer os.Unsetenv(configs.EnvRuleExternalIPAllowlistEnable)
+	defer os.Unsetenv(configs.EnvRuleExternalIPAllowedCIDRs)
+	defer func() { externalIPDisallowed = map[string][]string{} }()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"192.168.0.10", "8.8.8.8", "fd00:192:168::10", "2001:4860:4860::8888"},
+		},
+	}
+	if ips := GetDisallowedExternalIPs(svc); !reflect.DeepEqual(ips, []string{"8.8.8.8", "2001:4860:4860::8888"}) {
+		t.Errorf("wrong disallowed externalIPs - %v", ips)
+	}
+
+	// Only the operator approves services. The annotation of the service is ignored.
+	annotatedSvc := svc.DeepCopy()
+	annotatedSvc.Annotations = map[string]string{"network-node-manager.kakaocorp.com/external-ip-approved": "true"}
+	if ips := GetDisallowedExternalIPs(annotatedSvc); len(ips) != 2 {
+		t.Errorf("annotated service is approved - %v", ips)
+	}
+	for _, approved := range []string{"default/nginx", "default/*"} {
+		os.Setenv(configs.EnvRuleExternalIPApprovedServices, "kube-system/*,"+approved)
+		if ips := GetDisallowedExternalIPs(svc); len(ips) != 0 {
+			t.Errorf("approved service by %s has disallowed externalIPs - %v", approved, ips)
+		}
+	}
+	os.Setenv(configs.EnvRuleExternalIPApprovedServices, "default/apache,kube-system/*")
+	if ips := GetDisallowedExternalIPs(svc); len(ips) != 2 {
+		t.Errorf("service is approved by other services - %v", ips)
+	}
+	os.Unsetenv(configs.EnvRuleExternalIPApprovedServices)
+
+	// The externalIP to clusterIP rule ignores the disallowed externalIPs
+	Init("10.244.0.0/16", "")
+	if _, ips := getExternalClusterIPs(familyIPv4, svc); !reflect.DeepEqual(ips, []string{"192.168.0.10"}) {
+		t.Errorf("wrong externalIPs for externalIP to clusterIP rule - %v", ips)
+	}
+
+	// Set and remove ACCEPT rules for the service
+	fake := setFakeIptables(t)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	if err := (&ruleExternalIPAllowlist{}).Reconcile(log.NullLogger{}, familyIPv4, req, svc, nil); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	for _, chain := range []string{ChainNATExternalIPBlockPrerouting, ChainNATExternalIPBlockOutput} {
+		expected := "-A " + chain + " -m comment --comment default/nginx -d 8.8.8.8/32 -j ACCEPT"
+		if rules := fake.rules["iptables nat "+chain]; strings.Join(rules, "\n") != expected {
+			t.Errorf("wrong rules of %s - %v", chain, rules)
+		}
+	}
+	if err := (&ruleExternalIPAllowlist{}).Reconcile(log.NullLogger{}, familyIPv4, req, nil, svc); err != nil {
+		t.Fatalf("failed to reconcile : %v", err)
+	}
+	if rules := fake.rules["iptables nat "+ChainNATExternalIPBlockPrerouting]; len(rules) != 0 {
+		t.Errorf("rules remain after deleting service - %v", rules)
+	}
+}
@@ -0,0 +1,103 @@
+package rules
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+)
+
+// ruleMasquerade masquerades packets from pods except to the non-masquerade CIDRs like ip-masq-agent
+type ruleMasquerade struct{}
+
+func init() {
+	Register(&ruleMasquerade{})
+}
+
+func (r *ruleMasquerade) Name() string {
+	return FeatureMasquerade
+}
+
+func (r *ruleMasquerade) ConfigKey() string {
+	return configs.EnvRuleMasqEnable
+}
+
+func (r *ruleMasquerade) DefaultEnabled(mode proxymode.Mode) bool {
+	return false
+}
+
+func (r *ruleMasquerade) Chains() []string {
+	return []string{ChainNATMasquerade}
+}
+
+// Init sets the rules. It's called periodically, so that the changed config file is reloaded.
+func (r *ruleMasquerade) Init(logger logr.Logger, family *Family) error {
+	// Set masquerade rules
+	rules, err := r.getRules(family)
+	if err != nil {
+		logger.Error(err, "failed to get masquerade rules")
+		return err
+	}
+	return setChainRules(logger, family, iptables.TableNAT, ChainBasePostrouting, ChainNATMasquerade, rules)
+}
+
+func (r *ruleMasquerade) Cleanup(logger logr.Logger, family *Family) error {
+	return cleanupChain(logger, family, iptables.TableNAT, ChainBasePostrouting, ChainNATMasquerade)
+}
+
+func (r *ruleMasquerade) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	return nil
+}
+
+func (r *ruleMasquerade) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	return nil
+}
+
+// Desired returns the rules without the masquerade rules if the configs are wrong. Init reports the wrong configs.
+func (r *ruleMasquerade) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	rules, _ := r.getRules(family)
+	return getChainRuleSpecs(iptables.TableNAT, ChainBasePostrouting, ChainNATMasquerade, rules)
+}
+
+// getRules returns RETURN rules for the non-masquerade CIDRs and the masquerade rule for the others from the pod CIDR
+func (r *ruleMasquerade) getRules(family *Family) ([][]string, error) {
+	cidrs, err := getNonMasqCIDRs(family)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := [][]string{}
+	for _, cidr := range cidrs {
+		rules = append(rules, []string{"-d", cidr, "-j", "RETURN"})
+	}
+	rules = append(rules, []string{"-s", family.PodCIDR, "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "MASQUERADE"})
+	return rules, nil
+}
+
+// getNonMasqCIDRs returns the non-masquerade CIDRs of the family in the config file, or in the config of the family.
+// If no CIDR is set for the family, it returns the pod CIDR.
+func getNonMasqCIDRs(family *Family) ([]string, error) {
+	cidrs, ok, err := configs.GetConfigRuleMasqFileNonMasqCIDRs()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if family.IPFamily == corev1.IPv6Protocol {
+			cidrs, err = configs.GetConfigRuleMasqNonMasqCIDRsIPv6()
+		} else {
+			cidrs, err = configs.GetConfigRuleMasqNonMasqCIDRsIPv4()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cidrs = filterCIDRs(family, cidrs)
+	if len(cidrs) == 0 {
+		cidrs = []string{family.PodCIDR}
+	}
+	return cidrs, nil
+}
@@ -0,0 +1,70 @@
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+)
+
+func TestMasqueradeGetRules(t *testing.T) {
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	r := &ruleMasquerade{}
+
+	// Default to the pod CIDR
+	rules, err := r.getRules(familyIPv6)
+	if err != nil || len(rules) != 2 || strings.Join(rules[0], " ") != "-d fd00:10:244::/64 -j RETURN" {
+		t.Errorf("wrong default rules - %v %v", rules, err)
+	}
+
+	// Config of the family
+	os.Setenv(configs.EnvRuleMasqNonMasqCIDRsIPv4, "10.0.0.0/8,172.16.0.0/12")
+	defer os.Unsetenv(configs.EnvRuleMasqNonMasqCIDRsIPv4)
+	rules, err = r.getRules(familyIPv4)
+	if err != nil || len(rules) != 3 || strings.Join(rules[1], " ") != "-d 172.16.0.0/12 -j RETURN" ||
+		strings.Join(rules[2], " ") != "-s 10.244.0.0/16 -m addrtype ! --dst-type LOCAL -j MASQUERADE" {
+		t.Errorf("wrong rules - %v %v", rules, err)
+	}
+}
+
+func TestMasqueradeReloadConfigFile(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	r := &ruleMasquerade{}
+	fake := setFakeIptables(t)
+
+	dir, err := ioutil.TempDir("", "masq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	os.Setenv(configs.EnvRuleMasqConfigFile, path)
+	defer os.Unsetenv(configs.EnvRuleMasqConfigFile)
+
+	// Set rules and reload the changed config file
+	for _, config := range []string{"nonMasqueradeCIDRs:\n  - 10.0.0.0/8\n", "nonMasqueradeCIDRs:\n  - 10.0.0.0/8\n  - 192.168.0.0/16\n  - fd00::/8\n"} {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+			t.Fatalf("failed to init : %v", err)
+		}
+	}
+	rules := fake.rules["iptables nat "+ChainNATMasquerade]
+	if len(rules) != 3 || !strings.Contains(rules[1], "192.168.0.0/16") {
+		t.Errorf("wrong rules after reloading - %v", rules)
+	}
+
+	// Wrong config file
+	if err := ioutil.WriteFile(path, []byte("nonMasqueradeCIDRs: [wrong]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Init(log.NullLogger{}, familyIPv4); err == nil {
+		t.Errorf("no error with wrong config file")
+	}
+}
@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+)
+
+// Vars
+var (
+	nodeLocalDNSProtocols = []string{"udp", "tcp"}
+)
+
+// ruleNodeLocalDNS makes DNS packets between pods and node-local DNS bypass conntrack
+// to avoid DNS timeouts caused by conntrack insertion races
+type ruleNodeLocalDNS struct{}
+
+// nodeLocalDNSChain is a chain of the rule with the direction of DNS packets
+type nodeLocalDNSChain struct {
+	table     iptables.Table
+	baseChain string
+	chain     string
+	addrOpt   string
+	portOpt   string
+	target    []string
+}
+
+func init() {
+	Register(&ruleNodeLocalDNS{})
+}
+
+func (r *ruleNodeLocalDNS) Name() string {
+	return FeatureNodeLocalDNS
+}
+
+func (r *ruleNodeLocalDNS) ConfigKey() string {
+	return configs.EnvRuleNodeLocalDNSEnable
+}
+
+func (r *ruleNodeLocalDNS) DefaultEnabled(mode proxymode.Mode) bool {
+	return false
+}
+
+func (r *ruleNodeLocalDNS) Chains() []string {
+	return []string{ChainRawNodeLocalDNSPrerouting, ChainRawNodeLocalDNSOutput, ChainFilterNodeLocalDNSInput, ChainFilterNodeLocalDNSOutput}
+}
+
+func (r *ruleNodeLocalDNS) Init(logger logr.Logger, family *Family) error {
+	// Set NOTRACK and ACCEPT rules
+	for _, c := range getNodeLocalDNSChains() {
+		rules, err := c.getRules(family)
+		if err != nil {
+			logger.Error(err, "failed to get node-local DNS rules")
+			return err
+		}
+		if err := setChainRules(logger, family, c.table, c.baseChain, c.chain, rules); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *ruleNodeLocalDNS) Cleanup(logger logr.Logger, family *Family) error {
+	for _, c := range getNodeLocalDNSChains() {
+		if err := cleanupChain(logger, family, c.table, c.baseChain, c.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ruleNodeLocalDNS) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	return nil
+}
+
+func (r *ruleNodeLocalDNS) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	return nil
+}
+
+// Desired returns the rules without NOTRACK and ACCEPT rules if the configs are wrong. Init reports the wrong configs.
+func (r *ruleNodeLocalDNS) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	result := []RuleSpec{}
+	for _, c := range getNodeLocalDNSChains() {
+		rules, _ := c.getRules(family)
+		result = append(result, getChainRuleSpecs(c.table, c.baseChain, c.chain, rules)...)
+	}
+	return result
+}
+
+// getNodeLocalDNSChains returns the chains for queries to node-local DNS and responses from it.
+// NOTRACK target is written as "CT --notrack" because iptables-save prints the alias so.
+func getNodeLocalDNSChains() []nodeLocalDNSChain {
+	notrack := []string{"CT", "--notrack"}
+	accept := []string{"ACCEPT"}
+	return []nodeLocalDNSChain{
+		{iptables.TableRaw, ChainBasePrerouting, ChainRawNodeLocalDNSPrerouting, "-d", "--dport", notrack},
+		{iptables.TableRaw, ChainBaseOutput, ChainRawNodeLocalDNSOutput, "-s", "--sport", notrack},
+		{iptables.TableFilter, ChainBaseInput, ChainFilterNodeLocalDNSInput, "-d", "--dport", accept},
+		{iptables.TableFilter, ChainBaseOutput, ChainFilterNodeLocalDNSOutput, "-s", "--sport", accept},
+	}
+}
+
+// getRules returns the rules in the chain for the node-local DNS addresses of the family
+func (c nodeLocalDNSChain) getRules(family *Family) ([][]string, error) {
+	addrs, err := configs.GetConfigRuleNodeLocalDNSAddrs()
+	if err != nil {
+		return nil, err
+	}
+	port, err := configs.GetConfigRuleNodeLocalDNSPort()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := [][]string{}
+	for _, addr := range addrs {
+		if !family.IsAddr(addr) {
+			continue
+		}
+		for _, protocol := range nodeLocalDNSProtocols {
+			rules = append(rules, concatArgs([]string{c.addrOpt, family.HostCIDR(addr), "-p", protocol, "-m", protocol, c.portOpt, strconv.Itoa(port), "-j"}, c.target))
+		}
+	}
+	return rules, nil
+}
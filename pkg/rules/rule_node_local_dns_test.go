@@ -0,0 +1,124 @@
+package rules
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+)
+
+// savedNodeLocalDNS is the rules of the default configs as iptables-save prints
+var savedNodeLocalDNS = map[string][]string{
+	"iptables raw " + ChainRawNodeLocalDNSPrerouting: {
+		"-A NMANAGER_DNS_NOTRACK_PREROUTING -d 169.254.20.10/32 -p udp -m udp --dport 53 -j CT --notrack",
+		"-A NMANAGER_DNS_NOTRACK_PREROUTING -d 169.254.20.10/32 -p tcp -m tcp --dport 53 -j CT --notrack",
+	},
+	"iptables raw " + ChainRawNodeLocalDNSOutput: {
+		"-A NMANAGER_DNS_NOTRACK_OUTPUT -s 169.254.20.10/32 -p udp -m udp --sport 53 -j CT --notrack",
+		"-A NMANAGER_DNS_NOTRACK_OUTPUT -s 169.254.20.10/32 -p tcp -m tcp --sport 53 -j CT --notrack",
+	},
+	"iptables filter " + ChainFilterNodeLocalDNSInput: {
+		"-A NMANAGER_DNS_ACCEPT_INPUT -d 169.254.20.10/32 -p udp -m udp --dport 53 -j ACCEPT",
+		"-A NMANAGER_DNS_ACCEPT_INPUT -d 169.254.20.10/32 -p tcp -m tcp --dport 53 -j ACCEPT",
+	},
+	"iptables filter " + ChainFilterNodeLocalDNSOutput: {
+		"-A NMANAGER_DNS_ACCEPT_OUTPUT -s 169.254.20.10/32 -p udp -m udp --sport 53 -j ACCEPT",
+		"-A NMANAGER_DNS_ACCEPT_OUTPUT -s 169.254.20.10/32 -p tcp -m tcp --sport 53 -j ACCEPT",
+	},
+}
+
+func TestNodeLocalDNSGetRules(t *testing.T) {
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	for _, c := range getNodeLocalDNSChains() {
+		rules, err := c.getRules(familyIPv4)
+		if err != nil || !isSameRules(savedNodeLocalDNS["iptables "+string(c.table)+" "+c.chain], c.chain, rules) {
+			t.Errorf("wrong rules of %s - %v %v", c.chain, rules, err)
+		}
+
+		// No address of the family
+		if rules, err := c.getRules(familyIPv6); err != nil || len(rules) != 0 {
+			t.Errorf("wrong IPv6 rules of %s - %v %v", c.chain, rules, err)
+		}
+	}
+
+	os.Setenv(configs.EnvRuleNodeLocalDNSAddrs, "wrong")
+	defer os.Unsetenv(configs.EnvRuleNodeLocalDNSAddrs)
+	if _, err := getNodeLocalDNSChains()[0].getRules(familyIPv4); err == nil {
+		t.Errorf("no error for wrong config")
+	}
+}
+
+func TestNodeLocalDNSInitSaved(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	r := &ruleNodeLocalDNS{}
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+
+	// The rules in the node as iptables-save prints aren't flushed and set again
+	for key, rules := range savedNodeLocalDNS {
+		fake.rules[key] = rules
+	}
+	fake.commands = nil
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	for _, command := range fake.commands {
+		if strings.Contains(command, "-F") || strings.Contains(command, "-A") {
+			t.Errorf("rules are set again - %s", command)
+		}
+	}
+}
+
+func TestNodeLocalDNSBaseChains(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	isRawUsed := func() bool {
+		for key := range fake.chains {
+			if strings.HasPrefix(key, "iptables raw ") {
+				return true
+			}
+		}
+		return len(fake.rules["iptables raw "+ChainPrerouting]) != 0 || len(fake.rules["iptables raw "+ChainOutput]) != 0
+	}
+
+	// Raw table isn't used by other rules
+	for _, rule := range GetRules() {
+		if rule.Name() == FeatureNodeLocalDNS {
+			continue
+		}
+		if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+			t.Fatalf("failed to init %s : %v", rule.Name(), err)
+		}
+	}
+	if isRawUsed() {
+		t.Errorf("raw table is used without node-local DNS rule - %v", fake.chains)
+	}
+
+	// The jumps to raw base chains are set with the rule
+	r := &ruleNodeLocalDNS{}
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	for _, chain := range []string{ChainPrerouting, ChainOutput} {
+		if rules := fake.rules["iptables raw "+chain]; !reflect.DeepEqual(rules, []string{"-A " + chain + " -j " + ChainPrefix + chain}) {
+			t.Errorf("wrong jump rules of %s - %v", chain, rules)
+		}
+	}
+
+	// The raw base chains are deleted after the rule is disabled
+	if err := r.Cleanup(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	if err := CleanupBaseChains(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to cleanup base chains : %v", err)
+	}
+	if isRawUsed() {
+		t.Errorf("raw table is used after cleanup - %v %v", fake.chains, fake.rules)
+	}
+}
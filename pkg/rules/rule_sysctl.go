@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/sysctl"
+)
+
+// Vars
+var (
+	sysctlLock = &sync.Mutex{}
+)
+
+// ruleSysctl sets the configured kernel parameters of the node and restores the original values on cleanup.
+// Kernel parameters aren't per family, so the same params are applied for each family.
+type ruleSysctl struct{}
+
+func init() {
+	Register(&ruleSysctl{})
+}
+
+func (r *ruleSysctl) Name() string {
+	return FeatureSysctl
+}
+
+func (r *ruleSysctl) ConfigKey() string {
+	return configs.EnvRuleSysctlEnable
+}
+
+func (r *ruleSysctl) DefaultEnabled(mode proxymode.Mode) bool {
+	return false
+}
+
+func (r *ruleSysctl) Chains() []string {
+	return []string{}
+}
+
+func (r *ruleSysctl) Init(logger logr.Logger, family *Family) error {
+	// Lock
+	sysctlLock.Lock()
+	defer sysctlLock.Unlock()
+
+	// Get configs
+	params, err := configs.GetConfigRuleSysctlParams()
+	if err != nil {
+		logger.Error(err, "failed to get sysctl config")
+		return err
+	}
+	if err := sysctl.CheckWritable(params); err != nil {
+		logger.Error(err, "failed to check sysctl params")
+		return err
+	}
+	stateFile := configs.GetConfigRuleSysctlStateFile()
+	state, err := sysctl.LoadState(stateFile)
+	if err != nil {
+		logger.Error(err, "failed to load sysctl state", "file", stateFile)
+		return err
+	}
+
+	// Apply params and save the original values even if some params fail
+	changes, err := sysctl.Apply(params, state)
+	logSysctlChanges(logger, changes)
+	if err := sysctl.SaveState(stateFile, state); err != nil {
+		logger.Error(err, "failed to save sysctl state", "file", stateFile)
+		return err
+	}
+	if err != nil {
+		logger.Error(err, "failed to apply sysctl")
+		return err
+	}
+	return nil
+}
+
+func (r *ruleSysctl) Cleanup(logger logr.Logger, family *Family) error {
+	// Lock
+	sysctlLock.Lock()
+	defer sysctlLock.Unlock()
+
+	return restoreSysctl(logger)
+}
+
+func (r *ruleSysctl) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	return nil
+}
+
+func (r *ruleSysctl) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	return nil
+}
+
+// Desired returns nothing because the rule doesn't set iptables rules
+func (r *ruleSysctl) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	return []RuleSpec{}
+}
+
+// restoreSysctl restores the kernel parameters recorded in the state file. It should be called within lock.
+func restoreSysctl(logger logr.Logger) error {
+	stateFile := configs.GetConfigRuleSysctlStateFile()
+	state, err := sysctl.LoadState(stateFile)
+	if err != nil {
+		logger.Error(err, "failed to load sysctl state", "file", stateFile)
+		return err
+	}
+
+	changes, err := sysctl.Restore(state)
+	logSysctlChanges(logger, changes)
+	if err := sysctl.SaveState(stateFile, state); err != nil {
+		logger.Error(err, "failed to save sysctl state", "file", stateFile)
+		return err
+	}
+	if err != nil {
+		logger.Error(err, "failed to restore sysctl")
+		return err
+	}
+	return nil
+}
+
+func logSysctlChanges(logger logr.Logger, changes []sysctl.Change) {
+	for _, change := range changes {
+		logger.Info("set sysctl", "name", change.Name, "value", change.To, "previous", change.From)
+	}
+}
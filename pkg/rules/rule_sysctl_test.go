@@ -0,0 +1,50 @@
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/sysctl"
+)
+
+func TestSysctlInitAndCleanup(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	setFakeIptables(t)
+	root := t.TempDir()
+	prev := sysctl.SetRoot(root)
+	defer sysctl.SetRoot(prev)
+	path := filepath.Join(root, "net", "ipv4", "conf", "all", "rp_filter")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(configs.EnvRuleSysctlParams, "net.ipv4.conf.all.rp_filter=0")
+	defer os.Unsetenv(configs.EnvRuleSysctlParams)
+
+	// Init sets the param and records the original value in the state file
+	if err := (&ruleSysctl{}).Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if value, _ := sysctl.Get("net.ipv4.conf.all.rp_filter"); value != "0" {
+		t.Errorf("wrong value after init - %s", value)
+	}
+	state, err := sysctl.LoadState(configs.GetConfigRuleSysctlStateFile())
+	if err != nil || state.Originals["net.ipv4.conf.all.rp_filter"] != "1" {
+		t.Errorf("wrong state - %v %v", state, err)
+	}
+
+	// Cleanup restores the original value from the state file
+	if err := CleanupRulesAll(log.NullLogger{}); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	if value, _ := sysctl.Get("net.ipv4.conf.all.rp_filter"); value != "1" {
+		t.Errorf("wrong value after cleanup - %s", value)
+	}
+}
@@ -0,0 +1,81 @@
+package rules
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+)
+
+// ruleTCPMSSClamp clamps the MSS of TCP SYN packets from pods in FORWARD chain of mangle table
+// to avoid PMTU blackholes of overlay networks
+type ruleTCPMSSClamp struct{}
+
+func init() {
+	Register(&ruleTCPMSSClamp{})
+}
+
+func (r *ruleTCPMSSClamp) Name() string {
+	return FeatureTCPMSSClamp
+}
+
+func (r *ruleTCPMSSClamp) ConfigKey() string {
+	return configs.EnvRuleTCPMSSClampEnable
+}
+
+func (r *ruleTCPMSSClamp) DefaultEnabled(mode proxymode.Mode) bool {
+	return false
+}
+
+func (r *ruleTCPMSSClamp) Chains() []string {
+	return []string{ChainMangleTCPMSSClamp}
+}
+
+func (r *ruleTCPMSSClamp) Init(logger logr.Logger, family *Family) error {
+	// Set clamp rule
+	rules, err := r.getRules(family)
+	if err != nil {
+		logger.Error(err, "failed to get TCP MSS clamp rules")
+		return err
+	}
+	return setChainRules(logger, family, iptables.TableMangle, ChainBaseForward, ChainMangleTCPMSSClamp, rules)
+}
+
+func (r *ruleTCPMSSClamp) Cleanup(logger logr.Logger, family *Family) error {
+	return cleanupChain(logger, family, iptables.TableMangle, ChainBaseForward, ChainMangleTCPMSSClamp)
+}
+
+func (r *ruleTCPMSSClamp) Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error {
+	return nil
+}
+
+func (r *ruleTCPMSSClamp) Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error {
+	return nil
+}
+
+// Desired returns the rules without the clamp rule if the configs are wrong. Init reports the wrong configs.
+func (r *ruleTCPMSSClamp) Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec {
+	rules, _ := r.getRules(family)
+	return getChainRuleSpecs(iptables.TableMangle, ChainBaseForward, ChainMangleTCPMSSClamp, rules)
+}
+
+// getRules returns the clamp rule for TCP SYN packets from the pod CIDR
+func (r *ruleTCPMSSClamp) getRules(family *Family) ([][]string, error) {
+	mss, err := configs.GetConfigRuleTCPMSSClampMSS()
+	if err != nil {
+		return nil, err
+	}
+
+	rule := []string{"-s", family.PodCIDR, "-p", "tcp", "-m", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS"}
+	if mss == 0 {
+		rule = append(rule, "--clamp-mss-to-pmtu")
+	} else {
+		rule = append(rule, "--set-mss", strconv.Itoa(mss))
+	}
+	return [][]string{rule}, nil
+}
@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+)
+
+func TestTCPMSSClampGetRules(t *testing.T) {
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	defer os.Unsetenv(configs.EnvRuleTCPMSSClampMSS)
+	r := &ruleTCPMSSClamp{}
+
+	// Rules as iptables-save prints
+	tests := []struct {
+		config string
+		family *Family
+		saved  string
+	}{
+		{"", familyIPv4, "-A NMANAGER_TCPMSS_CLAMP -s 10.244.0.0/16 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu"},
+		{"pmtu", familyIPv6, "-A NMANAGER_TCPMSS_CLAMP -s fd00:10:244::/64 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu"},
+		{"1400", familyIPv4, "-A NMANAGER_TCPMSS_CLAMP -s 10.244.0.0/16 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1400"},
+	}
+	for _, test := range tests {
+		os.Setenv(configs.EnvRuleTCPMSSClampMSS, test.config)
+		rules, err := r.getRules(test.family)
+		if err != nil || !isSameRules([]string{test.saved}, ChainMangleTCPMSSClamp, rules) {
+			t.Errorf("wrong rules of %s for %s - %v %v", test.config, test.family.Name, rules, err)
+		}
+	}
+
+	os.Setenv(configs.EnvRuleTCPMSSClampMSS, "100")
+	if _, err := r.getRules(familyIPv4); err == nil {
+		t.Errorf("no error for wrong config")
+	}
+}
+
+func TestTCPMSSClampInitSaved(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	os.Setenv(configs.EnvRuleTCPMSSClampMSS, "1400")
+	defer os.Unsetenv(configs.EnvRuleTCPMSSClampMSS)
+	r := &ruleTCPMSSClamp{}
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+
+	// The rule in the node as iptables-save prints isn't set again
+	saved := []string{"-A NMANAGER_TCPMSS_CLAMP -s 10.244.0.0/16 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1400"}
+	fake.rules["iptables mangle "+ChainMangleTCPMSSClamp] = saved
+	fake.commands = nil
+	if err := r.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	for _, command := range fake.commands {
+		if strings.Contains(command, ChainMangleTCPMSSClamp) {
+			t.Errorf("rule is set again - %s", command)
+		}
+	}
+	if rules, _ := familyIPv4.GetRules(iptables.TableMangle, ChainMangleTCPMSSClamp); !reflect.DeepEqual(rules, saved) {
+		t.Errorf("wrong rules - %v", rules)
+	}
+}
@@ -1,120 +1,540 @@
 package rules
 
 import (
-	"github.com/go-logr/logr"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
 
-	"github.com/kakao/network-node-manager/pkg/ip"
+	"github.com/go-logr/logr"
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/ipset"
 	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
 )
 
 // Constants
 const (
-	ChainInput      = "INPUT"
-	ChainPrerouting = "PREROUTING"
-	ChainOutput     = "OUTPUT"
+	ChainInput       = "INPUT"
+	ChainPrerouting  = "PREROUTING"
+	ChainOutput      = "OUTPUT"
+	ChainForward     = "FORWARD"
+	ChainPostrouting = "POSTROUTING"
 
-	ChainBasePrerouting = "NMANAGER_PREROUTING"
-	ChainBaseInput      = "NMANAGER_INPUT"
-	ChainBaseOutput     = "NMANAGER_OUTPUT"
+	ChainPrefix = "NMANAGER_"
+
+	ChainBasePrerouting  = "NMANAGER_PREROUTING"
+	ChainBaseInput       = "NMANAGER_INPUT"
+	ChainBaseOutput      = "NMANAGER_OUTPUT"
+	ChainBaseForward     = "NMANAGER_FORWARD"
+	ChainBasePostrouting = "NMANAGER_POSTROUTING"
 
 	ChainFilterDropInvalidInput       = "NMANAGER_DROP_INVALID_INPUT"
+	ChainFilterDropInvalidForward     = "NMANAGER_DROP_INVALID_FORWARD"
+	ChainMangleTCPMSSClamp            = "NMANAGER_TCPMSS_CLAMP"
+	ChainRawNodeLocalDNSPrerouting    = "NMANAGER_DNS_NOTRACK_PREROUTING"
+	ChainRawNodeLocalDNSOutput        = "NMANAGER_DNS_NOTRACK_OUTPUT"
+	ChainFilterNodeLocalDNSInput      = "NMANAGER_DNS_ACCEPT_INPUT"
+	ChainFilterNodeLocalDNSOutput     = "NMANAGER_DNS_ACCEPT_OUTPUT"
+	ChainNATMasquerade                = "NMANAGER_MASQ"
+	ChainFilterBlockMetadataForward   = "NMANAGER_BLOCK_METADATA_FORWARD"
+	ChainFilterBlockMetadataOutput    = "NMANAGER_BLOCK_METADATA_OUTPUT"
 	ChainNATExternalClusterPrerouting = "NMANAGER_EX_CLUS_PREROUTING"
 	ChainNATExternalClusterOutput     = "NMANAGER_EX_CLUS_OUTPUT"
+	ChainFilterExternalClusterReject  = "NMANAGER_EX_CLUS_REJECT"
+	ChainNATMarkMasq                  = "NMANAGER_MARK_MASQ"
+	ChainNATMarkMasqPostrouting       = "NMANAGER_MARK_MASQ_POSTROUTING"
+	ChainNATExternalIPBlockPrerouting = "NMANAGER_EX_IP_BLOCK_PREROUTING"
+	ChainNATExternalIPBlockOutput     = "NMANAGER_EX_IP_BLOCK_OUTPUT"
+
+	// Prefix of the chains of services for externalIP to clusterIP rules
+	ChainPrefixNATExternalClusterService = "NMANAGER_EX_SVC_"
+
+	// Sets of the externalIPs for externalIP to clusterIP rules
+	SetExternalClusterIPv4 = "NMANAGER_EX_CLUS_IPV4"
+	SetExternalClusterIPv6 = "NMANAGER_EX_CLUS_IPV6"
 
 	ChainNATKubeMarkMasq = "KUBE-MARK-MASQ"
 )
 
+// Rule is a node network configuration managed by network-node-manager.
+// A rule registers itself with Register() in init() of its file.
+type Rule interface {
+	// Name returns the name of the rule used as the feature in logs and rule states
+	Name() string
+	// ConfigKey returns the environment variable to enable the rule
+	ConfigKey() string
+	// DefaultEnabled returns whether the rule is enabled in the kube-proxy mode when the config isn't set
+	DefaultEnabled(mode proxymode.Mode) bool
+	// Chains returns the chains owned by the rule
+	Chains() []string
+
+	// Init creates the chains and the rules not related to services.
+	// It's called at start and periodically to recover deleted rules.
+	Init(logger logr.Logger, family *Family) error
+	// Cleanup removes all the chains and rules of the rule. It's called at start when the rule is disabled.
+	Cleanup(logger logr.Logger, family *Family) error
+	// Sync removes the rules of deleted or changed services with all services. It's called at start.
+	Sync(logger logr.Logger, family *Family, svcs *corev1.ServiceList) error
+	// Reconcile sets the rules of a service. svc is nil when the service is deleted
+	// and oldSvc is the last reconciled service, nil if there is no one.
+	Reconcile(logger logr.Logger, family *Family, req ctrl.Request, svc, oldSvc *corev1.Service) error
+
+	// Desired returns the rules that the rule sets for the services without setting them
+	Desired(family *Family, svcs *corev1.ServiceList) []RuleSpec
+}
+
+// modeRestricted is implemented by the rules which work only in some kube-proxy modes
+type modeRestricted interface {
+	// SupportedMode returns whether the rule works in the kube-proxy mode
+	SupportedMode(mode proxymode.Mode) bool
+}
+
+// RuleSpec is a rule in a chain
+type RuleSpec struct {
+	Table   iptables.Table
+	Chain   string
+	Comment string
+	Rule    []string
+}
+
+// Types
+type chainRule struct {
+	chain string
+	rule  []string
+}
+
 // Vars
 var (
-	podCIDRIPv4 string
-	podCIDRIPv6 string
+	registry []Rule
+
+	// Lock for the pod CIDRs because rules can be set by controllers in parallel
+	familyLock = &sync.RWMutex{}
 )
 
+// Init sets the pod CIDRs of the families
 func Init(cidrIPv4, cidrIPv6 string) {
-	podCIDRIPv4 = cidrIPv4
-	podCIDRIPv6 = cidrIPv6
+	familyLock.Lock()
+	defer familyLock.Unlock()
+
+	familyIPv4.PodCIDR = cidrIPv4
+	familyIPv6.PodCIDR = cidrIPv6
+}
+
+// Register adds the rule to the registry
+func Register(rule Rule) {
+	registry = append(registry, rule)
+}
+
+// GetRules returns all the registered rules
+func GetRules() []Rule {
+	return registry
 }
 
-func initBaseChains(logger logr.Logger) error {
-	// IPv4
-	if ip.IsIPv4CIDR(podCIDRIPv4) {
-		// Create base chain in tables
-		out, err := iptables.CreateChainIPv4(iptables.TableFilter, ChainBaseInput)
+// GetEnabledRules returns the registered rules divided by the configs and the defaults of the kube-proxy mode
+func GetEnabledRules(mode proxymode.Mode) (enabled, disabled []Rule, err error) {
+	for _, rule := range registry {
+		ruleEnabled, err := configs.GetConfigRuleEnabled(rule.ConfigKey(), rule.DefaultEnabled(mode))
 		if err != nil {
-			logger.Error(err, out)
-			return err
+			return nil, nil, err
+		}
+		if ruleEnabled {
+			if restricted, ok := rule.(modeRestricted); ok && !restricted.SupportedMode(mode) {
+				return nil, nil, fmt.Errorf("%s rule isn't supported in %s kube-proxy mode", rule.Name(), mode)
+			}
+			enabled = append(enabled, rule)
+		} else {
+			disabled = append(disabled, rule)
+		}
+	}
+	return enabled, disabled, nil
+}
+
+// GetFamilies returns the IP families whose pod CIDR is set
+func GetFamilies() []*Family {
+	familyLock.RLock()
+	defer familyLock.RUnlock()
+
+	families := []*Family{}
+	for _, family := range []*Family{familyIPv4, familyIPv6} {
+		if family.IsCIDR(family.PodCIDR) {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameRules returns whether the rules of the chain in iptables-save format are the same as the rules in order
+func isSameRules(current []string, chain string, rules [][]string) bool {
+	if len(current) != len(rules) {
+		return false
+	}
+	for i, rule := range rules {
+		if iptables.GetRuleKey(current[i]) != iptables.GetRuleKey(iptables.MakeRule(chain, "", rule...)) {
+			return false
 		}
-		out, err = iptables.CreateChainIPv4(iptables.TableNAT, ChainBasePrerouting)
+	}
+	return true
+}
+
+// filterCIDRs returns the CIDRs of the family
+func filterCIDRs(family *Family, cidrs []string) []string {
+	result := []string{}
+	for _, cidr := range cidrs {
+		if family.IsCIDR(cidr) {
+			result = append(result, cidr)
+		}
+	}
+	return result
+}
+
+// orEmpty returns the list or the list of an empty string to loop once for no values
+func orEmpty(list []string) []string {
+	if len(list) == 0 {
+		return []string{""}
+	}
+	return list
+}
+
+func concatArgs(args ...[]string) []string {
+	result := []string{}
+	for _, arg := range args {
+		result = append(result, arg...)
+	}
+	return result
+}
+
+// initBaseChains creates the base chains in the table and the jump rules to them from the builtin chains of the same hooks.
+// Rules create only the base chains they use, not to add jumps to the paths of packets and not to need unused tables.
+func initBaseChains(logger logr.Logger, family *Family, table iptables.Table, baseChains ...string) error {
+	for _, baseChain := range baseChains {
+		out, err := family.CreateChain(table, baseChain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to create chain", "family", family.Name, "table", table, "chain", baseChain, "output", out)
 			return err
 		}
-		out, err = iptables.CreateChainIPv4(iptables.TableNAT, ChainBaseOutput)
+		spec := getRuleBaseJump(table, baseChain)
+		out, err = family.CreateRuleFirst(spec.Table, spec.Chain, spec.Comment, spec.Rule...)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to create rule", "family", family.Name, "table", spec.Table, "chain", spec.Chain, "rule", strings.Join(spec.Rule, " "), "output", out)
 			return err
 		}
+	}
+	return nil
+}
 
-		// Create jump rule to each chain in tables
-		ruleJumpFilterInput := []string{"-j", ChainBaseInput}
-		out, err = iptables.CreateRuleFirstIPv4(iptables.TableFilter, ChainInput, "", ruleJumpFilterInput...)
-		if err != nil {
-			logger.Error(err, out)
+// CleanupBaseChains deletes the empty base chains and the jump rules to them. The base chains are empty if no enabled rule
+// uses them, so it's called at start after the enabled rules are initialized and the disabled rules are cleaned up.
+// The tables not loaded are skipped.
+func CleanupBaseChains(logger logr.Logger, family *Family) error {
+	for _, table := range stateTables {
+		chains, err := family.GetChains(table)
+		if errors.Is(err, iptables.ErrNoTable) {
+			continue
+		} else if err != nil {
+			logger.Error(err, "failed to get chains", "family", family.Name, "table", table)
 			return err
 		}
-		ruleJumpNATPre := []string{"-j", ChainBasePrerouting}
-		out, err = iptables.CreateRuleFirstIPv4(iptables.TableNAT, ChainPrerouting, "", ruleJumpNATPre...)
-		if err != nil {
-			logger.Error(err, out)
-			return err
+		for _, baseChain := range getBaseChains() {
+			if !containsString(chains, baseChain) {
+				continue
+			}
+			rules, err := family.GetRules(table, baseChain)
+			if err != nil {
+				logger.Error(err, "failed to get rules", "family", family.Name, "table", table, "chain", baseChain)
+				return err
+			}
+			if len(rules) != 0 {
+				continue
+			}
+			if err := cleanupChain(logger, family, table, strings.TrimPrefix(baseChain, ChainPrefix), baseChain); err != nil {
+				return err
+			}
 		}
-		ruleJumpNATOut := []string{"-j", ChainBaseOutput}
-		out, err = iptables.CreateRuleFirstIPv4(iptables.TableNAT, ChainOutput, "", ruleJumpNATOut...)
+	}
+	return nil
+}
+
+// getRuleBaseJump returns the jump rule to the base chain from the builtin chain of the same hook
+func getRuleBaseJump(table iptables.Table, baseChain string) RuleSpec {
+	return RuleSpec{table, strings.TrimPrefix(baseChain, ChainPrefix), "", []string{"-j", baseChain}}
+}
+
+// getRulesBaseJump returns the jump rules to the base chains which the rules are set in
+func getRulesBaseJump(specs []RuleSpec) []RuleSpec {
+	result := []RuleSpec{}
+	for _, baseChain := range getBaseChains() {
+		for _, table := range stateTables {
+			for _, spec := range specs {
+				if spec.Table == table && spec.Chain == baseChain {
+					result = append(result, getRuleBaseJump(table, baseChain))
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+func getBaseChains() []string {
+	return []string{ChainBasePrerouting, ChainBaseInput, ChainBaseForward, ChainBaseOutput, ChainBasePostrouting}
+}
+
+// setChainRules creates the chain and the jump rule to it from the base chain, and sets the rules in the chain in order.
+// If the rules in the chain are different from the rules, it flushes the chain and sets the rules again.
+// If the base chain is empty, the jump rule isn't set for the chain jumped by other rules. Otherwise the base chain is also created.
+func setChainRules(logger logr.Logger, family *Family, table iptables.Table, baseChain, chain string, rules [][]string) error {
+	// Create chain
+	out, err := family.CreateChain(table, chain)
+	if err != nil {
+		logger.Error(err, "failed to create chain", "family", family.Name, "table", table, "chain", chain, "output", out)
+		return err
+	}
+
+	// Set rules
+	current, err := family.GetRules(table, chain)
+	if err != nil {
+		logger.Error(err, "failed to get rules", "family", family.Name, "table", table, "chain", chain)
+		return err
+	}
+	if !isSameRules(current, chain, rules) {
+		logger.Info("set rules in chain", "family", family.Name, "table", table, "chain", chain)
+		out, err = family.FlushChain(table, chain)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to flush chain", "family", family.Name, "table", table, "chain", chain, "output", out)
 			return err
 		}
+		for _, rule := range rules {
+			out, err = family.CreateRuleLast(table, chain, "", rule...)
+			if err != nil {
+				logger.Error(err, "failed to create rule", "family", family.Name, "table", table, "chain", chain, "rule", strings.Join(rule, " "), "output", out)
+				return err
+			}
+		}
+	}
+
+	// Set jump rule
+	if baseChain == "" {
+		return nil
+	}
+	if err := initBaseChains(logger, family, table, baseChain); err != nil {
+		return err
+	}
+	ruleJump := []string{"-j", chain}
+	out, err = family.CreateRuleFirst(table, baseChain, "", ruleJump...)
+	if err != nil {
+		logger.Error(err, "failed to create rule", "family", family.Name, "table", table, "chain", baseChain, "rule", strings.Join(ruleJump, " "), "output", out)
+		return err
+	}
+
+	return nil
+}
+
+// setServiceRules sets the rules of the service, distinguished by the comment of the service, in the chain in order.
+// It keeps the rules matched in order from the first, deletes the others and creates the rest of the rules
+// at the end of the chain, so that the rules of the service are in order. It returns the deleted rules.
+func setServiceRules(logger logr.Logger, family *Family, table iptables.Table, chain, nsName string, rules [][]string) ([]string, error) {
+	// Get rules of the service
+	current, err := family.GetRules(table, chain)
+	if err != nil {
+		logger.Error(err, "failed to get rules", "family", family.Name, "table", table, "chain", chain)
+		return nil, err
+	}
+	svcRules := []string{}
+	for _, rule := range current {
+		if iptables.GetRuleComment(rule) == nsName {
+			svcRules = append(svcRules, rule)
+		}
+	}
+
+	// Find the rules matched in order
+	matched := 0
+	for matched < len(svcRules) && matched < len(rules) &&
+		iptables.GetRuleKey(svcRules[matched]) == iptables.GetRuleKey(iptables.MakeRule(chain, nsName, rules[matched]...)) {
+		matched++
 	}
 
-	// IPv6
-	if ip.IsIPv6CIDR(podCIDRIPv6) {
-		// Create base chain in nat table
-		out, err := iptables.CreateChainIPv6(iptables.TableFilter, ChainBaseInput)
+	// Delete and create rules
+	for _, rule := range svcRules[matched:] {
+		logger.Info("delete rule", "service", nsName, "family", family.Name, "table", table, "chain", chain, "rule", rule)
+		out, err := family.DeleteRuleRaw(table, iptables.ChangeRuleToDelete(rule)...)
 		if err != nil {
-			logger.Error(err, out)
-			return err
+			logger.Error(err, "failed to delete rule", "service", nsName, "family", family.Name, "table", table, "rule", rule, "output", out)
+			return nil, err
 		}
-		out, err = iptables.CreateChainIPv6(iptables.TableNAT, ChainBasePrerouting)
+	}
+	for _, rule := range rules[matched:] {
+		logger.Info("create rule", "service", nsName, "family", family.Name, "table", table, "chain", chain, "rule", strings.Join(rule, " "))
+		out, err := family.CreateRuleLast(table, chain, nsName, rule...)
 		if err != nil {
-			logger.Error(err, out)
-			return err
+			logger.Error(err, "failed to create rule", "service", nsName, "family", family.Name, "table", table, "chain", chain, "rule", strings.Join(rule, " "), "output", out)
+			return nil, err
 		}
-		out, err = iptables.CreateChainIPv6(iptables.TableNAT, ChainBaseOutput)
+	}
+
+	return svcRules[matched:], nil
+}
+
+// cleanupChain deletes the jump rule to the chain from the base chain if it's set and the chain
+func cleanupChain(logger logr.Logger, family *Family, table iptables.Table, baseChain, chain string) error {
+	// Delete jump rule
+	if baseChain != "" {
+		ruleJump := []string{"-j", chain}
+		out, err := family.DeleteRule(table, baseChain, "", ruleJump...)
 		if err != nil {
-			logger.Error(err, out)
+			logger.Error(err, "failed to delete rule", "family", family.Name, "table", table, "chain", baseChain, "rule", strings.Join(ruleJump, " "), "output", out)
 			return err
 		}
+	}
+
+	// Delete chain
+	out, err := family.DeleteChain(table, chain)
+	if err != nil {
+		logger.Error(err, "failed to delete chain", "family", family.Name, "table", table, "chain", chain, "output", out)
+		return err
+	}
+
+	return nil
+}
+
+// getChainRuleSpecs returns the jump rule to the chain from the base chain if it's set and the rules in the chain
+func getChainRuleSpecs(table iptables.Table, baseChain, chain string, rules [][]string) []RuleSpec {
+	result := []RuleSpec{}
+	if baseChain != "" {
+		result = append(result, RuleSpec{table, baseChain, "", []string{"-j", chain}})
+	}
+	for _, rule := range rules {
+		result = append(result, RuleSpec{table, chain, "", rule})
+	}
+	return result
+}
+
+// CleanupRulesAll removes every network-node-manager chain and the jump rules to them in all tables of both families
+// and every network-node-manager set, regardless of the pod CIDR configs, and restores the changed kernel parameters.
+// Families and tools not in the node are skipped. Every step runs even if others fail, and the errors are aggregated.
+func CleanupRulesAll(logger logr.Logger) error {
+	errs := []error{}
+	for _, family := range []*Family{familyIPv4, familyIPv6} {
+		if !family.IsAvailable() {
+			logger.Info("skip cleanup because iptables of the family doesn't exist", "family", family.Name)
+			continue
+		}
+		for _, table := range stateTables {
+			if err := cleanupTable(logger, family, table); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// Delete sets after the rules matching them are deleted
+	if ipset.IsAvailable() {
+		if err := cleanupSets(logger); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		logger.Info("skip cleanup of sets because ipset doesn't exist")
+	}
+
+	// Restore kernel parameters
+	sysctlLock.Lock()
+	defer sysctlLock.Unlock()
 
-		// Create jump rule to each chain in tables
-		ruleJumpFilterInput := []string{"-j", ChainBaseInput}
-		out, err = iptables.CreateRuleFirstIPv6(iptables.TableFilter, ChainInput, "", ruleJumpFilterInput...)
+	if err := restoreSysctl(logger); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// cleanupTable removes the managed chains and the jump rules to them in the table. The table not loaded is already clean.
+func cleanupTable(logger logr.Logger, family *Family, table iptables.Table) error {
+	chains, err := family.GetChains(table)
+	if errors.Is(err, iptables.ErrNoTable) {
+		logger.Info("skip cleanup because the table doesn't exist", "family", family.Name, "table", table)
+		return nil
+	} else if err != nil {
+		logger.Error(err, "failed to get chains", "family", family.Name, "table", table)
+		return err
+	}
+	rules, err := family.GetRules(table, "")
+	if err != nil {
+		logger.Error(err, "failed to get rules", "family", family.Name, "table", table)
+		return err
+	}
+	errs := []error{}
+
+	// Delete jump rules from chains not managed by network-node-manager
+	for _, rule := range rules {
+		if isManagedChain(iptables.GetRuleChain(rule)) || !isManagedChain(iptables.GetRuleJump(rule)) {
+			continue
+		}
+		logger.Info("delete jump rule", "family", family.Name, "table", table, "rule", rule)
+		out, err := family.DeleteRuleRaw(table, iptables.ChangeRuleToDelete(rule)...)
 		if err != nil {
-			logger.Error(err, out)
-			return err
+			logger.Error(err, "failed to delete rule", "family", family.Name, "table", table, "rule", rule, "output", out)
+			errs = append(errs, err)
 		}
-		ruleJumpNATPre := []string{"-j", ChainBasePrerouting}
-		out, err = iptables.CreateRuleFirstIPv6(iptables.TableNAT, ChainPrerouting, "", ruleJumpNATPre...)
+	}
+
+	// Flush all chains first because managed chains can jump to each other
+	for _, chain := range chains {
+		if !isManagedChain(chain) {
+			continue
+		}
+		out, err := family.FlushChain(table, chain)
 		if err != nil {
-			logger.Error(err, out)
-			return err
+			logger.Error(err, "failed to flush chain", "family", family.Name, "table", table, "chain", chain, "output", out)
+			errs = append(errs, err)
 		}
-		ruleJumpNATOut := []string{"-j", ChainBaseOutput}
-		out, err = iptables.CreateRuleFirstIPv6(iptables.TableNAT, ChainOutput, "", ruleJumpNATOut...)
+	}
+	for _, chain := range chains {
+		if !isManagedChain(chain) {
+			continue
+		}
+		logger.Info("delete chain", "family", family.Name, "table", table, "chain", chain)
+		out, err := family.DeleteChain(table, chain)
 		if err != nil {
-			logger.Error(err, out)
-			return err
+			logger.Error(err, "failed to delete chain", "family", family.Name, "table", table, "chain", chain, "output", out)
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return utilerrors.NewAggregate(errs)
+}
+
+func cleanupSets(logger logr.Logger) error {
+	sets, err := ipset.GetSets()
+	if err != nil {
+		logger.Error(err, "failed to get sets")
+		return err
+	}
+	errs := []error{}
+	for _, set := range sets {
+		if !isManagedChain(set) {
+			continue
+		}
+		logger.Info("delete set", "set", set)
+		out, err := ipset.DestroySet(set)
+		if err != nil {
+			logger.Error(err, "failed to destroy set", "set", set, "output", out)
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func isManagedChain(chain string) bool {
+	return strings.HasPrefix(chain, ChainPrefix)
 }
@@ -0,0 +1,450 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kakao/network-node-manager/pkg/configs"
+	"github.com/kakao/network-node-manager/pkg/conntrack"
+	"github.com/kakao/network-node-manager/pkg/ipset"
+	"github.com/kakao/network-node-manager/pkg/iptables"
+	"github.com/kakao/network-node-manager/pkg/proxymode"
+	"github.com/kakao/network-node-manager/pkg/sysctl"
+)
+
+// fakeIptables is an in-memory iptables of both families and ipset that records mutating commands and conntrack deletes,
+// and counts iptables-save runs. Missing has the commands like "ip6tables" or "ipset" and the tables like "iptables raw" not in the node.
+type fakeIptables struct {
+	chains   map[string]bool
+	rules    map[string][]string
+	sets     map[string][]string
+	missing  map[string]bool
+	commands []string
+	saves    int
+}
+
+func newFakeIptables() *fakeIptables {
+	return &fakeIptables{chains: map[string]bool{}, rules: map[string][]string{}, sets: map[string][]string{}, missing: map[string]bool{}}
+}
+
+func (f *fakeIptables) run(name string, args ...string) ([]byte, error) {
+	if f.missing[strings.TrimSuffix(name, "-save")] {
+		return nil, fmt.Errorf("exec: %q: executable file not found in $PATH", name)
+	}
+	if name == "ipset" {
+		return f.runIpset(args...)
+	}
+
+	// Parse iptables-save
+	cmd := strings.TrimSuffix(name, "-save")
+	table := ""
+	for i := range args {
+		if args[i] == "-t" {
+			table = args[i+1]
+		}
+	}
+	if strings.HasSuffix(name, "-save") {
+		f.saves++
+		if f.missing[cmd+" "+table] {
+			return []byte(name + " v1.8.3 (legacy): Cannot initialize: Table does not exist (do you need to insmod?)"), errors.New("exit status 1")
+		}
+		var out strings.Builder
+		for key := range f.chains {
+			if strings.HasPrefix(key, cmd+" "+table+" ") {
+				out.WriteString(":" + strings.TrimPrefix(key, cmd+" "+table+" ") + " - [0:0]\n")
+			}
+		}
+		for key, rules := range f.rules {
+			if strings.HasPrefix(key, cmd+" "+table+" ") {
+				for _, rule := range rules {
+					out.WriteString(rule + "\n")
+				}
+			}
+		}
+		return []byte(out.String()), nil
+	}
+
+	// Parse iptables command
+	var op, chain string
+	var rule []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-w", "-W", "-t":
+			i++
+		case "-nL", "-N", "-F", "-X", "-C", "-I", "-A", "-D":
+			op, chain = args[i], args[i+1]
+			i++
+			if op == "-I" {
+				i++
+			}
+		default:
+			rule = append(rule, normalizeFakeAddr(args, i))
+		}
+	}
+	key := cmd + " " + table + " " + chain
+	ruleText := iptables.MakeRule(chain, "", rule...)
+	if op != "-nL" && op != "-C" {
+		f.commands = append(f.commands, strings.Join(append([]string{name}, args[4:]...), " "))
+	}
+
+	switch op {
+	case "-nL":
+		if !f.chains[key] {
+			return []byte("iptables: No chain/target/match by that name."), errors.New("exit status 1")
+		}
+	case "-N":
+		f.chains[key] = true
+	case "-F":
+		delete(f.rules, key)
+	case "-X":
+		delete(f.chains, key)
+	case "-C":
+		if f.indexOf(key, ruleText) < 0 {
+			return []byte("iptables: Bad rule (does a matching rule exist in that chain?)."), errors.New("exit status 1")
+		}
+	case "-I":
+		f.rules[key] = append([]string{ruleText}, f.rules[key]...)
+	case "-A":
+		f.rules[key] = append(f.rules[key], ruleText)
+	case "-D":
+		i := f.indexOf(key, ruleText)
+		f.rules[key] = append(f.rules[key][:i], f.rules[key][i+1:]...)
+		if len(f.rules[key]) == 0 {
+			delete(f.rules, key)
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeIptables) runIpset(args ...string) ([]byte, error) {
+	errNoSet := errors.New("exit status 1")
+	outNoSet := []byte("ipset v7.11: The set with the given name does not exist")
+	if args[0] != "list" && args[0] != "version" {
+		f.commands = append(f.commands, strings.Join(append([]string{"ipset"}, args...), " "))
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) == 2 && args[1] == "-n" {
+			var out strings.Builder
+			for set := range f.sets {
+				out.WriteString(set + "\n")
+			}
+			return []byte(out.String()), nil
+		}
+		entries, ok := f.sets[args[len(args)-1]]
+		if !ok {
+			return outNoSet, errNoSet
+		}
+		if args[1] == "-n" {
+			return []byte(args[2] + "\n"), nil
+		}
+		return []byte("Name: " + args[1] + "\nType: hash:ip\nMembers:\n" + strings.Join(entries, "\n")), nil
+	case "create":
+		if _, ok := f.sets[args[1]]; !ok {
+			f.sets[args[1]] = []string{}
+		}
+	case "destroy":
+		delete(f.sets, args[1])
+	case "add", "del":
+		entries, ok := f.sets[args[1]]
+		if !ok {
+			return outNoSet, errNoSet
+		}
+		if args[0] == "add" && !containsString(entries, args[2]) {
+			f.sets[args[1]] = append(entries, args[2])
+		}
+		if args[0] == "del" {
+			result := []string{}
+			for _, entry := range entries {
+				if entry != args[2] {
+					result = append(result, entry)
+				}
+			}
+			f.sets[args[1]] = result
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeIptables) indexOf(key, rule string) int {
+	for i, r := range f.rules[key] {
+		if iptables.GetRuleKey(r) == iptables.GetRuleKey(rule) {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeFakeAddr appends the host prefix length to addresses like iptables-save prints
+func normalizeFakeAddr(args []string, i int) string {
+	if i == 0 || (args[i-1] != "-s" && args[i-1] != "-d") || strings.Contains(args[i], "/") {
+		return args[i]
+	}
+	if strings.Contains(args[i], ":") {
+		return args[i] + "/128"
+	}
+	return args[i] + "/32"
+}
+
+// deleteConntrack records a conntrack command per dump with the filters
+func (f *fakeIptables) deleteConntrack(filters []conntrack.Filter) (int, error) {
+	args := []string{}
+	for _, filter := range filters {
+		args = append(args, fmt.Sprintf("-p %d --orig-dst %s --reply-src %s", filter.Protocol, filter.OrigDst, filter.ReplySrc))
+	}
+	f.commands = append(f.commands, "conntrack -D "+strings.Join(args, " , "))
+	return len(filters), nil
+}
+
+// setFakeIptables replaces iptables, ipset and conntrack with the fake, and the sysctl root and state file with temporary ones.
+// The mark chain is detected again with the fake.
+func setFakeIptables(t *testing.T) *fakeIptables {
+	fake := newFakeIptables()
+	prev := iptables.SetRunner(fake.run)
+	prevIpset := ipset.SetRunner(fake.run)
+	prevDeleter := conntrack.SetDeleter(fake.deleteConntrack)
+	prevRoot := sysctl.SetRoot(t.TempDir())
+	os.Setenv(configs.EnvRuleSysctlStateFile, filepath.Join(t.TempDir(), "sysctl.json"))
+	resetMarkMasqChains()
+	t.Cleanup(func() {
+		iptables.SetRunner(prev)
+		ipset.SetRunner(prevIpset)
+		conntrack.SetDeleter(prevDeleter)
+		sysctl.SetRoot(prevRoot)
+		os.Unsetenv(configs.EnvRuleSysctlStateFile)
+		resetMarkMasqChains()
+	})
+	return fake
+}
+
+// resetMarkMasqChains makes the mark chain detected again
+func resetMarkMasqChains() {
+	markMasqLock.Lock()
+	defer markMasqLock.Unlock()
+
+	markMasqChains = map[string]string{}
+}
+
+func TestRulesFamilyParity(t *testing.T) {
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	os.Setenv(configs.EnvRuleNodeLocalDNSAddrs, "169.254.20.10,fd00:169:254::10")
+	defer os.Unsetenv(configs.EnvRuleNodeLocalDNSAddrs)
+	logger := log.NullLogger{}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ClusterIPs:  []string{"10.96.0.10", "fd00:10:96::10"},
+			IPFamilies:  []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol},
+			ExternalIPs: []string{"192.168.0.10", "fd00:192:168::10"},
+		},
+	}
+	newSvc := svc.DeepCopy()
+	newSvc.Spec.ExternalIPs = []string{"192.168.0.20", "fd00:192:168::20"}
+	svcs := &corev1.ServiceList{Items: []corev1.Service{*newSvc}}
+
+	// Run every rule for each family and get the mutating commands
+	commands := map[string][]string{}
+	for _, family := range GetFamilies() {
+		fake := setFakeIptables(t)
+		for _, rule := range GetRules() {
+			if err := rule.Init(logger, family); err != nil {
+				t.Fatalf("failed to init %s for %s : %v", rule.Name(), family.Name, err)
+			}
+			if err := rule.Reconcile(logger, family, req, svc, nil); err != nil {
+				t.Fatalf("failed to reconcile %s for %s : %v", rule.Name(), family.Name, err)
+			}
+			if err := rule.Sync(logger, family, svcs); err != nil {
+				t.Fatalf("failed to sync %s for %s : %v", rule.Name(), family.Name, err)
+			}
+			if err := rule.Reconcile(logger, family, req, newSvc, svc); err != nil {
+				t.Fatalf("failed to reconcile %s for %s : %v", rule.Name(), family.Name, err)
+			}
+			if err := rule.Reconcile(logger, family, req, nil, newSvc); err != nil {
+				t.Fatalf("failed to reconcile %s for %s : %v", rule.Name(), family.Name, err)
+			}
+			if err := rule.Cleanup(logger, family); err != nil {
+				t.Fatalf("failed to cleanup %s for %s : %v", rule.Name(), family.Name, err)
+			}
+		}
+		commands[family.Name] = fake.commands
+	}
+
+	// Compare commands by replacing the IPv6 addresses to the IPv4 ones
+	replacer := strings.NewReplacer(
+		"ip6tables", "iptables",
+		"fd00:10:244::/64", "10.244.0.0/16",
+		"fd00:10:96::10", "10.96.0.10",
+		"fd00:192:168::10", "192.168.0.10",
+		"fd00:192:168::20", "192.168.0.20",
+		"fd00:169:254::10", "169.254.20.10",
+		"fd00:ec2::254", "169.254.169.254",
+		"/128", "/32",
+		SetExternalClusterIPv6, SetExternalClusterIPv4,
+		"family inet6", "family inet",
+	)
+	for i := range commands[iptables.FamilyIPv6.Name] {
+		commands[iptables.FamilyIPv6.Name][i] = replacer.Replace(commands[iptables.FamilyIPv6.Name][i])
+	}
+	if len(commands[iptables.FamilyIPv4.Name]) == 0 {
+		t.Fatalf("no commands")
+	}
+	if !reflect.DeepEqual(commands[iptables.FamilyIPv4.Name], commands[iptables.FamilyIPv6.Name]) {
+		t.Errorf("commands are different between families\nIPv4: %v\nIPv6: %v", commands[iptables.FamilyIPv4.Name], commands[iptables.FamilyIPv6.Name])
+	}
+}
+
+func TestCleanupRulesAll(t *testing.T) {
+	Init("10.244.0.0/16", "fd00:10:244::/64")
+	fake := setFakeIptables(t)
+	for _, family := range GetFamilies() {
+		for _, rule := range GetRules() {
+			if err := rule.Init(log.NullLogger{}, family); err != nil {
+				t.Fatalf("failed to init %s for %s : %v", rule.Name(), family.Name, err)
+			}
+		}
+	}
+
+	if err := CleanupRulesAll(log.NullLogger{}); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	if len(fake.chains) != 0 || len(fake.rules) != 0 || len(fake.sets) != 0 {
+		t.Errorf("chains, rules or sets remain - %v %v %v", fake.chains, fake.rules, fake.sets)
+	}
+}
+
+func TestCleanupRulesAllMissing(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	for _, rule := range GetRules() {
+		if err := rule.Init(log.NullLogger{}, familyIPv4); err != nil {
+			t.Fatalf("failed to init %s : %v", rule.Name(), err)
+		}
+	}
+
+	// IPv4-only node without ipset and raw table
+	fake.missing["ip6tables"] = true
+	fake.missing["ipset"] = true
+	fake.missing["iptables raw"] = true
+	fake.commands = nil
+	if err := CleanupRulesAll(log.NullLogger{}); err != nil {
+		t.Fatalf("failed to cleanup : %v", err)
+	}
+	for key := range fake.chains {
+		if !strings.HasPrefix(key, "iptables raw ") {
+			t.Errorf("chain remains - %s", key)
+		}
+	}
+	for _, command := range fake.commands {
+		if strings.HasPrefix(command, "ip6tables") || strings.HasPrefix(command, "ipset") {
+			t.Errorf("command of missing tool is run - %s", command)
+		}
+	}
+}
+
+func TestInitBaseChainsUsed(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	getRule := func(name string) Rule {
+		for _, rule := range GetRules() {
+			if rule.Name() == name {
+				return rule
+			}
+		}
+		t.Fatalf("no rule %s", name)
+		return nil
+	}
+	tablesOf := func() map[string]bool {
+		result := map[string]bool{}
+		for key := range fake.chains {
+			result[strings.Split(key, " ")[1]] = true
+		}
+		return result
+	}
+
+	// Drop invalid input rule uses only the input hook of filter table
+	dropInvalidInput := getRule(FeatureDropInvalidInput)
+	if err := dropInvalidInput.Init(log.NullLogger{}, familyIPv4); err != nil {
+		t.Fatalf("failed to init : %v", err)
+	}
+	if tables := tablesOf(); !reflect.DeepEqual(tables, map[string]bool{"filter": true}) {
+		t.Errorf("wrong tables - %v", tables)
+	}
+	if !fake.chains["iptables filter "+ChainBaseInput] || fake.chains["iptables filter "+ChainBaseForward] || fake.chains["iptables filter "+ChainBaseOutput] {
+		t.Errorf("wrong base chains - %v", fake.chains)
+	}
+	if rules := fake.rules["iptables filter "+ChainInput]; !reflect.DeepEqual(rules, []string{"-A INPUT -j " + ChainBaseInput}) {
+		t.Errorf("wrong jump rules - %v", rules)
+	}
+
+	// Tables not loaded are skipped
+	fake.missing["iptables mangle"] = true
+	if err := CleanupBaseChains(log.NullLogger{}, familyIPv4); err != nil {
+		t.Errorf("failed to cleanup base chains without mangle table : %v", err)
+	}
+}
+
+func TestGetEnabledRulesProxyMode(t *testing.T) {
+	isEnabled := func(mode proxymode.Mode, name string) bool {
+		enabled, _, err := GetEnabledRules(mode)
+		if err != nil {
+			t.Fatalf("failed to get enabled rules : %v", err)
+		}
+		for _, rule := range enabled {
+			if rule.Name() == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !isEnabled(proxymode.ModeIPVS, FeatureExternalCluster) || isEnabled(proxymode.ModeIPTables, FeatureExternalCluster) ||
+		isEnabled(proxymode.ModeUnknown, FeatureExternalCluster) {
+		t.Errorf("wrong default of externalIP to clusterIP rule")
+	}
+
+	// Explicit config overrides the default of the mode
+	os.Setenv(configs.EnvRuleExternalClusterEnable, "false")
+	defer os.Unsetenv(configs.EnvRuleExternalClusterEnable)
+	if isEnabled(proxymode.ModeIPVS, FeatureExternalCluster) {
+		t.Errorf("config doesn't override the default")
+	}
+	os.Setenv(configs.EnvRuleExternalClusterEnable, "true")
+	if !isEnabled(proxymode.ModeIPTables, FeatureExternalCluster) {
+		t.Errorf("config doesn't override the default")
+	}
+
+	// Wrong config
+	os.Setenv(configs.EnvRuleExternalClusterEnable, "none")
+	if _, _, err := GetEnabledRules(proxymode.ModeIPVS); err == nil {
+		t.Errorf("no error for wrong config")
+	}
+}
+
+func TestGetEnabledRulesSupportedMode(t *testing.T) {
+	os.Setenv(configs.EnvRuleExternalIPAllowlistEnable, "true")
+	defer os.Unsetenv(configs.EnvRuleExternalIPAllowlistEnable)
+
+	// ExternalIP allowlist rule works only in iptables mode
+	if _, _, err := GetEnabledRules(proxymode.ModeIPVS); err == nil {
+		t.Errorf("no error for externalIP allowlist rule in IPVS mode")
+	}
+	for _, mode := range []proxymode.Mode{proxymode.ModeIPTables, proxymode.ModeUnknown} {
+		if _, _, err := GetEnabledRules(mode); err != nil {
+			t.Errorf("failed to get enabled rules in %s mode : %v", mode, err)
+		}
+	}
+}
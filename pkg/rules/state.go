@@ -0,0 +1,208 @@
+package rules
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kakao/network-node-manager/pkg/iptables"
+)
+
+// Constants
+const (
+	FeatureBase                = "base"
+	FeatureDropInvalidInput    = "drop-invalid-input"
+	FeatureDropInvalidForward  = "drop-invalid-forward"
+	FeatureExternalCluster     = "external-cluster"
+	FeatureTCPMSSClamp         = "tcpmss-clamp"
+	FeatureNodeLocalDNS        = "node-local-dns"
+	FeatureMasquerade          = "masquerade"
+	FeatureBlockMetadata       = "block-metadata"
+	FeatureExternalIPAllowlist = "external-ip-allowlist"
+	FeatureSysctl              = "sysctl"
+	FeatureUnknown             = "unknown"
+)
+
+// RuleState is a rule of network-node-manager in a node
+type RuleState struct {
+	Family  string         `json:"family"`
+	Table   iptables.Table `json:"table"`
+	Feature string         `json:"feature"`
+	Service string         `json:"service,omitempty"`
+	Rule    string         `json:"rule"`
+}
+
+// Vars
+var (
+	stateTables = []iptables.Table{iptables.TableFilter, iptables.TableNAT, iptables.TableMangle, iptables.TableRaw}
+)
+
+// GetRulesCurrent returns the rules in network-node-manager chains and the jump rules
+// to network-node-manager chains of both families in a node. Families and tables not in the node have no rules.
+func GetRulesCurrent() ([]RuleState, error) {
+	var result []RuleState
+
+	for _, family := range []*Family{familyIPv4, familyIPv6} {
+		if !family.IsAvailable() {
+			continue
+		}
+		for _, table := range stateTables {
+			rules, err := family.GetRules(table, "")
+			if errors.Is(err, iptables.ErrNoTable) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			for _, rule := range rules {
+				if isManagedChain(iptables.GetRuleChain(rule)) || isManagedChain(iptables.GetRuleJump(rule)) {
+					result = append(result, newRuleState(family.Name, table, rule))
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// GetRulesDesired returns the rules that network-node-manager sets
+// by the enabled rules and the services
+func GetRulesDesired(enabledRules []Rule, svcs *corev1.ServiceList) []RuleState {
+	var result []RuleState
+	for _, family := range GetFamilies() {
+		specs := []RuleSpec{}
+		for _, rule := range enabledRules {
+			specs = append(specs, rule.Desired(family, svcs)...)
+		}
+		// Base chains used by the rules
+		specs = append(getRulesBaseJump(specs), specs...)
+
+		for _, spec := range specs {
+			result = append(result, newRuleState(family.Name, spec.Table, iptables.MakeRule(spec.Chain, spec.Comment, spec.Rule...)))
+		}
+	}
+	return result
+}
+
+// DiffRules returns the desired rules missing in the current rules
+// and the current rules not in the desired rules
+func DiffRules(current, desired []RuleState) (missing, extra []RuleState) {
+	currentKeys := make(map[string]bool)
+	for _, state := range current {
+		currentKeys[state.key()] = true
+	}
+	desiredKeys := make(map[string]bool)
+	for _, state := range desired {
+		desiredKeys[state.key()] = true
+	}
+
+	for _, state := range desired {
+		if !currentKeys[state.key()] {
+			missing = append(missing, state)
+		}
+	}
+	for _, state := range current {
+		if !desiredKeys[state.key()] {
+			extra = append(extra, state)
+		}
+	}
+	return
+}
+
+// SortRuleStates sorts rules by family, feature, service and table with keeping the rule order in a chain
+func SortRuleStates(states []RuleState) {
+	sort.SliceStable(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		if a.Feature != b.Feature {
+			return a.Feature < b.Feature
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.Table < b.Table
+	})
+}
+
+// GetRestorePayload returns the rules of the family in the format for "iptables-restore --noflush".
+// The jump rules in builtin chains are inserted first like network-node-manager does.
+func GetRestorePayload(states []RuleState, family string) string {
+	var b strings.Builder
+	for _, table := range stateTables {
+		// Get chains and rules of the table
+		var chains, rules []string
+		chainSet := make(map[string]bool)
+		for _, state := range states {
+			if state.Family != family || state.Table != table {
+				continue
+			}
+			for _, chain := range []string{iptables.GetRuleChain(state.Rule), iptables.GetRuleJump(state.Rule)} {
+				if isManagedChain(chain) && !chainSet[chain] {
+					chainSet[chain] = true
+					chains = append(chains, chain)
+				}
+			}
+			if chain := iptables.GetRuleChain(state.Rule); !isManagedChain(chain) {
+				rules = append(rules, "-I "+chain+" 1"+strings.TrimPrefix(state.Rule, "-A "+chain))
+			} else {
+				rules = append(rules, state.Rule)
+			}
+		}
+		if len(rules) == 0 {
+			continue
+		}
+
+		// Write table
+		b.WriteString("*" + string(table) + "\n")
+		for _, chain := range chains {
+			b.WriteString(":" + chain + " - [0:0]\n")
+		}
+		for _, rule := range rules {
+			b.WriteString(rule + "\n")
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+func (s RuleState) key() string {
+	return s.Family + " " + string(s.Table) + " " + iptables.GetRuleKey(s.Rule)
+}
+
+func newRuleState(family string, table iptables.Table, rule string) RuleState {
+	// Jump rules in base chains and builtin chains belong to the feature of the target chain
+	feature, ok := getFeatureByChain(iptables.GetRuleChain(rule))
+	if !ok || feature == FeatureBase {
+		feature, ok = getFeatureByChain(iptables.GetRuleJump(rule))
+	}
+	if !ok {
+		feature = FeatureUnknown
+	}
+
+	return RuleState{
+		Family:  family,
+		Table:   table,
+		Feature: feature,
+		Service: iptables.GetRuleComment(rule),
+		Rule:    rule,
+	}
+}
+
+func getFeatureByChain(chain string) (string, bool) {
+	switch chain {
+	case ChainBaseInput, ChainBaseForward, ChainBasePrerouting, ChainBaseOutput, ChainBasePostrouting:
+		return FeatureBase, true
+	}
+	if isServiceChainExternalCluster(chain) {
+		return FeatureExternalCluster, true
+	}
+	for _, rule := range registry {
+		if containsString(rule.Chains(), chain) {
+			return rule.Name(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,123 @@
+package rules
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kakao/network-node-manager/pkg/iptables"
+)
+
+var (
+	svcsTest = &corev1.ServiceList{
+		Items: []corev1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+				Spec: corev1.ServiceSpec{
+					ClusterIP:   "10.96.0.10",
+					ExternalIPs: []string{"192.168.0.10"},
+				},
+			},
+		},
+	}
+)
+
+func TestGetRulesDesired(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	SetKubeMarkMasqExist(true)
+	t.Cleanup(resetMarkMasqChains)
+
+	states := GetRulesDesired(GetRules(), svcsTest)
+	for _, state := range states {
+		if state.Family != iptables.FamilyIPv4.Name {
+			t.Errorf("wrong family - %+v", state)
+		}
+		if state.Feature == FeatureUnknown {
+			t.Errorf("wrong feature - %+v", state)
+		}
+	}
+
+	svcRules := 0
+	for _, state := range states {
+		if state.Service == "default/nginx" {
+			svcRules++
+		}
+	}
+	if svcRules != 3 {
+		t.Errorf("wrong number of service rules. expected:3 / actual:%d", svcRules)
+	}
+
+	// Base chains are jumped only for the hooks used by the rules
+	if states = GetRulesDesired(nil, svcsTest); len(states) != 0 {
+		t.Errorf("wrong rules without rules - %+v", states)
+	}
+	var dropInvalidInput []Rule
+	for _, rule := range GetRules() {
+		if rule.Name() == FeatureDropInvalidInput {
+			dropInvalidInput = append(dropInvalidInput, rule)
+		}
+	}
+	states = GetRulesDesired(dropInvalidInput, svcsTest)
+	baseRules := []string{}
+	for _, state := range states {
+		if state.Feature == FeatureBase {
+			baseRules = append(baseRules, string(state.Table)+" "+state.Rule)
+		}
+	}
+	if !reflect.DeepEqual(baseRules, []string{"filter -A INPUT -j NMANAGER_INPUT"}) {
+		t.Errorf("wrong base rules - %v", baseRules)
+	}
+	if payload := GetRestorePayload(states, iptables.FamilyIPv4.Name); strings.Contains(payload, "*mangle") || strings.Contains(payload, "*raw") {
+		t.Errorf("unused tables in payload - %s", payload)
+	}
+}
+
+func TestGetRulesCurrentMissing(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	fake := setFakeIptables(t)
+	fake.rules["iptables filter "+ChainInput] = []string{"-A INPUT -j " + ChainBaseInput}
+	fake.rules["iptables filter "+ChainBaseInput] = []string{"-A NMANAGER_INPUT -j " + ChainFilterDropInvalidInput}
+	fake.rules["iptables nat "+ChainPostrouting] = []string{"-A POSTROUTING -j KUBE-POSTROUTING"}
+
+	// IPv4-only node without raw table
+	fake.missing["ip6tables"] = true
+	fake.missing["iptables raw"] = true
+	states, err := GetRulesCurrent()
+	if err != nil {
+		t.Fatalf("failed to get rules : %v", err)
+	}
+	if len(states) != 2 {
+		t.Errorf("wrong rules - %+v", states)
+	}
+	for _, state := range states {
+		if state.Family != iptables.FamilyIPv4.Name || state.Table != iptables.TableFilter {
+			t.Errorf("wrong rule - %+v", state)
+		}
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	Init("10.244.0.0/16", "")
+	SetKubeMarkMasqExist(true)
+	t.Cleanup(resetMarkMasqChains)
+
+	desired := GetRulesDesired(GetRules(), svcsTest)
+	current := []RuleState{
+		newRuleState(iptables.FamilyIPv4.Name, iptables.TableFilter, "-A INPUT -j NMANAGER_INPUT"),
+		newRuleState(iptables.FamilyIPv4.Name, iptables.TableNAT,
+			"-A NMANAGER_EX_CLUS_PREROUTING -d 192.168.0.10/32 -m comment --comment \"default/nginx\" -j "+getServiceChainExternalCluster("default/nginx")),
+		newRuleState(iptables.FamilyIPv4.Name, iptables.TableNAT,
+			"-A NMANAGER_EX_CLUS_PREROUTING -d 192.168.0.20/32 -m comment --comment \"default/old\" -j "+getServiceChainExternalCluster("default/old")),
+	}
+
+	missing, extra := DiffRules(current, desired)
+	if len(missing) != len(desired)-2 {
+		t.Errorf("wrong number of missing rules. expected:%d / actual:%d", len(desired)-2, len(missing))
+	}
+	if len(extra) != 1 || extra[0].Service != "default/old" || extra[0].Feature != FeatureExternalCluster {
+		t.Errorf("wrong extra rules - %+v", extra)
+	}
+}
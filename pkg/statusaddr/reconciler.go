@@ -0,0 +1,184 @@
+package statusaddr
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/go-logr/logr"
+)
+
+// Const
+const (
+	// Gateways and ingresses wait for the service controller to initialize rules
+	initRequeueAfter = time.Second
+
+	EventReasonBackingServiceNotAllowed = "BackingServiceNotAllowed"
+	EventReasonAddressConflict          = "AddressConflict"
+)
+
+// Reconciler reconciles the externalIP to clusterIP rules for the addresses in the status of gateways or ingresses
+type Reconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Kind is KindGateway or KindIngress
+	Kind    string
+	Backing Backing
+
+	// Initialized returns whether the rules are initialized. Resources are requeued until it's true.
+	Initialized func() bool
+	// ReconcileService reconciles the rules of the service for the addresses of the resource. The service is nil
+	// if the resource is removed, or has no backing service or no address. It returns the conflicts of the addresses
+	// of the service with the services of older resources.
+	ReconcileService func(logger logr.Logger, kind string, req ctrl.Request, svc *corev1.Service) ([]Conflict, error)
+
+	gatewayGVK  schema.GroupVersionKind
+	backingRefs *backingIndex
+}
+
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=gateways,verbs=get;list;watch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
+
+func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Log.WithName("reconcile").WithValues(r.Kind, req.String())
+	if !r.Initialized() {
+		return ctrl.Result{RequeueAfter: initRequeueAfter}, nil
+	}
+
+	// Get the service for the addresses of the resource. Not found resource means that the resource is removed
+	var svc *corev1.Service
+	obj := r.newObject()
+	if err := r.Client.Get(ctx, req.NamespacedName, obj); err == nil {
+		ref, ok := GetBackingServiceRef(obj, r.Backing)
+		r.backingRefs.set(req, ref, ok)
+		if annotation, exist := obj.GetAnnotations()[AnnotationBackingService]; exist && !ok {
+			r.Recorder.Event(obj, corev1.EventTypeWarning, EventReasonBackingServiceNotAllowed,
+				fmt.Sprintf("backing service %s is wrong or not allowed. services in other namespaces must be allowed by the operator", annotation))
+		}
+		if svc, err = r.getService(ctx, obj); err != nil {
+			logger.Error(err, "failed to get backing service")
+			return ctrl.Result{}, err
+		}
+	} else if apierror.IsNotFound(err) {
+		r.backingRefs.set(req, types.NamespacedName{}, false)
+	} else {
+		logger.Error(err, "failed to get "+r.Kind+" info")
+		return ctrl.Result{}, err
+	}
+
+	conflicts, err := r.ReconcileService(logger, r.Kind, req, svc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, conflict := range conflicts {
+		r.Recorder.Event(obj, corev1.EventTypeWarning, EventReasonAddressConflict,
+			fmt.Sprintf("address %s isn't DNATed because it's already used by the older %s", conflict.Address, conflict.Owner))
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *Reconciler) SetupWithManager(mgr ctrl.Manager) error {
+	switch r.Kind {
+	case KindGateway:
+		// Gateway API is served in various versions by clusters
+		gvk, err := GetGatewayGVK(mgr.GetRESTMapper())
+		if err != nil {
+			return err
+		}
+		r.gatewayGVK = gvk
+	case KindIngress:
+	default:
+		return fmt.Errorf("unknown kind : %s", r.Kind)
+	}
+	r.backingRefs = newBackingIndex()
+
+	// Set controller manager. Watch services to reconcile the resources backed by them.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named(r.Kind).
+		For(r.newObject()).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.getResourcesOfService)).
+		Complete(r)
+}
+
+// newObject returns an empty object of the kind to get it with the client
+func (r *Reconciler) newObject() client.Object {
+	if r.Kind == KindGateway {
+		return NewGateway(r.gatewayGVK)
+	}
+	return &networkingv1.Ingress{}
+}
+
+// getService returns the service for the addresses of the gateway or the ingress
+func (r *Reconciler) getService(ctx context.Context, obj client.Object) (*corev1.Service, error) {
+	if r.Kind == KindGateway {
+		return GetGatewayService(ctx, r.Client, obj.(*unstructured.Unstructured), r.Backing)
+	}
+	return GetIngressService(ctx, r.Client, obj.(*networkingv1.Ingress), r.Backing)
+}
+
+// getResourcesOfService returns the resources backed by the service. Gateways are also backed by the services
+// labeled with their names by Gateway API implementations.
+func (r *Reconciler) getResourcesOfService(obj client.Object) []ctrl.Request {
+	reqs := r.backingRefs.get(types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()})
+	if r.Kind != KindGateway {
+		return reqs
+	}
+	if name, ok := obj.GetLabels()[LabelGatewayName]; ok {
+		reqs = append(reqs, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}})
+	}
+	return reqs
+}
+
+// backingIndex keeps the backing services referenced by gateways or ingresses,
+// so that they are reconciled when their backing services are changed
+type backingIndex struct {
+	lock *sync.Mutex
+	refs map[ctrl.Request]types.NamespacedName
+}
+
+func newBackingIndex() *backingIndex {
+	return &backingIndex{lock: &sync.Mutex{}, refs: map[ctrl.Request]types.NamespacedName{}}
+}
+
+// set sets the backing service of the resource, or deletes it if the resource has no backing service
+func (i *backingIndex) set(req ctrl.Request, ref types.NamespacedName, ok bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if ok {
+		i.refs[req] = ref
+	} else {
+		delete(i.refs, req)
+	}
+}
+
+// get returns the resources referencing the backing service
+func (i *backingIndex) get(ref types.NamespacedName) []ctrl.Request {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	result := []ctrl.Request{}
+	for req, r := range i.refs {
+		if r == ref {
+			result = append(result, req)
+		}
+	}
+	return result
+}
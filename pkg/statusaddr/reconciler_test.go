@@ -0,0 +1,142 @@
+package statusaddr
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/go-logr/logr"
+)
+
+func TestReconcilerIngress(t *testing.T) {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Status: networkingv1.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.0.30"}},
+		}},
+	}
+	c := fake.NewClientBuilder().WithObjects(ing, newService("ingress-nginx", "ingress-nginx-controller", nil, "10.96.0.30")).Build()
+
+	initialized := false
+	var reconciled []*corev1.Service
+	r := &Reconciler{
+		Client:      c,
+		Log:         log.NullLogger{},
+		Kind:        KindIngress,
+		Recorder:    record.NewFakeRecorder(10),
+		Backing:     Backing{DefaultService: "ingress-nginx/ingress-nginx-controller"},
+		Initialized: func() bool { return initialized },
+		ReconcileService: func(logger logr.Logger, kind string, req ctrl.Request, svc *corev1.Service) ([]Conflict, error) {
+			if kind != KindIngress {
+				t.Errorf("wrong kind - %s", kind)
+			}
+			reconciled = append(reconciled, svc)
+			return nil, nil
+		},
+		backingRefs: newBackingIndex(),
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}}
+	backing := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress-nginx", Name: "ingress-nginx-controller"}}
+
+	// Ingresses are requeued until rules are initialized
+	if result, err := r.Reconcile(context.Background(), req); err != nil || result.RequeueAfter == 0 || len(reconciled) != 0 {
+		t.Errorf("not requeued before init - %v %v", result, err)
+	}
+
+	// The service for the addresses is reconciled and the ingress is enqueued for its backing service
+	initialized = true
+	if _, err := r.Reconcile(context.Background(), req); err != nil || len(reconciled) != 1 || reconciled[0] == nil ||
+		reconciled[0].Name != "ingress.web" || reconciled[0].Spec.ClusterIP != "10.96.0.30" {
+		t.Fatalf("wrong reconciled service - %v %v", reconciled, err)
+	}
+	if reqs := r.getResourcesOfService(backing); !reflect.DeepEqual(reqs, []ctrl.Request{req}) {
+		t.Errorf("wrong requests of backing service - %v", reqs)
+	}
+
+	// Removed ingress reconciles no service and isn't enqueued anymore
+	if err := c.Delete(context.Background(), ing); err != nil {
+		t.Fatalf("failed to delete ingress : %v", err)
+	}
+	if _, err := r.Reconcile(context.Background(), req); err != nil || len(reconciled) != 2 || reconciled[1] != nil {
+		t.Errorf("wrong reconciled service of removed ingress - %v %v", reconciled, err)
+	}
+	if reqs := r.getResourcesOfService(backing); len(reqs) != 0 {
+		t.Errorf("wrong requests of backing service - %v", reqs)
+	}
+}
+
+func TestReconcilerEvents(t *testing.T) {
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "web",
+			Annotations: map[string]string{AnnotationBackingService: "kube-system/kube-dns"}},
+		Status: networkingv1.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.0.30"}},
+		}},
+	}
+	c := fake.NewClientBuilder().WithObjects(ing, newService("kube-system", "kube-dns", nil, "10.96.0.10")).Build()
+	recorder := record.NewFakeRecorder(10)
+	var conflicts []Conflict
+	var reconciled *corev1.Service
+	r := &Reconciler{
+		Client:      c,
+		Log:         log.NullLogger{},
+		Recorder:    recorder,
+		Kind:        KindIngress,
+		Initialized: func() bool { return true },
+		ReconcileService: func(logger logr.Logger, kind string, req ctrl.Request, svc *corev1.Service) ([]Conflict, error) {
+			reconciled = svc
+			return conflicts, nil
+		},
+		backingRefs: newBackingIndex(),
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "tenant", Name: "web"}}
+
+	// The service in another namespace isn't allowed
+	if _, err := r.Reconcile(context.Background(), req); err != nil || reconciled != nil {
+		t.Fatalf("wrong reconciled service - %v %v", reconciled, err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, EventReasonBackingServiceNotAllowed) {
+		t.Errorf("wrong event - %s", event)
+	}
+
+	// Conflicts of the addresses
+	r.Backing = Backing{AllowedServices: []string{"kube-system/kube-dns"}}
+	conflicts = []Conflict{{Address: "192.168.0.30", Owner: types.NamespacedName{Namespace: "default", Name: "ingress.old"}}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil || reconciled == nil {
+		t.Fatalf("wrong reconciled service - %v %v", reconciled, err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, EventReasonAddressConflict) || !strings.Contains(event, "default/ingress.old") {
+		t.Errorf("wrong event - %s", event)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected events - %d", len(recorder.Events))
+	}
+}
+
+func TestReconcilerGatewayOfLabeledService(t *testing.T) {
+	r := &Reconciler{Kind: KindGateway, gatewayGVK: gatewayGVK, backingRefs: newBackingIndex()}
+	svc := newService("default", "gw-istio", map[string]string{LabelGatewayName: "gw"}, "10.96.0.10")
+	expected := []ctrl.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "gw"}}}
+	if reqs := r.getResourcesOfService(svc); !reflect.DeepEqual(reqs, expected) {
+		t.Errorf("wrong requests of labeled service - %v", reqs)
+	}
+	if obj := r.newObject(); obj.GetObjectKind().GroupVersionKind() != gatewayGVK {
+		t.Errorf("wrong gvk of gateway - %v", obj.GetObjectKind().GroupVersionKind())
+	}
+
+	// Labels are ignored for ingresses
+	r.Kind = KindIngress
+	if reqs := r.getResourcesOfService(svc); len(reqs) != 0 {
+		t.Errorf("wrong requests of labeled service for ingresses - %v", reqs)
+	}
+}
@@ -0,0 +1,339 @@
+package statusaddr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kakao/network-node-manager/pkg/utils"
+)
+
+// Const
+const (
+	KindGateway = "gateway"
+	KindIngress = "ingress"
+
+	AnnotationBackingService = "network-node-manager.kakaocorp.com/backing-service"
+	LabelGatewayName         = "gateway.networking.k8s.io/gateway-name"
+
+	gatewayAddressTypeIP = "IPAddress"
+)
+
+// Vars
+var (
+	GatewayGroupKind = schema.GroupKind{Group: "gateway.networking.k8s.io", Kind: "Gateway"}
+	// GatewayVersions are the versions of Gateway API in order of preference. The addresses in the status are the same in them.
+	GatewayVersions = []string{"v1", "v1beta1", "v1alpha2"}
+)
+
+// GetGatewayGVK returns the group version kind of gateways served by the cluster. It returns an error
+// if the cluster serves none of the supported versions of Gateway API.
+func GetGatewayGVK(mapper meta.RESTMapper) (schema.GroupVersionKind, error) {
+	mapping, err := mapper.RESTMapping(GatewayGroupKind, GatewayVersions...)
+	if err != nil {
+		return schema.GroupVersionKind{}, fmt.Errorf("gateway API isn't served in the cluster. one of %s/%s is required : %w",
+			GatewayGroupKind.Group, strings.Join(GatewayVersions, ","), err)
+	}
+	return mapping.GroupVersionKind, nil
+}
+
+// NewGateway returns an empty gateway of the version to get it with the client. Gateways are handled as unstructured objects
+// not to depend on the Gateway API module.
+func NewGateway(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+	gw := &unstructured.Unstructured{}
+	gw.SetGroupVersionKind(gvk)
+	return gw
+}
+
+// NewGatewayList returns an empty gateway list of the version to list them with the client
+func NewGatewayList(gvk schema.GroupVersionKind) *unstructured.UnstructuredList {
+	gws := &unstructured.UnstructuredList{}
+	gws.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	return gws
+}
+
+// GetServiceName returns the name of the service made for the addresses of the resource.
+// Service names can't have dots, so it never conflicts with the names of the real services.
+func GetServiceName(kind, name string) string {
+	return kind + "." + name
+}
+
+// GetGatewayAddresses returns the IP addresses in the status of the gateway. Hostname addresses are ignored.
+func GetGatewayAddresses(gw *unstructured.Unstructured) []string {
+	addresses, _, _ := unstructured.NestedSlice(gw.Object, "status", "addresses")
+	result := []string{}
+	for _, address := range addresses {
+		fields, ok := address.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// The type is IPAddress by default
+		addrType, _, _ := unstructured.NestedString(fields, "type")
+		value, _, _ := unstructured.NestedString(fields, "value")
+		if (addrType == "" || addrType == gatewayAddressTypeIP) && net.ParseIP(value) != nil {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// GetIngressAddresses returns the IP addresses in the load balancer status of the ingress. Hostnames are ignored.
+func GetIngressAddresses(ing *networkingv1.Ingress) []string {
+	result := []string{}
+	for _, ingress := range ing.Status.LoadBalancer.Ingress {
+		if net.ParseIP(ingress.IP) != nil {
+			result = append(result, ingress.IP)
+		}
+	}
+	return result
+}
+
+// Backing is the config of the backing services of gateways and ingresses set by the operator
+type Backing struct {
+	// DefaultService is the "namespace/name" of the backing service of the ingresses without the backing service annotation
+	DefaultService string
+	// AllowedServices are the "namespace/name" of the services which the backing service annotation can reference
+	// in other namespaces. The default service is also allowed.
+	AllowedServices []string
+}
+
+// isAllowed returns whether the resources in the namespace can reference the service. Users who can annotate a resource
+// don't always own the services in other namespaces, so only the services allowed by the operator can be referenced.
+func (b Backing) isAllowed(namespace string, ref types.NamespacedName) bool {
+	return ref.Namespace == namespace || ref.String() == b.DefaultService || containsString(b.AllowedServices, ref.String())
+}
+
+// Conflict is the address of a resource which is already used by the service of an older resource
+type Conflict struct {
+	Address string
+	// Owner is the service for the addresses of the older resource
+	Owner types.NamespacedName
+}
+
+// GetBackingServiceRef returns the backing service in the annotation of the object, or the default service if the object
+// doesn't have the annotation. The annotation is the name of the service in the namespace of the object or "namespace/name"
+// of the service allowed by the backing config. It returns false if the annotation is wrong or not allowed.
+func GetBackingServiceRef(obj metav1.Object, backing Backing) (types.NamespacedName, bool) {
+	ref, ok := obj.GetAnnotations()[AnnotationBackingService]
+	if !ok {
+		ref = backing.DefaultService
+	}
+
+	var result types.NamespacedName
+	names := strings.Split(strings.TrimSpace(ref), "/")
+	switch {
+	case len(names) == 1 && names[0] != "":
+		result = types.NamespacedName{Namespace: obj.GetNamespace(), Name: names[0]}
+	case len(names) == 2 && names[0] != "" && names[1] != "":
+		result = types.NamespacedName{Namespace: names[0], Name: names[1]}
+	default:
+		return types.NamespacedName{}, false
+	}
+	if ok && !backing.isAllowed(obj.GetNamespace(), result) {
+		return types.NamespacedName{}, false
+	}
+	return result, true
+}
+
+// GetGatewayService returns the service for the addresses of the gateway. The backing service is the service in the annotation,
+// or the service labeled with the name of the gateway by Gateway API implementations. If there is no backing service
+// or no address to DNAT, it returns nil.
+func GetGatewayService(ctx context.Context, reader client.Reader, gw *unstructured.Unstructured, backing Backing) (*corev1.Service, error) {
+	var backingSvc *corev1.Service
+	if _, ok := gw.GetAnnotations()[AnnotationBackingService]; ok {
+		// Gateways don't have the default service
+		ref, ok := GetBackingServiceRef(gw, Backing{AllowedServices: backing.AllowedServices})
+		if !ok {
+			return nil, nil
+		}
+		svc, err := getService(ctx, reader, ref)
+		if err != nil {
+			return nil, err
+		}
+		backingSvc = svc
+	} else {
+		svcs := &corev1.ServiceList{}
+		if err := reader.List(ctx, svcs, client.InNamespace(gw.GetNamespace()),
+			client.MatchingLabels{LabelGatewayName: gw.GetName()}); err != nil {
+			return nil, err
+		}
+		// Use the first service by name to be stable if several services are labeled
+		for i := range svcs.Items {
+			if backingSvc == nil || svcs.Items[i].Name < backingSvc.Name {
+				backingSvc = &svcs.Items[i]
+			}
+		}
+	}
+	if backingSvc == nil {
+		return nil, nil
+	}
+	return NewService(KindGateway, gw, backingSvc, GetGatewayAddresses(gw)), nil
+}
+
+// GetIngressService returns the service for the addresses of the ingress. The backing service is the service in the annotation,
+// or the default service which is usually the service of the ingress controller. If there is no backing service
+// or no address to DNAT, it returns nil.
+func GetIngressService(ctx context.Context, reader client.Reader, ing *networkingv1.Ingress, backing Backing) (*corev1.Service, error) {
+	ref, ok := GetBackingServiceRef(ing, backing)
+	if !ok {
+		return nil, nil
+	}
+	backingSvc, err := getService(ctx, reader, ref)
+	if err != nil || backingSvc == nil {
+		return nil, err
+	}
+	return NewService(KindIngress, ing, backingSvc, GetIngressAddresses(ing)), nil
+}
+
+// NewService returns the service for the addresses of the resource made from the backing service. The addresses are set
+// as the load balancer ingress IPs of the service, so that the externalIP to clusterIP rules DNAT them to the clusterIP of
+// the backing service. The addresses which the backing service already has are excluded because the rules of the backing
+// service DNAT them. If no address is left, it returns nil. The creation time of the resource is kept to dedupe addresses.
+func NewService(kind string, obj metav1.Object, backing *corev1.Service, addresses []string) *corev1.Service {
+	backingIPs := utils.GetExternalIPs(backing)
+	ingress := []corev1.LoadBalancerIngress{}
+	for _, address := range addresses {
+		if !containsString(backingIPs, address) {
+			ingress = append(ingress, corev1.LoadBalancerIngress{IP: address})
+		}
+	}
+	if len(ingress) == 0 {
+		return nil
+	}
+
+	// The endpoints of the backing service aren't tracked for the addresses, so packets are always DNATed to the clusterIP
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         obj.GetNamespace(),
+			Name:              GetServiceName(kind, obj.GetName()),
+			CreationTimestamp: obj.GetCreationTimestamp(),
+		},
+		Spec: corev1.ServiceSpec{
+			Type:                  backing.Spec.Type,
+			ClusterIP:             backing.Spec.ClusterIP,
+			ClusterIPs:            append([]string{}, backing.Spec.ClusterIPs...),
+			IPFamilies:            append([]corev1.IPFamily{}, backing.Spec.IPFamilies...),
+			Ports:                 append([]corev1.ServicePort{}, backing.Spec.Ports...),
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeCluster,
+		},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: ingress}},
+	}
+}
+
+// Dedupe returns the services for the addresses of which the addresses used by the services of older resources are excluded,
+// because only one rule can DNAT an address. The oldest resource keeps the address, so that a new resource can't take
+// the address of an existing one. The services without addresses left are excluded. It also returns the conflicts of
+// each service with the owner having another clusterIP. The services of the same clusterIP share the address silently.
+func Dedupe(svcs []corev1.Service) ([]corev1.Service, map[types.NamespacedName][]Conflict) {
+	sorted := append([]corev1.Service{}, svcs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].CreationTimestamp.Equal(&sorted[j].CreationTimestamp) {
+			return sorted[i].CreationTimestamp.Before(&sorted[j].CreationTimestamp)
+		}
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	result := []corev1.Service{}
+	conflicts := map[types.NamespacedName][]Conflict{}
+	owners := map[string]*corev1.Service{}
+	for i := range sorted {
+		svc := sorted[i].DeepCopy()
+		key := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+		ingress := []corev1.LoadBalancerIngress{}
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			owner, ok := owners[lb.IP]
+			if !ok {
+				owners[lb.IP] = &sorted[i]
+				ingress = append(ingress, lb)
+				continue
+			}
+			if owner.Spec.ClusterIP != svc.Spec.ClusterIP {
+				conflicts[key] = append(conflicts[key], Conflict{
+					Address: lb.IP,
+					Owner:   types.NamespacedName{Namespace: owner.Namespace, Name: owner.Name},
+				})
+			}
+		}
+		if len(ingress) != 0 {
+			svc.Status.LoadBalancer.Ingress = ingress
+			result = append(result, *svc)
+		}
+	}
+	return result, conflicts
+}
+
+// List returns the services for the addresses of all gateways and ingresses if they are enabled. The addresses aren't deduped.
+func List(ctx context.Context, c client.Client, gateway, ingress bool, backing Backing) ([]corev1.Service, error) {
+	result := []corev1.Service{}
+	if gateway {
+		gvk, err := GetGatewayGVK(c.RESTMapper())
+		if err != nil {
+			return nil, err
+		}
+		gws := NewGatewayList(gvk)
+		if err := c.List(ctx, gws, client.InNamespace("")); err != nil {
+			return nil, err
+		}
+		for i := range gws.Items {
+			svc, err := GetGatewayService(ctx, c, &gws.Items[i], backing)
+			if err != nil {
+				return nil, err
+			}
+			if svc != nil {
+				result = append(result, *svc)
+			}
+		}
+	}
+	if ingress {
+		ings := &networkingv1.IngressList{}
+		if err := c.List(ctx, ings, client.InNamespace("")); err != nil {
+			return nil, err
+		}
+		for i := range ings.Items {
+			svc, err := GetIngressService(ctx, c, &ings.Items[i], backing)
+			if err != nil {
+				return nil, err
+			}
+			if svc != nil {
+				result = append(result, *svc)
+			}
+		}
+	}
+	return result, nil
+}
+
+// getService returns the service, or nil if it doesn't exist
+func getService(ctx context.Context, reader client.Reader, ref types.NamespacedName) (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	if err := reader.Get(ctx, ref, svc); err != nil {
+		if apierror.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return svc, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
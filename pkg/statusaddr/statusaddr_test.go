@@ -0,0 +1,245 @@
+package statusaddr
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var gatewayGVK = GatewayGroupKind.WithVersion("v1beta1")
+
+func newGateway(annotations map[string]string, addresses ...map[string]interface{}) *unstructured.Unstructured {
+	gw := NewGateway(gatewayGVK)
+	gw.SetNamespace("default")
+	gw.SetName("gw")
+	gw.SetAnnotations(annotations)
+	items := []interface{}{}
+	for _, address := range addresses {
+		items = append(items, address)
+	}
+	unstructured.SetNestedSlice(gw.Object, items, "status", "addresses")
+	return gw
+}
+
+func newService(namespace, name string, labels map[string]string, clusterIP string, lbIPs ...string) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec: corev1.ServiceSpec{
+			Type:       corev1.ServiceTypeLoadBalancer,
+			ClusterIP:  clusterIP,
+			ClusterIPs: []string{clusterIP},
+			IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol},
+			Ports:      []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	}
+	for _, ip := range lbIPs {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return svc
+}
+
+func TestGetGatewayGVK(t *testing.T) {
+	tests := []struct {
+		versions []string
+		expected string
+	}{
+		{[]string{"v1alpha2", "v1beta1", "v1"}, "v1"},
+		{[]string{"v1alpha2", "v1beta1"}, "v1beta1"},
+		{[]string{"v1alpha2"}, "v1alpha2"},
+	}
+	for _, test := range tests {
+		mapper := meta.NewDefaultRESTMapper(nil)
+		for _, version := range test.versions {
+			mapper.Add(GatewayGroupKind.WithVersion(version), meta.RESTScopeNamespace)
+		}
+		if gvk, err := GetGatewayGVK(mapper); err != nil || gvk != GatewayGroupKind.WithVersion(test.expected) {
+			t.Errorf("wrong gvk of %v - %v %v", test.versions, gvk, err)
+		}
+	}
+
+	// Gateway API isn't served or served in an unsupported version
+	for _, versions := range [][]string{nil, {"v1alpha1"}} {
+		mapper := meta.NewDefaultRESTMapper(nil)
+		for _, version := range versions {
+			mapper.Add(GatewayGroupKind.WithVersion(version), meta.RESTScopeNamespace)
+		}
+		if gvk, err := GetGatewayGVK(mapper); err == nil {
+			t.Errorf("no error for %v - %v", versions, gvk)
+		}
+	}
+}
+
+func TestNewGatewayList(t *testing.T) {
+	gws := NewGatewayList(gatewayGVK)
+	if gvk := gws.GroupVersionKind(); gvk != (schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1beta1", Kind: "GatewayList"}) {
+		t.Errorf("wrong gvk - %v", gvk)
+	}
+}
+
+func TestGetGatewayAddresses(t *testing.T) {
+	gw := newGateway(nil,
+		map[string]interface{}{"type": "IPAddress", "value": "192.168.0.10"},
+		map[string]interface{}{"value": "fd00::10"},
+		map[string]interface{}{"type": "Hostname", "value": "gw.example.com"},
+		map[string]interface{}{"type": "IPAddress", "value": "wrong"},
+	)
+	if addresses := GetGatewayAddresses(gw); !reflect.DeepEqual(addresses, []string{"192.168.0.10", "fd00::10"}) {
+		t.Errorf("wrong addresses - %v", addresses)
+	}
+	if addresses := GetGatewayAddresses(NewGateway(gatewayGVK)); len(addresses) != 0 {
+		t.Errorf("wrong addresses without status - %v", addresses)
+	}
+}
+
+func TestGetBackingServiceRef(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		backing     Backing
+		ref         types.NamespacedName
+		ok          bool
+	}{
+		{map[string]string{AnnotationBackingService: "gw-svc"}, Backing{}, types.NamespacedName{Namespace: "default", Name: "gw-svc"}, true},
+		{map[string]string{AnnotationBackingService: "default/gw-svc"}, Backing{}, types.NamespacedName{Namespace: "default", Name: "gw-svc"}, true},
+		{nil, Backing{DefaultService: "ingress/controller"}, types.NamespacedName{Namespace: "ingress", Name: "controller"}, true},
+		{nil, Backing{}, types.NamespacedName{}, false},
+		{map[string]string{AnnotationBackingService: "a/b/c"}, Backing{DefaultService: "ingress/controller"}, types.NamespacedName{}, false},
+
+		// Services in other namespaces must be allowed
+		{map[string]string{AnnotationBackingService: "infra/gw-svc"}, Backing{DefaultService: "ingress/controller"}, types.NamespacedName{}, false},
+		{map[string]string{AnnotationBackingService: "infra/gw-svc"}, Backing{AllowedServices: []string{"infra/gw-svc"}},
+			types.NamespacedName{Namespace: "infra", Name: "gw-svc"}, true},
+		{map[string]string{AnnotationBackingService: "ingress/controller"}, Backing{DefaultService: "ingress/controller"},
+			types.NamespacedName{Namespace: "ingress", Name: "controller"}, true},
+	}
+	for _, test := range tests {
+		obj := &metav1.ObjectMeta{Namespace: "default", Name: "test", Annotations: test.annotations}
+		if ref, ok := GetBackingServiceRef(obj, test.backing); ref != test.ref || ok != test.ok {
+			t.Errorf("wrong ref of %v %v - %v %v", test.annotations, test.backing, ref, ok)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	newAddrService := func(name string, created int64, clusterIP string, ips ...string) corev1.Service {
+		backing := newService("default", "backing", nil, clusterIP)
+		obj := &metav1.ObjectMeta{Namespace: "default", Name: name, CreationTimestamp: metav1.Unix(created, 0)}
+		return *NewService(KindIngress, obj, backing, ips)
+	}
+	svcs := []corev1.Service{
+		newAddrService("new", 300, "10.96.0.20", "192.168.0.10", "192.168.0.30"),
+		newAddrService("same", 200, "10.96.0.10", "192.168.0.10"),
+		newAddrService("old", 100, "10.96.0.10", "192.168.0.10", "192.168.0.20"),
+		newAddrService("taken", 400, "10.96.0.30", "192.168.0.20"),
+	}
+
+	// The oldest service keeps the addresses. The service of the same clusterIP doesn't conflict.
+	result, conflicts := Dedupe(svcs)
+	expected := map[string][]string{"ingress.old": {"192.168.0.10", "192.168.0.20"}, "ingress.new": {"192.168.0.30"}}
+	if len(result) != len(expected) {
+		t.Fatalf("wrong services - %v", result)
+	}
+	for _, svc := range result {
+		if ips := getLBIPs(&svc); !reflect.DeepEqual(ips, expected[svc.Name]) {
+			t.Errorf("wrong addresses of %s - %v", svc.Name, ips)
+		}
+	}
+	owner := types.NamespacedName{Namespace: "default", Name: "ingress.old"}
+	if !reflect.DeepEqual(conflicts, map[types.NamespacedName][]Conflict{
+		{Namespace: "default", Name: "ingress.new"}:   {{Address: "192.168.0.10", Owner: owner}},
+		{Namespace: "default", Name: "ingress.taken"}: {{Address: "192.168.0.20", Owner: owner}},
+	}) {
+		t.Errorf("wrong conflicts - %v", conflicts)
+	}
+
+	// The input isn't changed
+	if len(svcs[0].Status.LoadBalancer.Ingress) != 2 {
+		t.Errorf("input is changed - %v", svcs[0])
+	}
+}
+
+func getLBIPs(svc *corev1.Service) []string {
+	result := []string{}
+	for _, lb := range svc.Status.LoadBalancer.Ingress {
+		result = append(result, lb.IP)
+	}
+	return result
+}
+
+func TestGetGatewayService(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		newService("default", "gw-istio", map[string]string{LabelGatewayName: "gw"}, "10.96.0.10"),
+		newService("default", "gw-other", map[string]string{LabelGatewayName: "gw"}, "10.96.0.11"),
+		newService("infra", "gw-svc", nil, "10.96.0.20", "192.168.0.20"),
+	).Build()
+	address := map[string]interface{}{"type": "IPAddress", "value": "192.168.0.10"}
+
+	// Labeled service
+	svc, err := GetGatewayService(context.Background(), c, newGateway(nil, address), Backing{})
+	if err != nil || svc == nil {
+		t.Fatalf("failed to get service - %v", err)
+	}
+	if svc.Namespace != "default" || svc.Name != "gateway.gw" || svc.Spec.ClusterIP != "10.96.0.10" ||
+		!reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, []corev1.LoadBalancerIngress{{IP: "192.168.0.10"}}) {
+		t.Errorf("wrong service - %v", svc)
+	}
+
+	// Annotated service. The address of the backing service is excluded.
+	gw := newGateway(map[string]string{AnnotationBackingService: "infra/gw-svc"}, address,
+		map[string]interface{}{"type": "IPAddress", "value": "192.168.0.20"})
+	svc, err = GetGatewayService(context.Background(), c, gw, Backing{AllowedServices: []string{"infra/gw-svc"}})
+	if err != nil || svc == nil || svc.Spec.ClusterIP != "10.96.0.20" ||
+		!reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, []corev1.LoadBalancerIngress{{IP: "192.168.0.10"}}) {
+		t.Errorf("wrong service - %v %v", svc, err)
+	}
+
+	// The annotated service in another namespace isn't allowed. The labeled service isn't used instead.
+	if svc, err := GetGatewayService(context.Background(), c, gw, Backing{DefaultService: "infra/gw-svc"}); err != nil || svc != nil {
+		t.Errorf("wrong service of not allowed backing service - %v %v", svc, err)
+	}
+
+	// No backing service and no address
+	for _, gw := range []*unstructured.Unstructured{
+		newGateway(map[string]string{AnnotationBackingService: "unknown"}, address),
+		newGateway(map[string]string{AnnotationBackingService: "infra/gw-svc"},
+			map[string]interface{}{"type": "IPAddress", "value": "192.168.0.20"}),
+	} {
+		if svc, err := GetGatewayService(context.Background(), c, gw, Backing{AllowedServices: []string{"infra/gw-svc"}}); err != nil || svc != nil {
+			t.Errorf("wrong service - %v %v", svc, err)
+		}
+	}
+}
+
+func TestGetIngressService(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		newService("ingress-nginx", "ingress-nginx-controller", nil, "10.96.0.30"),
+	).Build()
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Status: networkingv1.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.0.30"}, {Hostname: "web.example.com"}},
+		}},
+	}
+
+	svc, err := GetIngressService(context.Background(), c, ing, Backing{DefaultService: "ingress-nginx/ingress-nginx-controller"})
+	if err != nil || svc == nil {
+		t.Fatalf("failed to get service - %v", err)
+	}
+	if svc.Namespace != "default" || svc.Name != "ingress.web" || svc.Spec.ClusterIP != "10.96.0.30" ||
+		!reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, []corev1.LoadBalancerIngress{{IP: "192.168.0.30"}}) {
+		t.Errorf("wrong service - %v", svc)
+	}
+
+	// No default service
+	if svc, err := GetIngressService(context.Background(), c, ing, Backing{}); err != nil || svc != nil {
+		t.Errorf("wrong service - %v %v", svc, err)
+	}
+}
@@ -0,0 +1,325 @@
+package sysctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-logr/logr"
+)
+
+// Param is a kernel parameter and its desired value
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Change is a change of a kernel parameter made by Apply or Restore
+type Change struct {
+	Name string
+	From string
+	To   string
+}
+
+// State records the original values of the kernel parameters changed by network-node-manager
+// to restore them after network-node-manager is restarted
+type State struct {
+	Originals map[string]string `json:"originals"`
+}
+
+// Const
+const (
+	DefaultRoot = "/proc/sys"
+)
+
+// Vars
+var (
+	lock = &sync.Mutex{}
+	root = DefaultRoot
+
+	dryRun       = false
+	dryRunLogger logr.Logger
+)
+
+// SetRoot replaces the root directory of kernel parameters and returns the previous one. It's used for tests.
+func SetRoot(r string) string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	prev := root
+	root = r
+	return prev
+}
+
+// SetDryRun makes kernel parameters be logged instead of being written
+func SetDryRun(logger logr.Logger) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	dryRun = true
+	dryRunLogger = logger
+}
+
+// ParseParam parses the param in "name=value" format
+func ParseParam(config string) (Param, error) {
+	tokens := strings.SplitN(config, "=", 2)
+	if len(tokens) != 2 {
+		return Param{}, fmt.Errorf("wrong sysctl param : %s", config)
+	}
+	param := Param{Name: strings.TrimSpace(tokens[0]), Value: normalizeValue(tokens[1])}
+	if _, err := getPath(param.Name); err != nil || param.Value == "" {
+		return Param{}, fmt.Errorf("wrong sysctl param : %s", config)
+	}
+	return param, nil
+}
+
+// Get returns the value of the kernel parameter. Names are in the dotted format like "net.ipv4.ip_forward".
+// Use slashes to separate names with dots like "net/ipv4/conf/eth0.100/rp_filter".
+func Get(name string) (string, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return get(name)
+}
+
+// Set sets the value of the kernel parameter
+func Set(name, value string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return set(name, value)
+}
+
+// CheckWritable returns an error if a kernel parameter can't be written. "/proc/sys" is mounted read-only
+// in unprivileged containers. In dry-run mode, nothing is written, so it isn't checked.
+func CheckWritable(params []Param) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if dryRun {
+		return nil
+	}
+	for _, param := range params {
+		path, err := getPath(param.Name)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(root, path), os.O_WRONLY, 0)
+		if errors.Is(err, syscall.EROFS) {
+			return fmt.Errorf("sysctl param %s is read-only. run network-node-manager in a privileged container : %w", param.Name, err)
+		} else if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// Apply sets the kernel parameters to the desired values. The original value of a param is recorded
+// in the state when the param is changed first, and the recorded params not desired anymore are restored.
+// It returns the changes of params, and the state is changed if there is any change.
+// In dry-run mode, the original values aren't recorded because params aren't changed.
+func Apply(desired []Param, state *State) ([]Change, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if state.Originals == nil {
+		state.Originals = map[string]string{}
+	}
+
+	// Set desired params
+	var changes []Change
+	desiredNames := map[string]bool{}
+	for _, param := range desired {
+		desiredNames[param.Name] = true
+		current, err := get(param.Name)
+		if err != nil {
+			return changes, err
+		}
+		if current == normalizeValue(param.Value) {
+			continue
+		}
+		if _, ok := state.Originals[param.Name]; !ok && !dryRun {
+			state.Originals[param.Name] = current
+		}
+		if err := set(param.Name, param.Value); err != nil {
+			return changes, err
+		}
+		changes = append(changes, Change{Name: param.Name, From: current, To: normalizeValue(param.Value)})
+	}
+
+	// Restore params not desired anymore
+	for _, name := range getSortedNames(state.Originals) {
+		if desiredNames[name] {
+			continue
+		}
+		change, err := restore(name, state)
+		if err != nil {
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	return changes, nil
+}
+
+// Restore restores all the kernel parameters recorded in the state and clears the state
+func Restore(state *State) ([]Change, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var changes []Change
+	for _, name := range getSortedNames(state.Originals) {
+		change, err := restore(name, state)
+		if err != nil {
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// LoadState reads the state file. If the file doesn't exist, it returns an empty state.
+func LoadState(path string) (*State, error) {
+	state := &State{Originals: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Originals == nil {
+		state.Originals = map[string]string{}
+	}
+	return state, nil
+}
+
+// SaveState writes the state file atomically. If the state is empty, the file is removed.
+// In dry-run mode, the state file isn't changed.
+func SaveState(path string, state *State) error {
+	if logger, ok := getDryRunLogger(); ok {
+		logger.Info("dry-run sysctl state", "file", path, "originals", state.Originals)
+		return nil
+	}
+
+	if len(state.Originals) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// getDryRunLogger returns the logger for dry-run mode and whether dry-run mode is set
+func getDryRunLogger() (logr.Logger, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return dryRunLogger, dryRun
+}
+
+// restore sets the param to the original value and removes it from the state. It should be called within lock.
+func restore(name string, state *State) (*Change, error) {
+	original := state.Originals[name]
+	current, err := get(name)
+	if os.IsNotExist(err) {
+		// The param is gone with its interface or module
+		delete(state.Originals, name)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var change *Change
+	if current != original {
+		if err := set(name, original); err != nil {
+			return nil, err
+		}
+		change = &Change{Name: name, From: current, To: original}
+	}
+	delete(state.Originals, name)
+	return change, nil
+}
+
+func get(name string) (string, error) {
+	path, err := getPath(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+	return normalizeValue(string(data)), nil
+}
+
+func set(name, value string) error {
+	path, err := getPath(name)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		dryRunLogger.Info("dry-run sysctl", "name", name, "value", normalizeValue(value))
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(root, path), []byte(normalizeValue(value)+"\n"), 0644)
+}
+
+// getPath returns the relative path of the param under the root
+func getPath(name string) (string, error) {
+	path := name
+	if !strings.Contains(name, "/") {
+		path = strings.ReplaceAll(name, ".", "/")
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "", fmt.Errorf("wrong sysctl name : %s", name)
+	}
+	for _, token := range strings.Split(path, "/") {
+		if token == "" || token == "." || token == ".." {
+			return "", fmt.Errorf("wrong sysctl name : %s", name)
+		}
+	}
+	return path, nil
+}
+
+// normalizeValue trims the value and joins multiple values with a space like sysctl does
+func normalizeValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func getSortedNames(m map[string]string) []string {
+	names := []string{}
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,181 @@
+package sysctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// setFakeRoot creates a fake /proc/sys with the params
+func setFakeRoot(t *testing.T, params map[string]string) string {
+	dir := t.TempDir()
+	for name, value := range params {
+		path, err := getPath(name)
+		if err != nil {
+			t.Fatalf("wrong name %s : %v", name, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prev := SetRoot(dir)
+	t.Cleanup(func() { SetRoot(prev) })
+	return dir
+}
+
+func TestParseParam(t *testing.T) {
+	tests := []struct {
+		config string
+		param  Param
+		err    bool
+	}{
+		{"net.ipv4.ip_forward=1", Param{"net.ipv4.ip_forward", "1"}, false},
+		{" net.ipv4.tcp_rmem = 4096  87380\t6291456 ", Param{"net.ipv4.tcp_rmem", "4096 87380 6291456"}, false},
+		{"net/ipv4/conf/eth0.100/rp_filter=0", Param{"net/ipv4/conf/eth0.100/rp_filter", "0"}, false},
+		{"net.ipv4.ip_forward", Param{}, true},
+		{"net.ipv4.ip_forward=", Param{}, true},
+		{"net/../../etc/passwd=1", Param{}, true},
+		{"=1", Param{}, true},
+	}
+	for _, test := range tests {
+		param, err := ParseParam(test.config)
+		if (err != nil) != test.err || param != test.param {
+			t.Errorf("wrong result for %q - %+v %v", test.config, param, err)
+		}
+	}
+}
+
+func TestApplyAndRestore(t *testing.T) {
+	setFakeRoot(t, map[string]string{
+		"net.netfilter.nf_conntrack_max":            "131072",
+		"net.netfilter.nf_conntrack_tcp_be_liberal": "0",
+		"net.ipv4.conf.all.route_localnet":          "0",
+	})
+	state := &State{}
+
+	// Apply params
+	changes, err := Apply([]Param{
+		{"net.netfilter.nf_conntrack_max", "262144"},
+		{"net.netfilter.nf_conntrack_tcp_be_liberal", "1"},
+		{"net.ipv4.conf.all.route_localnet", "0"},
+	}, state)
+	if err != nil {
+		t.Fatalf("failed to apply : %v", err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("wrong changes - %+v", changes)
+	}
+	if value, _ := Get("net.netfilter.nf_conntrack_max"); value != "262144" {
+		t.Errorf("wrong value - %s", value)
+	}
+	expected := map[string]string{"net.netfilter.nf_conntrack_max": "131072", "net.netfilter.nf_conntrack_tcp_be_liberal": "0"}
+	if !reflect.DeepEqual(state.Originals, expected) {
+		t.Errorf("wrong originals - %v", state.Originals)
+	}
+
+	// Re-assert a param changed by others and keep the first original value
+	if err := Set("net.netfilter.nf_conntrack_max", "65536"); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = Apply([]Param{
+		{"net.netfilter.nf_conntrack_max", "262144"},
+		{"net.netfilter.nf_conntrack_tcp_be_liberal", "1"},
+	}, state)
+	if err != nil || len(changes) != 1 || changes[0].From != "65536" {
+		t.Errorf("wrong changes - %+v %v", changes, err)
+	}
+	if !reflect.DeepEqual(state.Originals, expected) {
+		t.Errorf("wrong originals - %v", state.Originals)
+	}
+
+	// Restore the param not desired anymore
+	if _, err := Apply([]Param{{"net.netfilter.nf_conntrack_max", "262144"}}, state); err != nil {
+		t.Fatalf("failed to apply : %v", err)
+	}
+	if value, _ := Get("net.netfilter.nf_conntrack_tcp_be_liberal"); value != "0" {
+		t.Errorf("not restored - %s", value)
+	}
+
+	// Restore all
+	if _, err := Restore(state); err != nil {
+		t.Fatalf("failed to restore : %v", err)
+	}
+	if value, _ := Get("net.netfilter.nf_conntrack_max"); value != "131072" || len(state.Originals) != 0 {
+		t.Errorf("not restored - %s %v", value, state.Originals)
+	}
+
+	// Apply unknown param
+	if _, err := Apply([]Param{{"net.unknown", "1"}}, state); err == nil {
+		t.Errorf("no error for unknown param")
+	}
+}
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "sysctl.json")
+	state, err := LoadState(path)
+	if err != nil || len(state.Originals) != 0 {
+		t.Fatalf("wrong empty state - %v %v", state, err)
+	}
+
+	state.Originals["net.ipv4.ip_forward"] = "0"
+	if err := SaveState(path, state); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	loaded, err := LoadState(path)
+	if err != nil || !reflect.DeepEqual(loaded, state) {
+		t.Errorf("wrong loaded state - %v %v", loaded, err)
+	}
+
+	// Empty state removes the file
+	if err := SaveState(path, &State{}); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file remains - %v", err)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	setFakeRoot(t, map[string]string{"net.ipv4.ip_forward": "1"})
+	if err := CheckWritable([]Param{{"net.ipv4.ip_forward", "1"}}); err != nil {
+		t.Errorf("failed to check : %v", err)
+	}
+	if err := CheckWritable([]Param{{"net.unknown", "1"}}); err == nil {
+		t.Errorf("no error for unknown param")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	setFakeRoot(t, map[string]string{"net.netfilter.nf_conntrack_max": "131072"})
+	SetDryRun(log.NullLogger{})
+	defer func() { dryRun = false }()
+
+	// Params and originals aren't changed
+	state := &State{}
+	changes, err := Apply([]Param{{"net.netfilter.nf_conntrack_max", "262144"}}, state)
+	if err != nil || len(changes) != 1 {
+		t.Errorf("wrong changes - %+v %v", changes, err)
+	}
+	if value, _ := Get("net.netfilter.nf_conntrack_max"); value != "131072" {
+		t.Errorf("param is changed - %s", value)
+	}
+	if len(state.Originals) != 0 {
+		t.Errorf("originals are recorded - %v", state.Originals)
+	}
+
+	// State file isn't written
+	path := filepath.Join(t.TempDir(), "sysctl.json")
+	if err := SaveState(path, &State{Originals: map[string]string{"net.ipv4.ip_forward": "0"}}); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file is written - %v", err)
+	}
+}
@@ -31,3 +31,44 @@ func GetClusterIPByFamily(ipFamily corev1.IPFamily, service *corev1.Service) str
 	}
 	return ""
 }
+
+// GetExternalIPs returns all the service's externalIPs including load balancer ingress IPs
+func GetExternalIPs(service *corev1.Service) []string {
+	externalIPs := []string{}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			externalIPs = append(externalIPs, ingress.IP)
+		}
+	}
+	externalIPs = append(externalIPs, service.Spec.ExternalIPs...)
+	return externalIPs
+}
+
+// GetPodIPs returns the IPs of the running pod. Host network pods and finished pods have no IPs.
+func GetPodIPs(pod *corev1.Pod) []string {
+	if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil
+	}
+
+	ips := []string{}
+	for _, podIP := range pod.Status.PodIPs {
+		ips = append(ips, podIP.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+// IsSameStrings returns whether the string slices have the same items in the same order
+func IsSameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -93,3 +93,59 @@ func TestGetClusterIPByFamily(t *testing.T) {
 		t.Errorf("wrong result - ipv46SvcFamily - ipv6")
 	}
 }
+
+func TestGetExternalIPs(t *testing.T) {
+	svc := corev1.Service{
+		Spec: corev1.ServiceSpec{
+			ExternalIPs: []string{ipv6Local},
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: ipv4Local}, {Hostname: "localhost"}},
+			},
+		},
+	}
+
+	externalIPs := GetExternalIPs(&svc)
+	if len(externalIPs) != 2 || externalIPs[0] != ipv4Local || externalIPs[1] != ipv6Local {
+		t.Errorf("wrong result - %v", externalIPs)
+	}
+}
+
+func TestGetPodIPs(t *testing.T) {
+	pod := corev1.Pod{
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  ipv4Local,
+			PodIPs: []corev1.PodIP{{IP: ipv4Local}, {IP: ipv6Local}},
+		},
+	}
+	if ips := GetPodIPs(&pod); len(ips) != 2 || ips[0] != ipv4Local || ips[1] != ipv6Local {
+		t.Errorf("wrong result - %v", ips)
+	}
+
+	pod.Status.PodIPs = nil
+	if ips := GetPodIPs(&pod); len(ips) != 1 || ips[0] != ipv4Local {
+		t.Errorf("wrong result - no pod IPs - %v", ips)
+	}
+
+	pod.Status.Phase = corev1.PodSucceeded
+	if ips := GetPodIPs(&pod); len(ips) != 0 {
+		t.Errorf("wrong result - finished pod - %v", ips)
+	}
+
+	pod.Status.Phase = corev1.PodRunning
+	pod.Spec.HostNetwork = true
+	if ips := GetPodIPs(&pod); len(ips) != 0 {
+		t.Errorf("wrong result - host network pod - %v", ips)
+	}
+}
+
+func TestIsSameStrings(t *testing.T) {
+	if !IsSameStrings(nil, []string{}) || !IsSameStrings([]string{"a", "b"}, []string{"a", "b"}) {
+		t.Errorf("same strings are different")
+	}
+	if IsSameStrings([]string{"a", "b"}, []string{"b", "a"}) || IsSameStrings([]string{"a"}, []string{"a", "b"}) {
+		t.Errorf("different strings are same")
+	}
+}